@@ -2,30 +2,52 @@ package main
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"container/heap"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
 	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"net/url"
 	"os"
+	"os/signal"
 	"os/user"
+	"path"
 	"path/filepath"
 	"regexp"
 	"runtime/debug"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	texttemplate "text/template"
 	"time"
+	"unicode"
 
 	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 	"golang.org/x/net/html/charset"
 
 	"gopkg.in/gomail.v2"
 	"gopkg.in/yaml.v2"
+	yaml3 "gopkg.in/yaml.v3"
 )
 
 const AppVersion = "2.2.0"
@@ -37,60 +59,325 @@ var rxReddit = regexp.MustCompile(`http.+reddit.com/r/.+`)
 
 // Feed represents a downloaded news feed
 type Feed struct {
-	Title   string
-	ID      string
-	Link    string
-	Updated time.Time
-	Entries []*FeedEntry
+	Title    string
+	Subtitle string
+	ID       string
+	Link     string
+	Updated  time.Time
+	Entries  []*FeedEntry
 
 	Failure error
+
+	// FetchDuration is how long downloading and parsing the feed took, until
+	// it succeeded or failed.
+	FetchDuration time.Duration
+
+	// AutoDisabled is set when the feed was disabled after repeated failures.
+	AutoDisabled bool
+
+	conf *ConfigFeed
+
+	// next is the URL of the page with older entries, if the feed is paged.
+	next string
+
+	// links are the feed's links, to pick the ID by rel if configured.
+	links []*Link
+
+	// format is the detected feed format, warnings are issues found while
+	// parsing it.
+	format   string
+	warnings []string
+
+	// dropped are new entries that global-dedup dropped as another feed
+	// has them too, they still advance the feed's timestamp.
+	dropped []*FeedEntry
+
+	// sharedLink is set when another configured feed has the same canonical
+	// link, so the link can't identify the feed's timestamp.
+	sharedLink bool
+}
+
+// warnf logs the issue and records it in the feed's warnings.
+func (f *Feed) warnf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Print(msg)
+	f.warnings = append(f.warnings, msg)
 }
 
 // FeedEntry represents a a downloaded news feed entry
 type FeedEntry struct {
-	Title   string
-	Link    string
-	ID      string
-	Updated time.Time
-	Content template.HTML
+	Title        string
+	Link         string
+	ID           string
+	Updated      time.Time
+	Content      template.HTML
+	Thumbnail    string
+	CommentCount int
+	CommentsFeed string
+	Author       string
+	Views        int64
+	Rating       float64
+	Language     string
+	Enclosures   []Enclosure
+	Podcast      *PodcastMeta
+
+	// Boosted is set for entries that match their feed's boost keywords.
+	Boosted bool
+
+	// rawUpdated is the date string that Updated was parsed from.
+	rawUpdated string
+
+	// contentHash is the hash of the entry as downloaded, before its content
+	// is transformed.
+	contentHash string
+}
+
+// Enclosure is a media file attached to an entry, like a podcast episode.
+type Enclosure struct {
+	URL    string
+	Length int64
+	Type   string
+}
+
+// PodcastMeta is the iTunes metadata of a podcast episode.
+type PodcastMeta struct {
+	Duration time.Duration
+	Episode  int
+	Season   int
+	Image    string
+}
+
+// FormatDuration prints the duration as H:MM:SS, or M:SS for episodes
+// shorter than an hour.
+func (pm *PodcastMeta) FormatDuration() string {
+	secs := int(pm.Duration / time.Second)
+	if secs >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", secs/3600, secs/60%60, secs%60)
+	}
+	return fmt.Sprintf("%d:%02d", secs/60, secs%60)
+}
+
+// Layout is the name of the template used to render the feed's entries,
+// either "video" or "entry". Unless configured, YouTube feeds use "video".
+func (f *Feed) Layout() string {
+	if f.conf != nil && f.conf.Layout != "" {
+		return f.conf.Layout
+	}
+
+	u, err := url.Parse(f.Link)
+	if err == nil {
+		h := strings.ToLower(u.Hostname())
+		if h == "youtube.com" || strings.HasSuffix(h, ".youtube.com") {
+			return "video"
+		}
+	}
+
+	return "entry"
+}
+
+// Fragment is the name of the template fragment used to render the feed's
+// entries instead of its layout, if configured.
+func (f *Feed) Fragment() string {
+	if f.conf == nil {
+		return ""
+	}
+	return f.conf.Fragment
 }
 
 func (e *FeedEntry) Copy() *FeedEntry {
 	return &FeedEntry{
-		Title:   e.Title,
-		Link:    e.Link,
-		ID:      e.ID,
-		Updated: e.Updated,
-		Content: e.Content,
+		Title:        e.Title,
+		Link:         e.Link,
+		ID:           e.ID,
+		Updated:      e.Updated,
+		Content:      e.Content,
+		Thumbnail:    e.Thumbnail,
+		CommentCount: e.CommentCount,
+		CommentsFeed: e.CommentsFeed,
+		Author:       e.Author,
+		Views:        e.Views,
+		Rating:       e.Rating,
+		Language:     e.Language,
+		Enclosures:   append([]Enclosure(nil), e.Enclosures...),
+		Podcast:      e.Podcast,
+		Boosted:      e.Boosted,
+		rawUpdated:   e.rawUpdated,
+		contentHash:  e.contentHash,
+	}
+}
+
+// parseCommentCount leniently parses slash:comments, as a malformed count
+// shouldn't fail the whole feed.
+func parseCommentCount(raw string) int {
+	c, err := strconv.Atoi(strings.TrimSpace(raw))
+	if err != nil {
+		return 0
 	}
+	return c
 }
 
 type RSSFeed struct { // v2
 	XMLName       xml.Name  `xml:"rss"`
 	Title         string    `xml:"channel>title"`
+	Description   string    `xml:"channel>description"`
 	Links         []Link    `xml:"channel>link"`
 	LastBuildDate string    `xml:"channel>lastBuildDate"`
+	PubDate       string    `xml:"channel>pubDate"`
+	Language      string    `xml:"channel>language"`
 	Items         []RSSItem `xml:"channel>item"`
 }
 
 type RSSItem struct {
-	Title       string `xml:"title"`
-	Link        string `xml:"link"`
-	Description string `xml:"description"`
-	GUID        string `xml:"guid"`
-	PubDate     string `xml:"pubDate"`
+	Title        string `xml:"title"`
+	Link         string `xml:"link"`
+	Description  string `xml:"description"`
+	Encoded      string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	GUID         string `xml:"guid"`
+	PubDate      string `xml:"pubDate"`
+	DCDate       string `xml:"http://purl.org/dc/elements/1.1/ date"`
+	Creator      string `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	Author       string `xml:"author"`
+	Comments     string `xml:"http://purl.org/rss/1.0/modules/slash/ comments"`
+	CommentsFeed string `xml:"http://wellformedweb.org/CommentAPI/ commentRss"`
+
+	MediaContent   *MediaContent   `xml:"http://search.yahoo.com/mrss/ content"`
+	MediaThumbnail *MediaThumbnail `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+	Enclosures     []RSSEnclosure  `xml:"enclosure"`
+
+	ITunesDuration string       `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd duration"`
+	ITunesEpisode  string       `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd episode"`
+	ITunesSeason   string       `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd season"`
+	ITunesImage    *ITunesImage `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd image"`
 
 	pubTime time.Time
 }
 
+type ITunesImage struct {
+	Href string `xml:"href,attr"`
+}
+
+// podcast returns the item's iTunes metadata, or nil if it has none.
+func (i *RSSItem) podcast() *PodcastMeta {
+	pm := &PodcastMeta{}
+	pm.Duration, _ = parseITunesDuration(i.ITunesDuration)
+	pm.Episode, _ = strconv.Atoi(strings.TrimSpace(i.ITunesEpisode))
+	pm.Season, _ = strconv.Atoi(strings.TrimSpace(i.ITunesSeason))
+	if i.ITunesImage != nil {
+		pm.Image = strings.TrimSpace(i.ITunesImage.Href)
+	}
+
+	if *pm == (PodcastMeta{}) {
+		return nil
+	}
+	return pm
+}
+
+// parseITunesDuration parses an itunes:duration, either in seconds or as
+// [[HH:]MM:]SS.
+func parseITunesDuration(raw string) (time.Duration, bool) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return 0, false
+	}
+
+	ps := strings.Split(raw, ":")
+	if len(ps) > 3 {
+		return 0, false
+	}
+
+	secs := 0
+	for _, p := range ps {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return 0, false
+		}
+		secs = secs*60 + n
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
+type RSSEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length string `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// fullContent returns the content:encoded of an item, which usually holds the
+// full text, falling back to its description, which might be a summary.
+func fullContent(encoded, description string) string {
+	if strings.TrimSpace(encoded) != "" {
+		return unescapeMarkup(encoded)
+	}
+	return unescapeMarkup(description)
+}
+
+var rxEscapedMarkup = regexp.MustCompile(`^&(amp;)*lt;[!/]?[a-zA-Z]`)
+
+// unescapeMarkup unescapes content whose markup was entity encoded once too
+// often, e.g. &lt;p&gt; inside of CDATA. Only content that starts with an
+// escaped tag and has no actual tags is unescaped, other entities are likely
+// meant to be shown as they are.
+func unescapeMarkup(s string) string {
+	for i := 0; i < 3; i++ {
+		t := strings.TrimSpace(s)
+		if strings.Contains(t, "<") || !rxEscapedMarkup.MatchString(t) {
+			break
+		}
+		s = html.UnescapeString(s)
+	}
+	return s
+}
+
+var rxRSSAuthor = regexp.MustCompile(`^\S+@\S+\s+\((.+)\)$`)
+
+// rssAuthor returns the item's dc:creator, falling back to its author, which
+// is an email address that is usually followed by the name in parentheses.
+func rssAuthor(creator, author string) string {
+	if c := strings.TrimSpace(creator); c != "" {
+		return c
+	}
+
+	author = strings.TrimSpace(author)
+	if m := rxRSSAuthor.FindStringSubmatch(author); m != nil {
+		return strings.TrimSpace(m[1])
+	}
+	return author
+}
+
+// date returns the item's pubDate, falling back to its Dublin Core date.
+func (i *RSSItem) date() string {
+	if strings.TrimSpace(i.PubDate) != "" {
+		return i.PubDate
+	}
+	return i.DCDate
+}
+
 func (i *RSSItem) Entry() *FeedEntry {
-	return &FeedEntry{
-		Title:   i.Title,
-		Link:    i.Link,
-		ID:      i.GUID,
-		Updated: i.pubTime,
-		Content: template.HTML(i.Description),
+	content, thumbnail := itemMedia(fullContent(i.Encoded, i.Description), i.MediaContent, i.MediaThumbnail)
+	fe := &FeedEntry{
+		Title:        i.Title,
+		Link:         i.Link,
+		ID:           i.GUID,
+		Updated:      i.pubTime,
+		rawUpdated:   i.date(),
+		Content:      template.HTML(content),
+		Thumbnail:    thumbnail,
+		Author:       rssAuthor(i.Creator, i.Author),
+		CommentCount: parseCommentCount(i.Comments),
+		CommentsFeed: strings.TrimSpace(i.CommentsFeed),
+		Podcast:      i.podcast(),
+	}
+
+	for _, e := range i.Enclosures {
+		if e.URL == "" {
+			continue
+		}
+		// length is required but often empty or bogus
+		length, _ := strconv.ParseInt(strings.TrimSpace(e.Length), 10, 64)
+		fe.Enclosures = append(fe.Enclosures, Enclosure{URL: strings.TrimSpace(e.URL), Length: length, Type: strings.TrimSpace(e.Type)})
 	}
+
+	return fe
 }
 
 func parseTime(raw string) (t time.Time, err error) {
@@ -157,11 +444,23 @@ func (f *RSSFeed) Feed() (*Feed, error) {
 		}
 	}
 
+	var next string
+	links := []*Link{}
+	for i, l := range f.Links {
+		if l.Rel == "next" {
+			next = l.HRef
+		}
+		links = append(links, &f.Links[i])
+	}
+
 	cf := &Feed{
-		ID:      id.HRef,
-		Title:   f.Title,
-		Link:    lk.HRef,
-		Entries: []*FeedEntry{},
+		ID:       id.HRef,
+		Title:    f.Title,
+		Subtitle: strings.TrimSpace(f.Description),
+		Link:     lk.HRef,
+		Entries:  []*FeedEntry{},
+		next:     next,
+		links:    links,
 	}
 
 	var err error
@@ -170,18 +469,25 @@ func (f *RSSFeed) Feed() (*Feed, error) {
 		if err != nil {
 			return nil, fmt.Errorf("lastBuildDate parse error for feed %#v str=%#v err=%w", f.Title, f.LastBuildDate, err)
 		}
+	} else if f.PubDate != "" {
+		cf.Updated, err = parseTime(f.PubDate)
+		if err != nil {
+			return nil, fmt.Errorf("pubDate parse error for feed %#v str=%#v err=%w", f.Title, f.PubDate, err)
+		}
 	}
 
 	for _, e := range f.Items {
-		if e.PubDate == "" {
-			log.Printf("Ignoring item %#v without pubDate field for feed %#v", e.Title, f.Title)
+		if strings.TrimSpace(e.date()) == "" {
+			cf.warnf("Ignoring item %#v without pubDate or dc:date field for feed %#v", e.Title, f.Title)
 			continue
 		}
-		e.pubTime, err = parseTime(e.PubDate)
+		e.pubTime, err = parseTime(e.date())
 		if err != nil {
-			return nil, fmt.Errorf("pubDate parse error for feed title=%#v str=%#v err=%w", f.Title, e.PubDate, err)
+			return nil, fmt.Errorf("pubDate parse error for feed title=%#v str=%#v err=%w", f.Title, e.date(), err)
 		}
-		cf.Entries = append(cf.Entries, e.Entry())
+		fe := e.Entry()
+		fe.Language = strings.TrimSpace(f.Language)
+		cf.Entries = append(cf.Entries, fe)
 	}
 	return cf, nil
 }
@@ -194,11 +500,12 @@ type RDFFeed struct {
 
 func (f *RDFFeed) Feed() (*Feed, error) {
 	cf := &Feed{
-		ID:      f.Channel.Link,
-		Link:    f.Channel.Link,
-		Title:   f.Channel.Title,
-		Updated: f.Channel.Date.Time,
-		Entries: []*FeedEntry{},
+		ID:       f.Channel.Link,
+		Link:     f.Channel.Link,
+		Title:    f.Channel.Title,
+		Subtitle: strings.TrimSpace(f.Channel.Description),
+		Updated:  f.Channel.Date.Time,
+		Entries:  []*FeedEntry{},
 	}
 
 	for _, i := range f.Items {
@@ -209,64 +516,122 @@ func (f *RDFFeed) Feed() (*Feed, error) {
 }
 
 type RDFChannel struct {
-	Title string  `xml:"title"`
-	Link  string  `xml:"link"`
-	Date  xmlTime `xml:"date"`
-}
-
-type RDFItem struct {
 	Title       string  `xml:"title"`
 	Link        string  `xml:"link"`
-	Date        xmlTime `xml:"date"`
 	Description string  `xml:"description"`
+	Date        xmlTime `xml:"date"`
+}
+
+type RDFItem struct {
+	Title        string  `xml:"title"`
+	Link         string  `xml:"link"`
+	Date         xmlTime `xml:"date"`
+	Description  string  `xml:"description"`
+	Creator      string  `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	Encoded      string  `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	Comments     string  `xml:"http://purl.org/rss/1.0/modules/slash/ comments"`
+	CommentsFeed string  `xml:"http://wellformedweb.org/CommentAPI/ commentRss"`
 }
 
 func (i *RDFItem) Entry() *FeedEntry {
 	return &FeedEntry{
-		Title:   i.Title,
-		Link:    i.Link,
-		ID:      i.Link,
-		Updated: i.Date.Time,
-		Content: template.HTML(i.Description),
+		Title:        i.Title,
+		Link:         i.Link,
+		ID:           i.Link,
+		Updated:      i.Date.Time,
+		rawUpdated:   i.Date.Raw,
+		Content:      template.HTML(fullContent(i.Encoded, i.Description)),
+		Author:       strings.TrimSpace(i.Creator),
+		CommentCount: parseCommentCount(i.Comments),
+		CommentsFeed: strings.TrimSpace(i.CommentsFeed),
 	}
 }
 
 type AtomFeed struct {
-	XMLName xml.Name     `xml:"feed"`
-	Title   string       `xml:"title"`
-	Links   []*Link      `xml:"link"`
-	Updated xmlTime      `xml:"updated"`
-	ID      string       `xml:"id"`
-	Entries []*AtomEntry `xml:"entry"`
+	XMLName  xml.Name     `xml:"feed"`
+	Title    string       `xml:"title"`
+	Subtitle string       `xml:"subtitle"`
+	Authors  []AtomAuthor `xml:"author"`
+	Links    []*Link      `xml:"link"`
+	Updated  xmlTime      `xml:"updated"`
+	ID       string       `xml:"id"`
+	Entries  []*AtomEntry `xml:"entry"`
 }
 
 func (f *AtomFeed) Feed() (*Feed, error) {
 	cf := &Feed{
-		ID:      f.ID,
-		Title:   f.Title,
-		Updated: f.Updated.Time,
-		Entries: []*FeedEntry{},
+		ID:       f.ID,
+		Title:    f.Title,
+		Subtitle: strings.TrimSpace(f.Subtitle),
+		Updated:  f.Updated.Time,
+		Entries:  []*FeedEntry{},
+		links:    f.Links,
 	}
 
 	for _, l := range f.Links {
-		if l.Rel != "self" {
+		if l.Rel != "self" && l.Rel != "next" && l.Rel != "previous" {
 			cf.Link = l.HRef
 			break
 		}
 	}
 
+	for _, l := range f.Links {
+		if l.Rel == "next" {
+			cf.next = l.HRef
+		}
+	}
+
+	author := atomAuthorNames(f.Authors)
 	for _, e := range f.Entries {
+		thumbnail := ""
 		if e.Content == "" && e.MediaGroup != nil {
 			e.Content = e.MediaGroup.HTML()
+			if e.MediaGroup.Thumbnail != nil {
+				thumbnail = e.MediaGroup.Thumbnail.URL
+			}
+		} else {
+			if strings.TrimSpace(e.Content) == "" {
+				e.Content = e.Summary
+			}
+			e.Content, thumbnail = itemMedia(e.Content, e.MediaContent, e.MediaThumbnail)
+		}
+		fe := e.Entry()
+		fe.Thumbnail = thumbnail
+		if e.MediaGroup != nil && e.MediaGroup.Community != nil {
+			if st := e.MediaGroup.Community.Statistics; st != nil {
+				fe.Views = st.Views
+			}
+			if sr := e.MediaGroup.Community.StarRating; sr != nil {
+				fe.Rating = sr.Average
+			}
+		}
+		if fe.Author == "" {
+			fe.Author = author
 		}
-		cf.Entries = append(cf.Entries, e.Entry())
+		cf.Entries = append(cf.Entries, fe)
 	}
 
 	return cf, nil
 }
 
+type AtomAuthor struct {
+	Name string `xml:"name"`
+}
+
+func atomAuthorNames(as []AtomAuthor) string {
+	ns := []string{}
+	for _, a := range as {
+		n := strings.TrimSpace(a.Name)
+		if n != "" {
+			ns = append(ns, n)
+		}
+	}
+	return strings.Join(ns, ", ")
+}
+
 type xmlTime struct {
 	time.Time
+	Raw string
 }
 
 func (t *xmlTime) UnmarshalXML(d *xml.Decoder, el xml.StartElement) error {
@@ -277,6 +642,7 @@ func (t *xmlTime) UnmarshalXML(d *xml.Decoder, el xml.StartElement) error {
 		return err
 	}
 
+	t.Raw = v
 	t.Time, err = parseTime(v)
 	if err != nil {
 		return err
@@ -291,6 +657,7 @@ type Link struct {
 	HRef    string
 	Rel     string
 	Type    string
+	Length  int64
 }
 
 func (l *Link) UnmarshalXML(d *xml.Decoder, el xml.StartElement) error {
@@ -311,6 +678,7 @@ func (l *Link) UnmarshalXML(d *xml.Decoder, el xml.StartElement) error {
 	l.HRef = getXMLAttr(el, "href")
 	l.Rel = getXMLAttr(el, "rel")
 	l.Type = getXMLAttr(el, "type")
+	l.Length, _ = strconv.ParseInt(getXMLAttr(el, "length"), 10, 64)
 
 	if l.HRef == "" {
 		return fmt.Errorf("found no href content in link element %#v", el)
@@ -334,22 +702,46 @@ func getXMLAttr(el xml.StartElement, name string) string {
 }
 
 type AtomEntry struct {
-	Title      string      `xml:"title"`
-	Link       Link        `xml:"link"`
-	Updated    xmlTime     `xml:"updated"`
-	ID         string      `xml:"id"`
-	Content    string      `xml:"content"`
-	MediaGroup *MediaGroup `xml:"group"`
+	Title   string  `xml:"title"`
+	Links   []Link  `xml:"link"`
+	Updated xmlTime `xml:"updated"`
+	ID      string  `xml:"id"`
+	// before Content, as the first matching field wins and Content matches
+	// content elements of any namespace.
+	MediaContent   *MediaContent   `xml:"http://search.yahoo.com/mrss/ content"`
+	MediaThumbnail *MediaThumbnail `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+	Content        string          `xml:"content"`
+	Summary        string          `xml:"summary"`
+	Authors        []AtomAuthor    `xml:"author"`
+	MediaGroup     *MediaGroup     `xml:"group"`
 }
 
 func (e *AtomEntry) Entry() *FeedEntry {
-	return &FeedEntry{
+	fe := &FeedEntry{
 		Title:   e.Title,
-		Link:    e.Link.HRef,
 		ID:      e.ID,
 		Updated: e.Updated.Time,
 		Content: template.HTML(e.Content),
+		Author:  atomAuthorNames(e.Authors),
+
+		rawUpdated: e.Updated.Raw,
 	}
+
+	for _, l := range e.Links {
+		switch l.Rel {
+		case "", "alternate":
+			if fe.Link == "" {
+				fe.Link = l.HRef
+			}
+		case "enclosure":
+			fe.Enclosures = append(fe.Enclosures, Enclosure{URL: l.HRef, Length: l.Length, Type: l.Type})
+		}
+	}
+	if fe.Link == "" && len(e.Links) > 0 {
+		fe.Link = e.Links[0].HRef
+	}
+
+	return fe
 }
 
 type MediaGroup struct {
@@ -361,11 +753,36 @@ type MediaGroup struct {
 }
 
 func (mg *MediaGroup) HTML() string {
-	result := fmt.Sprintf(`<div>%s</div>`, mg.Description)
-	if mg.Thumbnail != nil {
-		result += fmt.Sprintf(`<div><a href="%s">%s</a></div>`, mg.Content.URL, mg.Thumbnail.HTML())
+	return fmt.Sprintf(`<div>%s</div>`, mg.Description) + mg.ThumbnailHTML()
+}
+
+// ThumbnailHTML renders the thumbnail, linked to the content if present.
+func (mg *MediaGroup) ThumbnailHTML() string {
+	if mg.Thumbnail == nil {
+		return ""
 	}
-	return result
+	if mg.Content == nil || mg.Content.URL == "" {
+		return fmt.Sprintf(`<div>%s</div>`, mg.Thumbnail.HTML())
+	}
+	return fmt.Sprintf(`<div><a href="%s">%s</a></div>`, mg.Content.URL, mg.Thumbnail.HTML())
+}
+
+// itemMedia appends media elements found directly on an item rather than in
+// a media group to its content, unless the content already shows the image.
+// An image media content without thumbnail is used as the thumbnail.
+func itemMedia(content string, mc *MediaContent, mt *MediaThumbnail) (string, string) {
+	if mt == nil && mc != nil && (mc.Medium == "image" || strings.HasPrefix(mc.Type, "image/")) {
+		mt = &MediaThumbnail{URL: mc.URL, Width: mc.Width, Height: mc.Height}
+	}
+	if mt == nil || mt.URL == "" {
+		return content, ""
+	}
+	if strings.Contains(content, mt.URL) {
+		return content, mt.URL
+	}
+
+	mg := &MediaGroup{Content: mc, Thumbnail: mt}
+	return content + mg.ThumbnailHTML(), mt.URL
 }
 
 type MediaThumbnail struct {
@@ -381,6 +798,7 @@ func (mt *MediaThumbnail) HTML() string {
 type MediaContent struct {
 	URL    string `xml:"url,attr"`
 	Type   string `xml:"type,attr"`
+	Medium string `xml:"medium,attr"`
 	Width  int    `xml:"width,attr"`
 	Height int    `xml:"height,attr"`
 }
@@ -401,52 +819,189 @@ type MediaStatistics struct {
 	Views int64 `xml:"views,attr"`
 }
 
+// ErrEmptyFeed is returned for empty or truncated feed documents.
+var ErrEmptyFeed = errors.New("empty feed")
+
+// JSONFeed is a feed in the JSON Feed format, cf. https://jsonfeed.org
+type JSONFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url"`
+	FeedURL     string         `json:"feed_url"`
+	Description string         `json:"description"`
+	Authors     []JSONAuthor   `json:"authors"`
+	Items       []JSONFeedItem `json:"items"`
+}
+
+type JSONAuthor struct {
+	Name string `json:"name"`
+}
+
+type JSONFeedItem struct {
+	ID            string       `json:"id"`
+	URL           string       `json:"url"`
+	Title         string       `json:"title"`
+	ContentHTML   string       `json:"content_html"`
+	ContentText   string       `json:"content_text"`
+	Image         string       `json:"image"`
+	DatePublished string       `json:"date_published"`
+	DateModified  string       `json:"date_modified"`
+	Authors       []JSONAuthor `json:"authors"`
+	Author        *JSONAuthor  `json:"author"` // v1.0
+}
+
+func jsonAuthorNames(as []JSONAuthor) string {
+	ns := []string{}
+	for _, a := range as {
+		if n := strings.TrimSpace(a.Name); n != "" {
+			ns = append(ns, n)
+		}
+	}
+	return strings.Join(ns, ", ")
+}
+
+func (f *JSONFeed) Feed() (*Feed, error) {
+	cf := &Feed{
+		ID:       f.FeedURL,
+		Title:    f.Title,
+		Subtitle: strings.TrimSpace(f.Description),
+		Link:     f.HomePageURL,
+		Entries:  []*FeedEntry{},
+	}
+	if cf.ID == "" {
+		cf.ID = f.HomePageURL
+	}
+
+	author := jsonAuthorNames(f.Authors)
+	for _, i := range f.Items {
+		raw := i.DateModified
+		if raw == "" {
+			raw = i.DatePublished
+		}
+		if raw == "" {
+			cf.warnf("Ignoring item %#v without date for feed %#v", i.Title, f.Title)
+			continue
+		}
+		updated, err := parseTime(raw)
+		if err != nil {
+			return nil, fmt.Errorf("date parse error for feed title=%#v str=%#v err=%w", f.Title, raw, err)
+		}
+
+		content := i.ContentHTML
+		if content == "" && i.ContentText != "" {
+			content = fmt.Sprintf("<pre>%s</pre>", html.EscapeString(i.ContentText))
+		}
+
+		as := i.Authors
+		if len(as) == 0 && i.Author != nil {
+			as = []JSONAuthor{*i.Author}
+		}
+
+		fe := &FeedEntry{
+			Title:     i.Title,
+			Link:      i.URL,
+			ID:        i.ID,
+			Updated:   updated,
+			Content:   template.HTML(content),
+			Thumbnail: i.Image,
+
+			rawUpdated: raw,
+			Author:     jsonAuthorNames(as),
+		}
+		if fe.Author == "" {
+			fe.Author = author
+		}
+		cf.Entries = append(cf.Entries, fe)
+	}
+
+	return cf, nil
+}
+
 func unmarshal(byt []byte) (*Feed, error) {
-	var atom AtomFeed
-	reader := bytes.NewReader(byt)
-	decoder := xml.NewDecoder(reader)
-	decoder.CharsetReader = charset.NewReaderLabel
+	if trimmed := bytes.TrimSpace(byt); len(trimmed) > 0 && trimmed[0] == '{' {
+		var jf JSONFeed
+		err := decodeJSON(trimmed, &jf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal json feed err=%w", err)
+		}
+		return convertFeed(&jf, "json")
+	}
 
-	atomErr := decoder.Decode(&atom)
+	var atom AtomFeed
+	atomErr := decodeXML(byt, &atom)
 	if atomErr == nil {
-		return (&atom).Feed()
+		return convertFeed(&atom, "atom")
 	}
 
 	var rss RSSFeed
-	reader = bytes.NewReader(byt)
-	decoder = xml.NewDecoder(reader)
-	decoder.CharsetReader = charset.NewReaderLabel
-
-	rssErr := decoder.Decode(&rss)
+	rssErr := decodeXML(byt, &rss)
 	if rssErr == nil {
-		return (&rss).Feed()
+		return convertFeed(&rss, "rss")
 	}
 
 	var rdf RDFFeed
-	reader = bytes.NewReader(byt)
-	decoder = xml.NewDecoder(reader)
-	decoder.CharsetReader = charset.NewReaderLabel
-
-	rdfErr := decoder.Decode(&rdf)
+	rdfErr := decodeXML(byt, &rdf)
 	if rdfErr == nil {
-		return (&rdf).Feed()
+		return convertFeed(&rdf, "rdf")
 	}
 
 	log.Printf("failed to unmarshal feed for atom err=[%v] for rss err=[%v] for rdf err=[%v]", atomErr, rssErr, rdfErr)
 
-	if strings.Contains(rdfErr.Error(), "unexpected EOF") {
-		log.Printf("ignoring EOF err=%s", rdfErr)
-		return nil, nil
+	if len(bytes.TrimSpace(byt)) == 0 || strings.Contains(rdfErr.Error(), "unexpected EOF") {
+		return nil, ErrEmptyFeed
 	}
 
 	return nil, rdfErr
 }
 
+// recoverAsError turns a panic into an error, so that a feed that trips up a
+// decoder fails on its own rather than crashing the whole run.
+func recoverAsError(err *error, what string) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("panic while %s err=%v", what, r)
+	}
+}
+
+func decodeJSON(byt []byte, v any) (err error) {
+	defer recoverAsError(&err, "decoding json")
+	return json.Unmarshal(byt, v)
+}
+
+func decodeXML(byt []byte, v any) (err error) {
+	defer recoverAsError(&err, "decoding xml")
+	decoder := xml.NewDecoder(bytes.NewReader(byt))
+	decoder.CharsetReader = charset.NewReaderLabel
+	return decoder.Decode(v)
+}
+
+// convertFeed converts the decoded feed and records its format.
+func convertFeed(df interface{ Feed() (*Feed, error) }, format string) (f *Feed, err error) {
+	defer recoverAsError(&err, fmt.Sprintf("converting %s feed", format))
+	f, err = df.Feed()
+	if err == nil {
+		f.format = format
+	}
+	return f, err
+}
+
 type FeederFlags struct {
-	Config    string
-	Subscribe string
-	Version   bool
-	BuildInfo bool
+	Config       string
+	Subscribe    string
+	Version      bool
+	BuildInfo    bool
+	JSON         bool
+	SinceLastRun bool
+	Since        time.Duration
+	Strict       bool
+	Loop         time.Duration
+	Render       string
+	Timeout      time.Duration
+	Status       bool
+	ImportOPML   string
+	Explain      string
+	Output       string
+	Only         string
+	Stats        string
 }
 
 func readFlags() (*FeederFlags, error) {
@@ -454,10 +1009,23 @@ func readFlags() (*FeederFlags, error) {
 	flg := &FeederFlags{}
 
 	flags := flag.NewFlagSet("feeder", flag.ExitOnError)
-	flags.StringVar(&flg.Config, "config", "", "Path to config file (default $XDG_CONFIG_HOME/feeder/config.yml)")
+	flags.StringVar(&flg.Config, "config", "", "Path to config file, or - to read it from stdin (default $XDG_CONFIG_HOME/feeder/config.yml)")
 	flags.StringVar(&flg.Subscribe, "subscribe", "", "URL to feed to subscribe to")
+	flags.StringVar(&flg.ImportOPML, "import-opml", "", "Path to OPML file to subscribe to all of its feeds")
 	flags.BoolVar(&flg.Version, "version", false, "Print version information")
 	flags.BoolVar(&flg.BuildInfo, "build-info", false, "Print build information")
+	flags.BoolVar(&flg.JSON, "json", false, "Print version or build information, or the subscribed feed as JSON")
+	flags.StringVar(&flg.Explain, "explain", "", "Download the feed at the given URL and print how it is parsed")
+	flags.StringVar(&flg.Render, "render-template", "", "Render the given email template file with sample data to stdout")
+	flags.StringVar(&flg.Output, "output", "", "Write the email body as HTML to the given file, or stdout for -, instead of sending an email")
+	flags.StringVar(&flg.Stats, "stats", "", "Write a JSON summary of each feed's download and new entries to the given file")
+	flags.BoolVar(&flg.Status, "status", false, "Print the status of each feed as of the last run as JSON")
+	flags.DurationVar(&flg.Timeout, "timeout", 0, "Timeout for each request, overrides the configured timeouts (e.g. 5s)")
+	flags.DurationVar(&flg.Loop, "loop", 0, "Run repeatedly with the given interval (e.g. 30m) until interrupted")
+	flags.BoolVar(&flg.Strict, "strict", false, "Fail on unknown config keys instead of ignoring them, and refuse to subscribe to stale feeds")
+	flags.StringVar(&flg.Only, "only", "", "Comma separated names or URLs of the feeds to process, ignoring all others")
+	flags.BoolVar(&flg.SinceLastRun, "since-last-run", false, "Select entries newer than the timestamp file's modification time for all feeds")
+	flags.DurationVar(&flg.Since, "since", 0, "Select entries newer than the given duration (e.g. 24h) for all feeds, without updating the timestamps or state")
 	flags.Usage = func() {
 		fmt.Fprintf(flags.Output(), "Usage of feeder:\n\n")
 		flags.PrintDefaults()
@@ -483,6 +1051,22 @@ at the given URL and persists the augmented feeds config.
 		return flg, nil
 	}
 
+	if flg.Render != "" {
+		return flg, nil
+	}
+
+	if flg.Since < 0 {
+		return nil, fmt.Errorf("since must not be negative")
+	}
+
+	if flg.Since > 0 && flg.SinceLastRun {
+		return nil, fmt.Errorf("since and since-last-run cannot be combined")
+	}
+
+	if flg.Since > 0 && flg.Loop > 0 {
+		return nil, fmt.Errorf("since and loop cannot be combined")
+	}
+
 	if flg.Config == "" {
 		df, err := defaultConfigPath()
 		if err != nil {
@@ -518,23 +1102,98 @@ func fileExists(path string) bool {
 }
 
 type Config struct {
-	TimestampFile       string       `yaml:"timestamp-file"`
-	EmailTemplateFile   string       `yaml:"email-template-file"`
-	FeedsFile           string       `yaml:"feeds-file"`
-	Email               ConfigEmail  `yaml:"email"`
-	MaxEntriesPerFeed   int          `yaml:"max-entries-per-feed"`
-	ReplaceRelativeURLs bool         `yaml:"replace-relative-urls"`
-	Reddit              ConfigReddit `yaml:"reddit"`
+	TimestampFile         string        `yaml:"timestamp-file"`
+	EmailTemplateFile     string        `yaml:"email-template-file"`
+	TextTemplateFile      string        `yaml:"text-email-template-file"`
+	FeedsFile             StringList    `yaml:"feeds-file"`
+	SubscribeFile         string        `yaml:"subscribe-file"`
+	OutputFile            string        `yaml:"output-file"`
+	Email                 ConfigEmail   `yaml:"email"`
+	MaxEntriesPerFeed     int           `yaml:"max-entries-per-feed"`
+	ReplaceRelativeURLs   bool          `yaml:"replace-relative-urls"`
+	UpgradeInsecureImages string        `yaml:"upgrade-insecure-images"`
+	StripTrackingParams   bool          `yaml:"strip-tracking-params"`
+	StyleCodeBlocks       bool          `yaml:"style-code-blocks"`
+	TrackingParams        []string      `yaml:"tracking-params"`
+	SendRetries           int           `yaml:"send-retries"`
+	SendRetryBackoff      time.Duration `yaml:"send-retry-backoff"`
+	Retries               int           `yaml:"retries"`
+	RetryBackoff          time.Duration `yaml:"retry-backoff"`
+	HTTPTimeout           time.Duration `yaml:"http-timeout"`
+	UserAgent             string        `yaml:"user-agent"`
+	CookieJar             bool          `yaml:"cookie-jar"`
+	CookieFile            string        `yaml:"cookie-file"`
+	Chronological         bool          `yaml:"chronological"`
+	DisplayTimezone       string        `yaml:"display-timezone"`
+	SectionOrder          string        `yaml:"section-order"`
+	ConfigChangeWarning   string        `yaml:"config-change-warning"`
+	DedupByTitle          bool          `yaml:"dedup-by-title"`
+	DedupSimilarity       float64       `yaml:"dedup-similarity"`
+	DedupWindowRuns       int           `yaml:"dedup-window-runs"`
+	DedupByID             bool          `yaml:"dedup-by-id"`
+	GlobalDedup           bool          `yaml:"global-dedup"`
+	SkipUnchangedContent  bool          `yaml:"skip-unchanged-content"`
+	SaveRawFeeds          string        `yaml:"save-raw-feeds"`
+	StateFile             string        `yaml:"state-file"`
+	LogFile               string        `yaml:"log-file"`
+	LogFileMaxSize        int64         `yaml:"log-file-max-size"`
+	LogFileKeep           int           `yaml:"log-file-keep"`
+	MinSendInterval       time.Duration `yaml:"min-send-interval"`
+	StaleFeedAge          time.Duration `yaml:"stale-feed-age"`
+	SendDays              []string      `yaml:"send-days"`
+	AutoDisableAfter      int           `yaml:"auto-disable-after-failures"`
+	FooterHTML            string        `yaml:"footer-html"`
+	Greeting              string        `yaml:"greeting"`
+	Signature             string        `yaml:"signature"`
+	SubjectTemplate       string        `yaml:"subject-template"`
+	ClampFutureDates      bool          `yaml:"clamp-future-dates"`
+	ContentPipeline       []string      `yaml:"content-pipeline"`
+	EmptyFeedIsFailure    bool          `yaml:"empty-feed-is-failure"`
+	ExitNonzeroOnFailures bool          `yaml:"exit-nonzero-on-failures"`
+	DetectLanguage        bool          `yaml:"detect-language"`
+	ShowSummaryHeader     bool          `yaml:"show-summary-header"`
+	ShowFeedUpdated       bool          `yaml:"show-feed-updated"`
+	MaxContentChars       int           `yaml:"max-content-chars"`
+	ArchiveFile           string        `yaml:"archive-file"`
+	MaxContentFetches     int           `yaml:"max-content-fetch-concurrency"`
+	MaxPages              int           `yaml:"max-pages"`
+	MaxDownloads          int           `yaml:"max-concurrent-downloads"`
+	PerHostDelay          time.Duration `yaml:"per-host-delay"`
+	FetchOpenGraph        bool          `yaml:"fetch-open-graph"`
+	SanitizeHTML          bool          `yaml:"sanitize-html"`
+	AllowedHTMLTags       []string      `yaml:"allowed-html-tags"`
+	AllowedHTMLAttrs      []string      `yaml:"allowed-html-attrs"`
+	Reddit                ConfigReddit  `yaml:"reddit"`
+
+	// TemplateFragments are named templates that feeds can pick by their
+	// fragment setting to render their entries.
+	TemplateFragments map[string]string `yaml:"template-fragments"`
+
+	clientOnce sync.Once
+	client     *http.Client
+	jar        *cookieJar
+
+	fetchesOnce sync.Once
+	fetches     chan struct{}
+
+	// timeout overrides all request timeouts when set via -timeout.
+	timeout time.Duration
+
+	// path is the file the config was read from, - for stdin.
+	path string
 }
 
 type ConfigEmail struct {
-	From string     `yaml:"from"`
-	SMTP ConfigSMTP `yaml:"smtp"`
+	From            string     `yaml:"from"`
+	SMTP            ConfigSMTP `yaml:"smtp"`
+	Maildir         string     `yaml:"maildir"`
+	MessageIDDomain string     `yaml:"message-id-domain"`
 }
 
 type ConfigReddit struct {
 	ClientID     string `yaml:"client-id"`
 	ClientSecret string `yaml:"client-secret"`
+	UseOldReddit bool   `yaml:"use-old-reddit"`
 	bearerToken  string
 }
 
@@ -556,21 +1215,117 @@ type ConfigSMTP struct {
 }
 
 type ConfigFeed struct {
-	Name     string `yaml:"name"`
-	URL      string `yaml:"url"`
-	Disabled bool   `yaml:"disabled"`
+	Name                string            `yaml:"name" json:"name"`
+	URL                 string            `yaml:"url" json:"url"`
+	Disabled            bool              `yaml:"disabled" json:"disabled"`
+	ReplaceRelativeURLs *bool             `yaml:"replace-relative-urls,omitempty" json:"replace-relative-urls,omitempty"`
+	Method              string            `yaml:"method,omitempty" json:"method,omitempty"`
+	Body                string            `yaml:"body,omitempty" json:"body,omitempty"`
+	ContentType         string            `yaml:"content-type,omitempty" json:"content-type,omitempty"`
+	UserAgent           string            `yaml:"user-agent,omitempty" json:"user-agent,omitempty"`
+	Username            string            `yaml:"username,omitempty" json:"username,omitempty"`
+	Password            string            `yaml:"password,omitempty" json:"-"`
+	BearerToken         string            `yaml:"bearer-token,omitempty" json:"-"`
+	Headers             map[string]string `yaml:"headers,omitempty" json:"headers,omitempty"`
+	Cookies             map[string]string `yaml:"cookies,omitempty" json:"cookies,omitempty"`
+	IDLinkRel           string            `yaml:"id-link-rel,omitempty" json:"id-link-rel,omitempty"`
+	IncludeAuthors      []string          `yaml:"include-authors,omitempty" json:"include-authors,omitempty"`
+	ExcludeAuthors      []string          `yaml:"exclude-authors,omitempty" json:"exclude-authors,omitempty"`
+	Include             []string          `yaml:"include,omitempty" json:"include,omitempty"`
+	Exclude             []string          `yaml:"exclude,omitempty" json:"exclude,omitempty"`
+	BoostKeywords       []string          `yaml:"boost-keywords,omitempty" json:"boost-keywords,omitempty"`
+	To                  string            `yaml:"to,omitempty" json:"to,omitempty"`
+	Charset             string            `yaml:"charset,omitempty" json:"charset,omitempty"`
+	Layout              string            `yaml:"layout,omitempty" json:"layout,omitempty"`
+	AlwaysShow          bool              `yaml:"always-show,omitempty" json:"always-show,omitempty"`
+	Fragment            string            `yaml:"fragment,omitempty" json:"fragment,omitempty"`
+	MaxEntries          int               `yaml:"max-entries,omitempty" json:"max-entries,omitempty"`
+	MaxContentChars     *int              `yaml:"max-content-chars,omitempty" json:"max-content-chars,omitempty"`
+	Timeout             time.Duration     `yaml:"timeout,omitempty" json:"timeout,omitempty"`
 }
 
-func readConfig(fp string) (*Config, error) {
-	bt, err := os.ReadFile(fp)
+// request returns the method, body and content type to request the feed
+// with. Feeds are requested via GET unless a method or body is configured,
+// bodies are sent as JSON unless a content type is configured.
+func (fc *ConfigFeed) request() (string, io.Reader, string) {
+	if fc == nil || (fc.Method == "" && fc.Body == "") {
+		return http.MethodGet, nil, ""
+	}
+
+	method := strings.ToUpper(fc.Method)
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	if fc.Body == "" {
+		return method, nil, fc.ContentType
+	}
+
+	contentType := fc.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	return method, strings.NewReader(fc.Body), contentType
+}
+
+// maxContentChars returns the feed's content limit, or the given global limit
+// if it isn't overridden. Zero means no limit.
+func (fc *ConfigFeed) maxContentChars(global int) int {
+	if fc == nil || fc.MaxContentChars == nil {
+		return global
+	}
+	return *fc.MaxContentChars
+}
+
+// maxEntries returns the feed's limit of new entries, or the given global
+// limit if it isn't overridden.
+func (fc *ConfigFeed) maxEntries(global int) int {
+	if fc == nil || fc.MaxEntries == 0 {
+		return global
+	}
+	return fc.MaxEntries
+}
+
+// replaceRelativeURLs resolves the per-feed override against the global setting.
+func (fc *ConfigFeed) replaceRelativeURLs(global bool) bool {
+	if fc == nil || fc.ReplaceRelativeURLs == nil {
+		return global
+	}
+	return *fc.ReplaceRelativeURLs
+}
+
+// stdin is read for -config -, tests replace it to provide the config.
+var stdin io.Reader = os.Stdin
+
+func readConfig(fp string, strict bool) (*Config, error) {
+	var bt []byte
+	var err error
+	if fp == "-" {
+		bt, err = io.ReadAll(stdin)
+	} else {
+		bt, err = os.ReadFile(fp)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
-	var cf Config
-	err = yaml.Unmarshal(bt, &cf)
+	// the retries start out negative to tell a missing key from 0, which
+	// disables them.
+	cf := Config{SendRetries: -1, Retries: -1}
+	err = yaml.UnmarshalStrict(bt, &cf)
+	if err != nil {
+		if strict {
+			return nil, fmt.Errorf("failed to strictly parse config file err=%w", err)
+		}
+		log.Printf("ignoring config warnings, use -strict to fail instead: %v", err)
+		cf = Config{SendRetries: -1, Retries: -1}
+		err = yaml.Unmarshal(bt, &cf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse config file err=%w", err)
+		}
+	}
 
-	if cf.FeedsFile == "" {
+	if len(cf.FeedsFile) == 0 {
 		return nil, fmt.Errorf("config is missing feeds-file")
 	}
 
@@ -582,643 +1337,4786 @@ func readConfig(fp string) (*Config, error) {
 		return nil, fmt.Errorf("config is missing email.from")
 	}
 
-	if cf.Email.SMTP.Host == "" {
-		return nil, fmt.Errorf("config is missing email.smtp.host")
+	if cf.Email.MessageIDDomain != "" && !isDomain(cf.Email.MessageIDDomain) {
+		return nil, fmt.Errorf("config has invalid email.message-id-domain %#v", cf.Email.MessageIDDomain)
 	}
 
-	if cf.Email.SMTP.Port == 0 {
-		return nil, fmt.Errorf("config is missing email.smtp.port")
-	}
+	if cf.Email.Maildir == "" && cf.OutputFile == "" {
+		if cf.Email.SMTP.Host == "" {
+			return nil, fmt.Errorf("config is missing email.smtp.host")
+		}
 
-	if cf.Email.SMTP.User == "" {
-		return nil, fmt.Errorf("config is missing email.smtp.user")
-	}
+		if cf.Email.SMTP.Port == 0 {
+			return nil, fmt.Errorf("config is missing email.smtp.port")
+		}
+
+		if cf.Email.SMTP.User == "" {
+			return nil, fmt.Errorf("config is missing email.smtp.user")
+		}
 
-	if cf.Email.SMTP.Pass == "" {
-		return nil, fmt.Errorf("config is missing email.smtp.pass")
+		if cf.Email.SMTP.Pass == "" {
+			return nil, fmt.Errorf("config is missing email.smtp.pass")
+		}
 	}
 
 	if cf.MaxEntriesPerFeed == 0 {
 		cf.MaxEntriesPerFeed = 3
 	}
 
-	if cf.Reddit.IsValid() {
-		cf.Reddit.bearerToken, err = getRedditBearerToken(cf.Reddit)
-		if err != nil {
-			cf.Reddit.bearerToken = ""
-			log.Printf("failed to retrieve reddit bearer token err=%v", err)
-		}
+	if cf.SendRetries < 0 {
+		cf.SendRetries = 2
 	}
 
-	return &cf, err
-}
+	if cf.SendRetryBackoff == 0 {
+		cf.SendRetryBackoff = 10 * time.Second
+	}
 
-func readFeedsConfig(fp string) ([]*ConfigFeed, error) {
-	_, err := os.Stat(fp)
-	if os.IsNotExist(err) {
-		return []*ConfigFeed{}, nil
+	if cf.Retries < 0 {
+		cf.Retries = 3
 	}
 
-	bt, err := os.ReadFile(fp)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read feeds config file: %w", err)
+	if cf.LogFileMaxSize == 0 {
+		cf.LogFileMaxSize = defaultLogFileMaxSize
 	}
 
-	var fs []*ConfigFeed
-	err = yaml.Unmarshal(bt, &fs)
+	if cf.LogFileKeep == 0 {
+		cf.LogFileKeep = 3
+	}
 
-	return fs, err
-}
+	if cf.RetryBackoff == 0 {
+		cf.RetryBackoff = time.Second
+	}
 
-func failOnErr(cfg *Config, err error) {
-	if err != nil {
-		if cfg != nil {
-			cf := cfg.Email
-			m := gomail.NewMessage()
-			m.SetHeader("From", cf.From)
-			m.SetHeader("To", cf.From)
-			m.SetHeader("Subject", "feeder failure")
-			m.SetBody("text/plain", err.Error())
+	if cf.PerHostDelay < 0 {
+		return nil, fmt.Errorf("config has negative per-host-delay %v", cf.PerHostDelay)
+	}
 
-			d := gomail.NewDialer(cf.SMTP.Host, cf.SMTP.Port, cf.SMTP.User, cf.SMTP.Pass)
-			log.Printf("tried to send failure email err=%v", d.DialAndSend(m))
-		}
-		log.Fatal(err)
+	if cf.StaleFeedAge == 0 {
+		cf.StaleFeedAge = defaultStaleFeedAge
 	}
-}
 
-func sendEmail(cfg ConfigEmail, body string) error {
-	m := gomail.NewMessage()
-	m.SetHeader("From", cfg.From)
-	m.SetHeader("To", cfg.From)
-	m.SetHeader("Subject", fmt.Sprintf("feeder update: %s", time.Now().Format("2006-01-02 15:04")))
-	m.SetBody("text/html", body)
+	switch cf.UpgradeInsecureImages {
+	case "", "auto", "always":
+	default:
+		return nil, fmt.Errorf("config has invalid upgrade-insecure-images %#v, expected auto or always", cf.UpgradeInsecureImages)
+	}
 
-	d := gomail.NewDialer(cfg.SMTP.Host, cfg.SMTP.Port, cfg.SMTP.User, cfg.SMTP.Pass)
-	return d.DialAndSend(m)
-}
+	if cf.DisplayTimezone != "" {
+		_, err = time.LoadLocation(cf.DisplayTimezone)
+		if err != nil {
+			return nil, fmt.Errorf("config has invalid display-timezone %#v err=%w", cf.DisplayTimezone, err)
+		}
+	}
 
-func downloadFeed(cfg *Config, fc *ConfigFeed) (*Feed, error) {
-	rf, err := get(cfg, fc.URL)
+	if cf.DedupSimilarity < 0 || cf.DedupSimilarity > 1 {
+		return nil, fmt.Errorf("config has invalid dedup-similarity %v, expected a value between 0 and 1", cf.DedupSimilarity)
+	}
+
+	switch cf.SectionOrder {
+	case "", "successes-first", "failures-first":
+	default:
+		return nil, fmt.Errorf("config has invalid section-order %#v, expected successes-first or failures-first", cf.SectionOrder)
+	}
+
+	switch cf.ConfigChangeWarning {
+	case "", "log", "email":
+	default:
+		return nil, fmt.Errorf("config has invalid config-change-warning %#v, expected log or email", cf.ConfigChangeWarning)
+	}
+
+	err = validateAllowlist(cf.AllowedHTMLTags, cf.AllowedHTMLAttrs)
 	if err != nil {
 		return nil, err
 	}
 
-	return unmarshal(rf)
-}
+	for _, t := range []string{cf.Greeting, cf.Signature} {
+		_, err = renderSalutation(t, now())
+		if err != nil {
+			return nil, err
+		}
+	}
 
-func downloadFeeds(cfg *Config, cs []*ConfigFeed) ([]*Feed, []*Feed) {
-	started := 0
-	disabled := 0
-	succ := make(chan *Feed)
-	fail := make(chan *Feed)
+	_, err = renderSubject(cf.SubjectTemplate, nil, nil, now())
+	if err != nil {
+		return nil, err
+	}
 
-	for _, fc := range cs {
-		if fc.Disabled {
-			disabled += 1
-			continue
+	for _, d := range cf.SendDays {
+		if _, ok := parseWeekday(d); !ok {
+			return nil, fmt.Errorf("config has invalid send-days entry %#v", d)
 		}
-
-		go func(fc *ConfigFeed) {
-			f, err := downloadFeed(cfg, fc)
-			if err != nil {
-				fail <- &Feed{Title: fc.Name, Link: fc.URL, Failure: err}
-				return
-			}
-			succ <- f
-		}(fc)
-		started += 1
 	}
 
-	log.Printf("downloading %v feeds in parallel, %v disabled.", started, disabled)
+	for _, p := range cf.TrackingParams {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("config has invalid tracking-params pattern %#v err=%w", p, err)
+		}
+	}
 
-	succs := []*Feed{}
-	fails := []*Feed{}
-	for {
-		if started == len(succs)+len(fails) {
-			return succs, fails
+	for _, n := range cf.ContentPipeline {
+		if _, ok := contentTransforms[n]; !ok {
+			return nil, fmt.Errorf("config has unknown content-pipeline transform %#v", n)
 		}
+	}
 
-		select {
-		case s := <-succ:
-			succs = append(succs, s)
-		case f := <-fail:
-			fails = append(fails, f)
+	if cf.Reddit.IsValid() {
+		cf.Reddit.bearerToken, err = getRedditBearerToken(cf.Reddit)
+		if err != nil {
+			cf.Reddit.bearerToken = ""
+			log.Printf("failed to retrieve reddit bearer token err=%v", err)
 		}
 	}
+
+	cf.path = fp
+	return &cf, err
 }
 
-func pickNewData(fs []*Feed, limitPerFeed int, ts map[string]time.Time) []*Feed {
-	result := []*Feed{}
-	for _, f := range fs {
-		copies := make([]*FeedEntry, len(f.Entries))
-		for i, e := range f.Entries {
-			copies[i] = e.Copy()
-		}
-		sort.Slice(copies, func(i, j int) bool {
-			return copies[i].Updated.After(copies[j].Updated)
-		})
+// StringList unmarshals from either a single string or a list of strings.
+type StringList []string
 
-		nf := &Feed{Title: f.Title, ID: f.ID, Link: f.Link, Updated: f.Updated, Entries: []*FeedEntry{}}
-		lt, seen := ts[f.ID]
+func (sl *StringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	err := unmarshal(&s)
+	if err == nil {
+		*sl = StringList{s}
+		return nil
+	}
 
-		for _, e := range copies {
-			if !seen || e.Updated.After(lt) {
-				nf.Entries = append(nf.Entries, e)
-				if len(nf.Entries) >= limitPerFeed {
-					break
-				}
+	var l []string
+	err = unmarshal(&l)
+	if err != nil {
+		return err
+	}
+	*sl = l
+	return nil
+}
+
+// feedsFiles expands the globs of the configured feeds files. Paths without
+// matches are kept as they are, so they can be created by subscribe.
+func (cfg *Config) feedsFiles() ([]string, error) {
+	result := []string{}
+	seen := map[string]bool{}
+	for _, p := range cfg.FeedsFile {
+		ms, err := filepath.Glob(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid feeds-file pattern %#v err=%w", p, err)
+		}
+		if len(ms) == 0 {
+			ms = []string{p}
+		}
+		for _, m := range ms {
+			if !seen[m] {
+				seen[m] = true
+				result = append(result, m)
 			}
 		}
+	}
+	return result, nil
+}
 
-		sort.Slice(nf.Entries, func(i, j int) bool {
-			return nf.Entries[i].Updated.Before(nf.Entries[j].Updated)
-		})
+// watchedFiles are the config and feeds files whose changes are reported by
+// config-change-warning.
+func (cfg *Config) watchedFiles() ([]string, error) {
+	fps, err := cfg.feedsFiles()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.path != "" && cfg.path != "-" {
+		fps = append([]string{cfg.path}, fps...)
+	}
+	return fps, nil
+}
 
-		if len(nf.Entries) > 0 {
-			result = append(result, nf)
-		}
+// subscribeFile is the feeds file that new subscriptions are added to,
+// defaulting to the first feeds file.
+func (cfg *Config) subscribeFile() (string, error) {
+	if cfg.SubscribeFile != "" {
+		return cfg.SubscribeFile, nil
 	}
-	return result
+
+	fps, err := cfg.feedsFiles()
+	if err != nil {
+		return "", err
+	}
+	if len(fps) == 0 {
+		return "", fmt.Errorf("config is missing feeds-file")
+	}
+	return fps[0], nil
 }
 
-func updateTimestamps(ts map[string]time.Time, nd []*Feed) {
-	for _, f := range nd {
-		_, ok := ts[f.ID]
-		if !ok {
-			ts[f.ID] = f.Entries[0].Updated
+// readFeedsConfigs merges the feeds of the given files, feeds with the same
+// url as an earlier feed are dropped.
+func readFeedsConfigs(fps []string) ([]*ConfigFeed, error) {
+	result := []*ConfigFeed{}
+	seen := map[string]bool{}
+	for _, fp := range fps {
+		fs, err := readFeedsConfig(fp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read feeds config %#v err=%w", fp, err)
 		}
-		for _, e := range f.Entries {
-			if e.Updated.After(ts[f.ID]) {
-				ts[f.ID] = e.Updated
+		for _, f := range fs {
+			u := strings.ToLower(f.URL)
+			if seen[u] {
+				log.Printf("ignoring duplicate feed url=%#v in %#v", f.URL, fp)
+				continue
 			}
+			seen[u] = true
+			result = append(result, f)
 		}
 	}
+	return result, nil
 }
 
-func readTimestamps(fn string) (map[string]time.Time, error) {
-	var err error
-	var result map[string]time.Time
-	var bt []byte
-	var fh *os.File
+func readFeedsConfig(fp string) ([]*ConfigFeed, error) {
+	_, err := os.Stat(fp)
+	if os.IsNotExist(err) {
+		return []*ConfigFeed{}, nil
+	}
 
-	fh, err = os.OpenFile(fn, os.O_CREATE, 0o677)
+	bt, err := os.ReadFile(fp)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open timestamps file %#v err=%w", fn, err)
+		return nil, fmt.Errorf("failed to read feeds config file: %w", err)
 	}
 
-	bt, err = io.ReadAll(fh)
+	var fs []*ConfigFeed
+	err = yaml.Unmarshal(bt, &fs)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read timestamps file %#v err=%w", fn, err)
+		return nil, err
 	}
 
-	if len(bt) == 0 {
-		return map[string]time.Time{}, nil
+	for _, fc := range fs {
+		for _, kw := range append(append(append([]string{}, fc.Include...), fc.Exclude...), fc.BoostKeywords...) {
+			_, err = keywordPattern(kw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid include, exclude or boost pattern %#v for feed %#v err=%w", kw, fc.URL, err)
+			}
+		}
+
+		switch strings.ToUpper(fc.Method) {
+		case "", http.MethodGet, http.MethodPost:
+		default:
+			return nil, fmt.Errorf("invalid method %#v for feed %#v, expected GET or POST", fc.Method, fc.URL)
+		}
 	}
 
-	err = yaml.Unmarshal(bt, &result)
+	return fs, nil
+}
+
+func failOnErr(cfg *Config, err error) {
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal timestamps %#v file err=%w", fn, err)
+		if cfg != nil {
+			reportFailure(cfg, err)
+		}
+		log.Fatal(err)
 	}
+}
 
-	return result, nil
+// reportFailure sends a failure email, unless the email body is written to
+// output-file instead of being sent.
+func reportFailure(cfg *Config, err error) {
+	if cfg.OutputFile == "" {
+		sendFailureEmail(cfg.Email, err)
+	}
 }
 
-func writeTimestamps(fn string, ts map[string]time.Time) error {
-	var err error
-	var bt []byte
+func sendFailureEmail(cf ConfigEmail, err error) {
+	m := gomail.NewMessage()
+	m.SetHeader("From", cf.From)
+	m.SetHeader("To", cf.From)
+	m.SetHeader("Subject", "feeder failure")
+	m.SetBody("text/plain", err.Error())
 
-	bt, err = yaml.Marshal(ts)
-	if err != nil {
-		return fmt.Errorf("failed to marshal timestamps err=%w", err)
+	log.Printf("tried to send failure email err=%v", dispatch(cf, m))
+}
+
+// message is a digest email ready to be delivered.
+type message struct {
+	To      string
+	Subject string
+	Body    string
+	Text    string
+}
+
+func sendEmail(cfg ConfigEmail, msg *message) error {
+	m := gomail.NewMessage()
+	m.SetHeader("From", cfg.From)
+	m.SetHeader("To", splitAddresses(msg.To)...)
+	subject := msg.Subject
+	if subject == "" {
+		subject = fmt.Sprintf("feeder update: %s", time.Now().Format("2006-01-02 15:04"))
+	}
+	m.SetHeader("Subject", subject)
+	if msg.Text != "" {
+		m.SetBody("text/plain", msg.Text)
+		m.AddAlternative("text/html", msg.Body)
+	} else {
+		m.SetBody("text/html", msg.Body)
 	}
 
-	err = os.WriteFile(fn, bt, 0o677)
-	if err != nil {
-		return fmt.Errorf("failed to write timestamps file err=%w", err)
+	return dispatch(cfg, m)
+}
+
+// dispatch sends the message via SMTP, or writes it to the Maildir if one is
+// configured.
+func dispatch(cfg ConfigEmail, m *gomail.Message) error {
+	if cfg.MessageIDDomain != "" {
+		m.SetHeader("Message-ID", newMessageID(cfg.MessageIDDomain))
 	}
 
-	return nil
+	if cfg.Maildir != "" {
+		return writeMaildir(cfg.Maildir, m)
+	}
+
+	d := gomail.NewDialer(cfg.SMTP.Host, cfg.SMTP.Port, cfg.SMTP.User, cfg.SMTP.Pass)
+	return d.DialAndSend(m)
 }
 
-// FormatTime prints a time with layout "2006-01-02 15:04 MST"
-func FormatTime(t time.Time) string {
-	return t.Format("2006-01-02 15:04 MST")
+var rxDomain = regexp.MustCompile(`^(?i)[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*$`)
+
+func isDomain(s string) bool {
+	return len(s) <= 253 && rxDomain.MatchString(s)
 }
 
-// FormatLayoutTime prints a time according to the given layout.
-func FormatLayoutTime(layout string, t *time.Time) string {
-	return t.Format(layout)
+var messageIDCount int64
+
+// newMessageID returns a unique Message-ID with the given domain as its right
+// hand side.
+func newMessageID(domain string) string {
+	rnd := make([]byte, 8)
+	_, err := rand.Read(rnd)
+	if err != nil {
+		log.Printf("ignoring failure to read random bytes for message id err=%v", err)
+	}
+	return fmt.Sprintf("<%v.%v.%v.%s@%s>", now().UnixNano(), os.Getpid(), atomic.AddInt64(&messageIDCount, 1), hex.EncodeToString(rnd), domain)
 }
 
-var defaultEmailTemplate = `
-{{ range .Successes}}
-<h1 style="border: 1px solid #acb0bf; border-radius: 3px; background: #f4f4f4; padding: 1em; margin: 1.6em 0;"><a href="{{ .Link }}" style="text-decoration: none; color: RoyalBlue; ">{{ .Title }}</a></h1>
-  {{ range .Entries }}
-  <h2 style="border: 1px solid #acb0bf; border-radius: 3px; background: #f4f4f4; padding: 1em; margin: 1.6em 0;"><a href="{{ .Link }}" style="text-decoration: none; color: RoyalBlue; ">{{ .Title }}</a><span style="font-size:0.75rem;margin-left:1rem;">{{ FormatTime .Updated }}</span></h2>
-  <div>
-    {{ .Content }}
-  </div>
-  {{ end }}
-{{ end }}
+var maildirCount int64
 
-<br />
-<hr />
-<br />
+// writeMaildir delivers the message to the new directory of the Maildir at
+// dir, creating it if necessary. The message is written to tmp first and then
+// moved, so readers never see a partial message.
+func writeMaildir(dir string, m *gomail.Message) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		err := os.MkdirAll(filepath.Join(dir, sub), 0o700)
+		if err != nil {
+			return fmt.Errorf("failed to create maildir %#v err=%w", dir, err)
+		}
+	}
 
-{{ range .Failures}}
-<h1 style="border: 1px solid #acb0bf; border-radius: 3px; background: #f4f4f4; padding: 1em; margin: 1.6em 0;"><a href="{{ .Link }}" style="text-decoration: none; color: RoyalBlue; ">{{ .Title }}</a></h1>
-Failed to process feed: {{ .Failure }}
-{{ end }}
-`
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	host = strings.NewReplacer("/", "\\057", ":", "\\072").Replace(host)
 
-func readEmailTemplate(fn string) (string, error) {
-	if fn == "" {
-		return defaultEmailTemplate, nil
+	t := now()
+	name := fmt.Sprintf("%v.M%vP%vQ%v.%s", t.Unix(), t.Nanosecond()/1000, os.Getpid(), atomic.AddInt64(&maildirCount, 1), host)
+	tmp := filepath.Join(dir, "tmp", name)
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create maildir message err=%w", err)
 	}
 
-	bt, err := os.ReadFile(fn)
+	_, err = m.WriteTo(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to read email template file %#v err=%w", fn, err)
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write maildir message err=%w", err)
 	}
 
-	return string(bt), nil
+	err = os.Rename(tmp, filepath.Join(dir, "new", name))
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to deliver maildir message err=%w", err)
+	}
+
+	return nil
 }
 
-type templateData struct {
-	Successes []*Feed
-	Failures  []*Feed
+// deliver sends the digest email, tests replace it to avoid dialing SMTP.
+var deliver = sendEmail
+
+// sendEmailWithRetries retries failed deliveries with exponential backoff, so
+// a transient SMTP failure doesn't throw away the downloaded feeds.
+func sendEmailWithRetries(cfg *Config, msg *message) error {
+	var err error
+	backoff := cfg.SendRetryBackoff
+	for attempt := 0; attempt <= cfg.SendRetries; attempt++ {
+		if attempt > 0 {
+			log.Printf("retrying to send email in %v, retry %v of %v", backoff, attempt, cfg.SendRetries)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		err = deliver(cfg.Email, msg)
+		if err == nil {
+			return nil
+		}
+		log.Printf("failed to send email err=%v", err)
+	}
+
+	return fmt.Errorf("failed to send email after %v attempts err=%w", cfg.SendRetries+1, err)
 }
 
-func makeEmailBody(succs []*Feed, fails []*Feed, emailTemplate string) (string, error) {
-	fs := template.FuncMap{"FormatTime": FormatTime, "FormatLayoutTime": FormatLayoutTime}
-	tmpl, err := template.New("email").Funcs(fs).Parse(emailTemplate)
+func downloadFeed(cfg *Config, fc *ConfigFeed) (*Feed, error) {
+	f, err := downloadFeedPage(cfg, fc, fc.URL)
+	if errors.Is(err, ErrEmptyFeed) && !cfg.EmptyFeedIsFailure {
+		log.Printf("ignoring empty feed %#v", fc.URL)
+		return &Feed{Title: fc.Name, Link: fc.URL, Updated: now(), Entries: []*FeedEntry{}}, nil
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to parse template err=%w", err)
+		return nil, err
 	}
 
-	var buf bytes.Buffer
-	err = tmpl.Execute(&buf, &templateData{succs, fails})
-	if err != nil {
-		return "", fmt.Errorf("failed to execute template err=%w", err)
+	followPages(cfg, fc, f)
+
+	if fc.IDLinkRel != "" {
+		useLinkAsID(f, fc.IDLinkRel)
 	}
 
-	return buf.String(), nil
+	if f.Updated.IsZero() {
+		f.Updated = latestUpdate(f.Entries, now())
+	}
+
+	return f, nil
 }
 
-func absolutifyHTML(in string, base *url.URL) (string, error) {
-	ir := strings.NewReader(in)
-	node, err := html.ParseFragment(ir, nil)
-	if err != nil {
-		return in, fmt.Errorf("failed to parse as HTML err=%w", err)
+// useLinkAsID sets the feed's ID to its link with the given rel, where links
+// without rel count as alternate links.
+func useLinkAsID(f *Feed, rel string) {
+	for _, l := range f.links {
+		r := l.Rel
+		if r == "" {
+			r = "alternate"
+		}
+		if strings.EqualFold(r, rel) {
+			f.ID = l.HRef
+			return
+		}
 	}
+	log.Printf("ignoring id-link-rel, feed %#v has no link with rel %#v", f.Title, rel)
+}
 
-	absolutify := func(u string) (string, error) {
-		pu, err := url.Parse(u)
+// followPages merges the entries of older pages that the feed links to via
+// rel="next" into f, up to max-pages pages in total. Failing to download an
+// older page only stops paging, the entries so far are kept.
+func followPages(cfg *Config, fc *ConfigFeed, f *Feed) {
+	seenPages := map[string]bool{fc.URL: true}
+	seenEntries := map[string]bool{}
+	for _, e := range f.Entries {
+		seenEntries[entryKey(e)] = true
+	}
+
+	base := fc.URL
+	page := f
+	for n := 2; n <= cfg.MaxPages && page.next != ""; n++ {
+		next, err := resolveURL(base, page.next)
 		if err != nil {
-			return "", fmt.Errorf("failed to parse url=%#v err=%w", u, err)
+			log.Printf("ignoring invalid next page %#v of feed %#v err=%v", page.next, fc.URL, err)
+			return
 		}
+		if seenPages[next] {
+			return
+		}
+		seenPages[next] = true
 
-		if pu.IsAbs() {
-			return u, nil
+		page, err = downloadFeedPage(cfg, fc, next)
+		if err != nil {
+			log.Printf("stopped paging feed %#v at page %v err=%v", fc.URL, n, err)
+			return
 		}
-		ru := base.ResolveReference(pu)
-		return ru.String(), nil
-	}
 
-	var visit func(n *html.Node)
+		for _, e := range page.Entries {
+			if k := entryKey(e); !seenEntries[k] {
+				seenEntries[k] = true
+				f.Entries = append(f.Entries, e)
+			}
+		}
+		base = next
+	}
+}
+
+// resolveURL resolves ref relative to base.
+func resolveURL(base, ref string) (string, error) {
+	bu, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	ru, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return bu.ResolveReference(ru).String(), nil
+}
+
+// downloadFeedPage downloads and parses a single page of the feed at the
+// given URL.
+func downloadFeedPage(cfg *Config, fc *ConfigFeed, u string) (*Feed, error) {
+	rf, err := get(cfg, fc, u)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.SaveRawFeeds != "" && u == fc.URL {
+		err = saveRawFeed(cfg.SaveRawFeeds, fc, rf)
+		if err != nil {
+			log.Printf("ignoring failure to save raw feed err=%v", err)
+		}
+	}
+
+	if fc.Charset != "" {
+		rf, err = forceCharset(rf, fc.Charset)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return unmarshal(rf)
+}
+
+// latestUpdate returns the latest update time of the given entries, or the
+// fallback if there are none.
+func latestUpdate(es []*FeedEntry, fallback time.Time) time.Time {
+	var result time.Time
+	for _, e := range es {
+		if e.Updated.After(result) {
+			result = e.Updated
+		}
+	}
+	if result.IsZero() {
+		return fallback
+	}
+	return result
+}
+
+var rxXMLEncoding = regexp.MustCompile(`^(\s*<\?xml[^>]*encoding=["'])[^"']*(["'])`)
+
+// forceCharset decodes the feed with the given charset regardless of what it
+// declares, and updates the declaration to match the UTF-8 result.
+func forceCharset(byt []byte, name string) ([]byte, error) {
+	enc, _ := charset.Lookup(name)
+	if enc == nil {
+		return nil, fmt.Errorf("unknown charset %#v", name)
+	}
+
+	dec, err := enc.NewDecoder().Bytes(byt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode feed as %#v err=%w", name, err)
+	}
+
+	return rxXMLEncoding.ReplaceAll(dec, []byte("${1}UTF-8${2}")), nil
+}
+
+var rxFileNameUnsafe = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// saveRawFeed writes the downloaded bytes to a file named after the feed in
+// dir, overwriting the file of the previous run.
+func saveRawFeed(dir string, fc *ConfigFeed, byt []byte) error {
+	name := fc.Name
+	if strings.TrimSpace(name) == "" {
+		name = fc.URL
+	}
+	name = strings.Trim(rxFileNameUnsafe.ReplaceAllString(strings.ToLower(name), "-"), "-")
+
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return fmt.Errorf("failed to create raw feeds dir %#v err=%w", dir, err)
+	}
+
+	fn := filepath.Join(dir, name+".raw")
+	err = os.WriteFile(fn, byt, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write raw feed %#v err=%w", fn, err)
+	}
+
+	return nil
+}
+
+// defaultConcurrentDownloads is the number of feeds downloaded in parallel
+// unless max-concurrent-downloads is set.
+const defaultConcurrentDownloads = 10
+
+// fetchFeed downloads a single feed, tests replace it to observe downloads.
+var fetchFeed = downloadFeed
+
+func downloadFeeds(cfg *Config, cs []*ConfigFeed) ([]*Feed, []*Feed) {
+	started := 0
+	disabled := 0
+	succ := make(chan *Feed)
+	fail := make(chan *Feed)
+
+	limit := cfg.MaxDownloads
+	if limit <= 0 {
+		limit = defaultConcurrentDownloads
+	}
+	sem := make(chan struct{}, limit)
+	ht := &hostThrottle{delay: cfg.PerHostDelay}
+
+	for _, fc := range cs {
+		if fc.Disabled {
+			disabled += 1
+			continue
+		}
+
+		go func(fc *ConfigFeed) {
+			release := ht.acquire(fc.URL)
+			sem <- struct{}{}
+			start := time.Now()
+			f, err := fetchFeed(cfg, fc)
+			took := time.Since(start)
+			<-sem
+			release()
+			if err != nil {
+				log.Printf("failed to download feed %#v after %v err=%v", fc.URL, took.Round(time.Millisecond), err)
+				fail <- &Feed{Title: fc.Name, Link: fc.URL, Failure: err, conf: fc, FetchDuration: took}
+				return
+			}
+			log.Printf("downloaded feed %#v in %v", fc.URL, took.Round(time.Millisecond))
+			f.conf = fc
+			f.FetchDuration = took
+			succ <- f
+		}(fc)
+		started += 1
+	}
+
+	log.Printf("downloading %v feeds, %v in parallel, %v disabled.", started, limit, disabled)
+
+	succs := []*Feed{}
+	fails := []*Feed{}
+	for {
+		if started == len(succs)+len(fails) {
+			return succs, fails
+		}
+
+		select {
+		case s := <-succ:
+			succs = append(succs, s)
+		case f := <-fail:
+			fails = append(fails, f)
+		}
+	}
+}
+
+// hostThrottle serializes downloads of feeds on the same host and waits for
+// delay between them, if delay is set.
+type hostThrottle struct {
+	sync.Mutex
+	delay time.Duration
+	hosts map[string]*hostSlot
+}
+
+type hostSlot struct {
+	sync.Mutex
+	last time.Time
+}
+
+// acquire blocks until the feed at the given url may be downloaded, the
+// returned func must be called once the download finished.
+func (ht *hostThrottle) acquire(u string) func() {
+	if ht.delay <= 0 {
+		return func() {}
+	}
+
+	host := ""
+	pu, err := url.Parse(u)
+	if err == nil {
+		host = strings.ToLower(pu.Host)
+	}
+
+	ht.Lock()
+	if ht.hosts == nil {
+		ht.hosts = map[string]*hostSlot{}
+	}
+	hs, ok := ht.hosts[host]
+	if !ok {
+		hs = &hostSlot{}
+		ht.hosts[host] = hs
+	}
+	ht.Unlock()
+
+	hs.Lock()
+	if !hs.last.IsZero() {
+		time.Sleep(time.Until(hs.last.Add(ht.delay)))
+	}
+
+	return func() {
+		hs.last = time.Now()
+		hs.Unlock()
+	}
+}
+
+// trackFormats records the format and ID of the downloaded feeds in the
+// state. When a feed's format changes, e.g. from RSS to RDF, its ID is likely
+// derived from different links, so from then on it keeps the ID it had
+// before to find its timestamps, unless id-link-rel is configured.
+func trackFormats(st *State, succs []*Feed) {
+	for _, f := range succs {
+		if f.format == "" {
+			continue
+		}
+
+		fs := st.feed(f.conf.URL)
+		if fs.Format != "" && fs.Format != f.format {
+			log.Printf("feed %#v changed format from %v to %v", f.Title, fs.Format, f.format)
+			fs.KeepID = fs.ID != ""
+		}
+		fs.Format = f.format
+
+		if fs.KeepID && f.conf.IDLinkRel == "" {
+			if f.ID != fs.ID {
+				log.Printf("keeping id %#v of feed %#v instead of %#v", fs.ID, f.Title, f.ID)
+			}
+			f.ID = fs.ID
+			continue
+		}
+		fs.ID = f.ID
+	}
+}
+
+// trackFailures records the outcome of the downloads in the state and
+// disables feeds in the feeds file that reached the configured threshold of
+// consecutive failures.
+func trackFailures(cfg *Config, st *State, succs, fails []*Feed) error {
+	for _, f := range succs {
+		fs := st.feed(f.conf.URL)
+		fs.LastSuccess = now()
+		fs.Failures = 0
+		fs.NewEntries = 0
+	}
+
+	disable := map[string]bool{}
+	for _, f := range fails {
+		fs := st.feed(f.conf.URL)
+		fs.LastError = f.Failure.Error()
+		fs.Failures += 1
+		fs.NewEntries = 0
+		if cfg.AutoDisableAfter > 0 && fs.Failures >= cfg.AutoDisableAfter {
+			disable[f.conf.URL] = true
+			f.AutoDisabled = true
+		}
+	}
+
+	if len(disable) == 0 {
+		return nil
+	}
+
+	fps, err := cfg.feedsFiles()
+	if err != nil {
+		return err
+	}
+	for _, fp := range fps {
+		err = disableFeeds(fp, disable)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.ConfigChangeWarning != "" {
+		err = st.recordFileHashes(fps)
+		if err != nil {
+			return err
+		}
+	}
+	for u := range disable {
+		st.feed(u).Failures = 0
+		log.Printf("disabled feed %#v after %v consecutive failures", u, cfg.AutoDisableAfter)
+	}
+
+	return nil
+}
+
+// disableFeeds sets disabled for the feeds with the given urls. It edits the
+// yaml document rather than marshalling the config so that comments are kept.
+func disableFeeds(fp string, urls map[string]bool) error {
+	bt, err := os.ReadFile(fp)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read feeds config file: %w", err)
+	}
+
+	var doc yaml3.Node
+	err = yaml3.Unmarshal(bt, &doc)
+	if err != nil {
+		return fmt.Errorf("failed to parse feeds config file: %w", err)
+	}
+
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml3.SequenceNode {
+		return fmt.Errorf("feeds config file %#v is not a list of feeds", fp)
+	}
+
+	changed := false
+	for _, fn := range doc.Content[0].Content {
+		if fn.Kind != yaml3.MappingNode {
+			continue
+		}
+
+		var disabled *yaml3.Node
+		matches := false
+		for i := 0; i+1 < len(fn.Content); i += 2 {
+			switch fn.Content[i].Value {
+			case "url":
+				matches = urls[fn.Content[i+1].Value]
+			case "disabled":
+				disabled = fn.Content[i+1]
+			}
+		}
+
+		if !matches {
+			continue
+		}
+
+		if disabled == nil {
+			disabled = &yaml3.Node{Kind: yaml3.ScalarNode}
+			fn.Content = append(fn.Content, &yaml3.Node{Kind: yaml3.ScalarNode, Value: "disabled"}, disabled)
+		}
+		disabled.Tag = "!!bool"
+		disabled.Value = "true"
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	enc := yaml3.NewEncoder(buf)
+	enc.SetIndent(2)
+	err = enc.Encode(&doc)
+	if err != nil {
+		return fmt.Errorf("failed to marshal feeds config: %w", err)
+	}
+
+	err = os.WriteFile(fp, buf.Bytes(), 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write feeds config file: %w", err)
+	}
+
+	return nil
+}
+
+// futureDateSkew is the tolerance for entries updated after the download
+// time, e.g. due to clock differences.
+const futureDateSkew = 10 * time.Minute
+
+// clampFutureDates sets the update time of entries that claim to be from the
+// future to the download time, so they don't push the feed's timestamp ahead
+// of subsequent entries. The clamped time is remembered for as long as the
+// entry is in the feed, so that later runs don't consider it updated again.
+func (st *State) clampFutureDates(fs []*Feed, downloaded time.Time) {
+	if st.Clamped == nil {
+		st.Clamped = map[string]map[string]time.Time{}
+	}
+	for _, f := range fs {
+		cs := st.Clamped[f.conf.URL]
+		present := map[string]bool{}
+		for _, e := range f.Entries {
+			k := entryKey(e)
+			present[k] = true
+			if ct, ok := cs[k]; ok {
+				e.Updated = ct
+				continue
+			}
+			if e.Updated.After(downloaded.Add(futureDateSkew)) {
+				log.Printf("clamping future update time %v of entry %#v in feed %#v", FormatTime(e.Updated), e.Title, f.Title)
+				e.Updated = downloaded
+				if cs == nil {
+					cs = map[string]time.Time{}
+					st.Clamped[f.conf.URL] = cs
+				}
+				cs[k] = downloaded
+			}
+		}
+
+		for k := range cs {
+			if !present[k] {
+				delete(cs, k)
+			}
+		}
+		if len(cs) == 0 {
+			delete(st.Clamped, f.conf.URL)
+		}
+	}
+}
+
+// filterEntries drops entries that don't pass their feed's filters.
+func filterEntries(fs []*Feed) {
+	for _, f := range fs {
+		if f.conf == nil {
+			continue
+		}
+		kept := []*FeedEntry{}
+		for _, e := range f.Entries {
+			if f.conf.includesAuthor(e.Author) && f.conf.includesKeywords(e) {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) < len(f.Entries) {
+			log.Printf("filtered %v of %v entries for feed %#v", len(f.Entries)-len(kept), len(f.Entries), f.Title)
+		}
+		f.Entries = kept
+	}
+}
+
+// includesAuthor checks the author against the feed's author lists, entries
+// without author are always included.
+func (fc *ConfigFeed) includesAuthor(author string) bool {
+	if strings.TrimSpace(author) == "" {
+		return true
+	}
+
+	matches := func(names []string) bool {
+		for _, a := range strings.Split(author, ",") {
+			for _, n := range names {
+				if strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(n)) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	if len(fc.IncludeAuthors) > 0 && !matches(fc.IncludeAuthors) {
+		return false
+	}
+
+	return !matches(fc.ExcludeAuthors)
+}
+
+// includesKeywords checks the entry's title and content against the feed's
+// include and exclude patterns.
+func (fc *ConfigFeed) includesKeywords(e *FeedEntry) bool {
+	if len(fc.Include) == 0 && len(fc.Exclude) == 0 {
+		return true
+	}
+
+	if len(fc.Include) > 0 && !matchesKeywords(e, fc.Include) {
+		return false
+	}
+
+	return !matchesKeywords(e, fc.Exclude)
+}
+
+// matchesKeywords checks whether the entry's title or text match any of the
+// given keywords.
+func matchesKeywords(e *FeedEntry, keywords []string) bool {
+	if len(keywords) == 0 {
+		return false
+	}
+
+	text := e.Title + " " + htmlText(string(e.Content))
+	for _, kw := range keywords {
+		rx, err := keywordPattern(kw)
+		if err != nil {
+			log.Printf("ignoring invalid pattern %#v err=%v", kw, err)
+			continue
+		}
+		if rx.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// keywordPattern compiles a case-insensitive pattern from the given keyword,
+// which is a regular expression if it's enclosed in slashes like /go(lang)?/,
+// and a plain substring otherwise.
+func keywordPattern(kw string) (*regexp.Regexp, error) {
+	if len(kw) > 1 && strings.HasPrefix(kw, "/") && strings.HasSuffix(kw, "/") {
+		return regexp.Compile("(?i)" + kw[1:len(kw)-1])
+	}
+	return regexp.Compile("(?i)" + regexp.QuoteMeta(kw))
+}
+
+var rxNonWord = regexp.MustCompile(`[^\pL\pN]+`)
+
+// normalizeTitle lowercases the title and collapses punctuation and
+// whitespace, so that republished stories compare equal.
+func normalizeTitle(t string) string {
+	return strings.TrimSpace(rxNonWord.ReplaceAllString(strings.ToLower(t), " "))
+}
+
+// dedupByTitle drops entries whose normalized title was already seen in the
+// same feed, keeping the first occurrence.
+func dedupByTitle(fs []*Feed) {
+	for _, f := range fs {
+		seen := map[string]bool{}
+		kept := []*FeedEntry{}
+		for _, e := range f.Entries {
+			nt := normalizeTitle(e.Title)
+			if nt != "" && seen[nt] {
+				log.Printf("dropping entry %#v with duplicate title for feed %#v", e.Link, f.Title)
+				continue
+			}
+			seen[nt] = true
+			kept = append(kept, e)
+		}
+		f.Entries = kept
+	}
+}
+
+// globalDedup drops entries whose key was already picked from another feed,
+// the first feed in config order wins. It returns the feeds that were left
+// without entries, they are removed from the new data unless always-show is
+// set.
+func globalDedup(nd []*Feed, cs []*ConfigFeed) ([]*Feed, []*Feed) {
+	order := map[*ConfigFeed]int{}
+	for i, fc := range cs {
+		order[fc] = i
+	}
+	rank := func(f *Feed) int {
+		if i, ok := order[f.conf]; ok {
+			return i
+		}
+		return len(cs)
+	}
+
+	sorted := append([]*Feed{}, nd...)
+	sort.SliceStable(sorted, func(i, j int) bool { return rank(sorted[i]) < rank(sorted[j]) })
+
+	seen := map[string]*Feed{}
+	emptied := map[*Feed]bool{}
+	for _, f := range sorted {
+		if len(f.Entries) == 0 {
+			continue
+		}
+		kept := []*FeedEntry{}
+		for _, e := range f.Entries {
+			k := entryKey(e)
+			if first, ok := seen[k]; ok && first != f {
+				log.Printf("dropping entry %#v of feed %#v as feed %#v has it too", e.Link, f.Title, first.Title)
+				f.dropped = append(f.dropped, e)
+				continue
+			}
+			seen[k] = f
+			kept = append(kept, e)
+		}
+		f.Entries = kept
+		emptied[f] = len(kept) == 0
+	}
+
+	result, removed := []*Feed{}, []*Feed{}
+	for _, f := range nd {
+		if emptied[f] && (f.conf == nil || !f.conf.AlwaysShow) {
+			removed = append(removed, f)
+			continue
+		}
+		result = append(result, f)
+	}
+	return result, removed
+}
+
+const (
+	// maxShingleWords limits the words of an entry that are compared.
+	maxShingleWords = 200
+
+	// maxSimilarityCandidates limits the kept entries that an entry is
+	// compared with, to bound the cost for large feeds.
+	maxSimilarityCandidates = 100
+)
+
+// shingles returns the set of word pairs of the entry's title and content.
+func shingles(e *FeedEntry) map[string]bool {
+	ws := strings.Fields(normalizeTitle(e.Title + " " + htmlText(string(e.Content))))
+	if len(ws) > maxShingleWords {
+		ws = ws[:maxShingleWords]
+	}
+
+	result := map[string]bool{}
+	if len(ws) == 1 {
+		result[ws[0]] = true
+	}
+	for i := 1; i < len(ws); i++ {
+		result[ws[i-1]+" "+ws[i]] = true
+	}
+	return result
+}
+
+// jaccard returns the size of the intersection of the given sets divided by
+// the size of their union.
+func jaccard(a, b map[string]bool) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+
+	shared := 0
+	for k := range a {
+		if b[k] {
+			shared += 1
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
+
+// dedupBySimilarity drops entries whose title and content are at least
+// threshold similar to an entry that was kept before in the same feed,
+// keeping the first of near-duplicates.
+func dedupBySimilarity(fs []*Feed, threshold float64) {
+	for _, f := range fs {
+		kept := []*FeedEntry{}
+		keptShingles := []map[string]bool{}
+		similar := func(sh map[string]bool) *FeedEntry {
+			for i := max(0, len(kept)-maxSimilarityCandidates); i < len(kept); i++ {
+				if jaccard(sh, keptShingles[i]) >= threshold {
+					return kept[i]
+				}
+			}
+			return nil
+		}
+
+		for _, e := range f.Entries {
+			sh := shingles(e)
+			if o := similar(sh); o != nil {
+				log.Printf("dropping entry %#v similar to %#v for feed %#v", e.Link, o.Link, f.Title)
+				continue
+			}
+			kept = append(kept, e)
+			keptShingles = append(keptShingles, sh)
+		}
+		f.Entries = kept
+	}
+}
+
+// entryHeap is a min-heap of entries ordered by their update time.
+type entryHeap []*FeedEntry
+
+func (h entryHeap) Len() int           { return len(h) }
+func (h entryHeap) Less(i, j int) bool { return h[i].Updated.Before(h[j].Updated) }
+func (h entryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *entryHeap) Push(x any)        { *h = append(*h, x.(*FeedEntry)) }
+func (h *entryHeap) Pop() any {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	*h = old[:n-1]
+	return e
+}
+
+// pickNewData selects up to limitPerFeed, or the feed's max-entries, of the
+// most recent entries per feed that were updated after the feed's timestamp.
+// Only selected entries are copied, the entries of the returned feeds are
+// ordered oldest first.
+func pickNewData(fs []*Feed, limitPerFeed int, ts map[string]time.Time) []*Feed {
+	result := []*Feed{}
+	for _, f := range fs {
+		limit := max(f.conf.maxEntries(limitPerFeed), 1)
+		lt, seen := feedTimestamp(ts, f)
+
+		h := make(entryHeap, 0, min(limit, len(f.Entries)))
+		for _, e := range f.Entries {
+			if seen && !e.Updated.After(lt) {
+				continue
+			}
+			if len(h) < limit {
+				heap.Push(&h, e)
+			} else if e.Updated.After(h[0].Updated) {
+				h[0] = e
+				heap.Fix(&h, 0)
+			}
+		}
+
+		if len(h) == 0 && (f.conf == nil || !f.conf.AlwaysShow) {
+			continue
+		}
+
+		nf := &Feed{Title: f.Title, Subtitle: f.Subtitle, ID: f.ID, Link: f.Link, Updated: f.Updated, Entries: make([]*FeedEntry, len(h)), conf: f.conf, sharedLink: f.sharedLink}
+		for i, e := range h {
+			nf.Entries[i] = e.Copy()
+			if f.conf != nil {
+				nf.Entries[i].Boosted = matchesKeywords(e, f.conf.BoostKeywords)
+			}
+		}
+		sort.Slice(nf.Entries, func(i, j int) bool {
+			if nf.Entries[i].Boosted != nf.Entries[j].Boosted {
+				return nf.Entries[i].Boosted
+			}
+			return nf.Entries[i].Updated.Before(nf.Entries[j].Updated)
+		})
+
+		result = append(result, nf)
+	}
+	return result
+}
+
+func updateTimestamps(ts map[string]time.Time, nd []*Feed) {
+	for _, f := range nd {
+		es := append(append([]*FeedEntry{}, f.Entries...), f.dropped...)
+		if len(es) == 0 {
+			continue
+		}
+
+		lt, ok := feedTimestamp(ts, f)
+		if !ok {
+			lt = es[0].Updated
+		}
+		for _, e := range es {
+			if e.Updated.After(lt) {
+				lt = e.Updated
+			}
+		}
+
+		ts[f.ID] = lt
+		if lk := f.linkKey(); lk != "" {
+			ts[lk] = lt
+		}
+	}
+}
+
+// markSharedLinks marks feeds whose canonical link is shared with another of
+// the given feeds.
+func markSharedLinks(fs []*Feed) {
+	count := map[string]int{}
+	for _, f := range fs {
+		if lk := linkKey(f.Link); lk != "" {
+			count[lk]++
+		}
+	}
+	for _, f := range fs {
+		f.sharedLink = count[linkKey(f.Link)] > 1
+	}
+}
+
+// linkKey is the timestamps key for the feed's link, empty if the link is
+// shared with another feed or the same as the feed's ID.
+func (f *Feed) linkKey() string {
+	lk := linkKey(f.Link)
+	if f.sharedLink || lk == linkKey(f.ID) {
+		return ""
+	}
+	return lk
+}
+
+// linkKey is the timestamps key for the feed's canonicalized link.
+func linkKey(link string) string {
+	if strings.TrimSpace(link) == "" {
+		return ""
+	}
+
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return ""
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.Fragment = ""
+
+	return "link:" + u.String()
+}
+
+// feedTimestamp looks up the feed's timestamp by its ID, falling back to its
+// link, so that feeds with an unstable ID but a stable link aren't mistaken
+// for new feeds.
+func feedTimestamp(ts map[string]time.Time, f *Feed) (time.Time, bool) {
+	if it, ok := ts[f.ID]; ok {
+		return it, true
+	}
+	if lk := f.linkKey(); lk != "" {
+		lt, ok := ts[lk]
+		return lt, ok
+	}
+	return time.Time{}, false
+}
+
+// lastRunTime returns the timestamp file's modification time, to use as the
+// boundary for all feeds rather than their individual timestamps. It has to
+// be checked before readTimestamps creates a missing file.
+func lastRunTime(fn string) (time.Time, error) {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to stat timestamps file %#v err=%w", fn, err)
+	}
+
+	return fi.ModTime(), nil
+}
+
+// uniformTimestamps uses the given time as the timestamp of all given feeds.
+func uniformTimestamps(fs []*Feed, t time.Time) map[string]time.Time {
+	result := map[string]time.Time{}
+	for _, f := range fs {
+		result[f.ID] = t
+	}
+	return result
+}
+
+var archiveHeader = []string{"id", "feed", "title", "link", "updated", "author"}
+
+func archiveID(e *FeedEntry) string {
+	if e.ID != "" {
+		return e.ID
+	}
+	return e.Link
+}
+
+// archiveEntries appends the given entries to the CSV archive file, skipping
+// entries whose ID is already archived.
+func archiveEntries(fn string, fs []*Feed) error {
+	seen := map[string]bool{}
+	exists := false
+
+	rf, err := os.Open(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to open archive file %#v err=%w", fn, err)
+	}
+	if err == nil {
+		exists = true
+		rs, err := csv.NewReader(rf).ReadAll()
+		rf.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read archive file %#v err=%w", fn, err)
+		}
+		for _, r := range rs {
+			seen[r[0]] = true
+		}
+	}
+
+	af, err := os.OpenFile(fn, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open archive file %#v err=%w", fn, err)
+	}
+	defer af.Close()
+
+	w := csv.NewWriter(af)
+	if !exists {
+		w.Write(archiveHeader)
+	}
+	for _, f := range fs {
+		for _, e := range f.Entries {
+			id := archiveID(e)
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			w.Write([]string{id, f.Title, e.Title, e.Link, e.Updated.Format(time.RFC3339), e.Author})
+		}
+	}
+	w.Flush()
+
+	err = w.Error()
+	if err != nil {
+		return fmt.Errorf("failed to write archive file %#v err=%w", fn, err)
+	}
+
+	return nil
+}
+
+func readTimestamps(fn string) (map[string]time.Time, error) {
+	var err error
+	var result map[string]time.Time
+	var bt []byte
+	var fh *os.File
+
+	fh, err = os.OpenFile(fn, os.O_CREATE, 0o677)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open timestamps file %#v err=%w", fn, err)
+	}
+
+	bt, err = io.ReadAll(fh)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read timestamps file %#v err=%w", fn, err)
+	}
+
+	if len(bt) == 0 {
+		return map[string]time.Time{}, nil
+	}
+
+	err = yaml.Unmarshal(bt, &result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal timestamps %#v file err=%w", fn, err)
+	}
+
+	return result, nil
+}
+
+func writeTimestamps(fn string, ts map[string]time.Time) error {
+	var err error
+	var bt []byte
+
+	bt, err = yaml.Marshal(ts)
+	if err != nil {
+		return fmt.Errorf("failed to marshal timestamps err=%w", err)
+	}
+
+	err = os.WriteFile(fn, bt, 0o677)
+	if err != nil {
+		return fmt.Errorf("failed to write timestamps file err=%w", err)
+	}
+
+	return nil
+}
+
+// State is persisted between runs in addition to the timestamps.
+type State struct {
+	LastSend time.Time `yaml:"last-send,omitempty"`
+
+	// Feeds tracks the status of each feed by its url.
+	Feeds map[string]*FeedStatus `yaml:"feeds,omitempty"`
+
+	// Spool holds new entries by feed url that weren't sent yet because it
+	// wasn't a send day.
+	Spool map[string]*SpooledFeed `yaml:"spool,omitempty"`
+
+	// Runs counts the runs that downloaded feeds, Seen holds the run in
+	// which a sent entry was last seen by its feed url and entry ID.
+	Runs int            `yaml:"runs,omitempty"`
+	Seen map[string]int `yaml:"seen,omitempty"`
+
+	// SentIDs holds the keys of the most recently sent entries by feed url.
+	SentIDs map[string][]string `yaml:"sent-ids,omitempty"`
+
+	// ContentHashes holds the content hash of sent entries by feed url and
+	// entry key.
+	ContentHashes map[string]map[string]string `yaml:"content-hashes,omitempty"`
+
+	// FileHashes holds the hash of the config and feeds files by path, as of
+	// the last run or feeder's own edits, for config-change-warning.
+	FileHashes map[string]string `yaml:"file-hashes,omitempty"`
+
+	// Clamped holds the time that future-dated entries were clamped to by
+	// feed url and entry key.
+	Clamped map[string]map[string]time.Time `yaml:"clamped,omitempty"`
+}
+
+// SpooledFeed holds the unsent entries of a feed.
+type SpooledFeed struct {
+	ID      string       `yaml:"id"`
+	Title   string       `yaml:"title"`
+	Link    string       `yaml:"link"`
+	Entries []*FeedEntry `yaml:"entries"`
+}
+
+// FeedStatus summarizes a feed's recent downloads.
+type FeedStatus struct {
+	LastSuccess time.Time `yaml:"last-success,omitempty" json:"last_success,omitempty"`
+	LastError   string    `yaml:"last-error,omitempty" json:"last_error,omitempty"`
+	NewEntries  int       `yaml:"new-entries" json:"new_entries"`
+	Failures    int       `yaml:"failures" json:"failures"`
+	Format      string    `yaml:"format,omitempty" json:"format,omitempty"`
+	ID          string    `yaml:"id,omitempty" json:"id,omitempty"`
+
+	// KeepID is set once the feed changed its format, from then on ID is
+	// used as the feed's ID regardless of its format.
+	KeepID bool `yaml:"keep-id,omitempty" json:"keep_id,omitempty"`
+}
+
+func (st *State) feed(url string) *FeedStatus {
+	if st.Feeds == nil {
+		st.Feeds = map[string]*FeedStatus{}
+	}
+	fs, ok := st.Feeds[url]
+	if !ok {
+		fs = &FeedStatus{}
+		st.Feeds[url] = fs
+	}
+	return fs
+}
+
+// maxSentIDsPerFeed caps the number of sent entries that are remembered per
+// feed for dedup-by-id.
+const maxSentIDsPerFeed = 1000
+
+// entryKey identifies an entry by its ID, or a hash of its title and link if
+// it has none.
+func entryKey(e *FeedEntry) string {
+	if e.ID != "" {
+		return e.ID
+	}
+	sum := sha1.Sum([]byte(e.Title + "\n" + e.Link))
+	return "sha1:" + hex.EncodeToString(sum[:])
+}
+
+// dropSent drops entries that were sent before, regardless of their update
+// time.
+func (st *State) dropSent(fs []*Feed) {
+	for _, f := range fs {
+		sent := map[string]bool{}
+		for _, k := range st.SentIDs[f.conf.URL] {
+			sent[k] = true
+		}
+
+		kept := []*FeedEntry{}
+		for _, e := range f.Entries {
+			if !sent[entryKey(e)] {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) < len(f.Entries) {
+			log.Printf("dropped %v already sent entries for feed %#v", len(f.Entries)-len(kept), f.Title)
+		}
+		f.Entries = kept
+	}
+}
+
+// recordSent remembers the sent entries' keys, dropping the oldest ones
+// beyond maxSentIDsPerFeed.
+func (st *State) recordSent(fs []*Feed) {
+	if st.SentIDs == nil {
+		st.SentIDs = map[string][]string{}
+	}
+	for _, f := range fs {
+		ids := st.SentIDs[f.conf.URL]
+		for _, e := range f.Entries {
+			ids = append(ids, entryKey(e))
+		}
+		if len(ids) > maxSentIDsPerFeed {
+			ids = ids[len(ids)-maxSentIDsPerFeed:]
+		}
+		st.SentIDs[f.conf.URL] = ids
+	}
+}
+
+func contentHash(e *FeedEntry) string {
+	sum := sha1.Sum([]byte(e.Title + "\n" + string(e.Content)))
+	return hex.EncodeToString(sum[:])
+}
+
+// dropUnchanged drops entries whose title and content are unchanged since
+// they were sent, so entries that are only re-sent because their update time
+// advanced are skipped. Hashes of entries that left the feed are forgotten.
+func (st *State) dropUnchanged(fs []*Feed) {
+	for _, f := range fs {
+		hs := st.ContentHashes[f.conf.URL]
+		present := map[string]bool{}
+		kept := []*FeedEntry{}
+		for _, e := range f.Entries {
+			k := entryKey(e)
+			present[k] = true
+			e.contentHash = contentHash(e)
+			if h, ok := hs[k]; ok && h == e.contentHash {
+				continue
+			}
+			kept = append(kept, e)
+		}
+		if len(kept) < len(f.Entries) {
+			log.Printf("dropped %v unchanged entries for feed %#v", len(f.Entries)-len(kept), f.Title)
+		}
+		f.Entries = kept
+
+		for k := range hs {
+			if !present[k] {
+				delete(hs, k)
+			}
+		}
+	}
+}
+
+// recordContentHashes remembers the content hashes of the sent entries.
+func (st *State) recordContentHashes(fs []*Feed) {
+	if st.ContentHashes == nil {
+		st.ContentHashes = map[string]map[string]string{}
+	}
+	for _, f := range fs {
+		hs := st.ContentHashes[f.conf.URL]
+		if hs == nil {
+			hs = map[string]string{}
+			st.ContentHashes[f.conf.URL] = hs
+		}
+		for _, e := range f.Entries {
+			if e.contentHash != "" {
+				hs[entryKey(e)] = e.contentHash
+			}
+		}
+	}
+}
+
+// fileHash returns the hash of the file's contents, or an empty string if it
+// doesn't exist.
+func fileHash(fn string) (string, error) {
+	bt, err := os.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read file %#v err=%w", fn, err)
+	}
+	sum := sha1.Sum(bt)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// changedFiles returns the files whose hash differs from the recorded one,
+// and records their current hashes. Files without a recorded hash aren't
+// considered changed.
+func (st *State) changedFiles(fps []string) ([]string, error) {
+	changed := []string{}
+	for _, fp := range fps {
+		prev, ok := st.FileHashes[fp]
+		h, err := fileHash(fp)
+		if err != nil {
+			return nil, err
+		}
+		if ok && prev != h {
+			changed = append(changed, fp)
+		}
+	}
+	return changed, st.recordFileHashes(fps)
+}
+
+// recordFileHashes records the current hashes of the given files, e.g. after
+// feeder edited them itself.
+func (st *State) recordFileHashes(fps []string) error {
+	if st.FileHashes == nil {
+		st.FileHashes = map[string]string{}
+	}
+	for _, fp := range fps {
+		h, err := fileHash(fp)
+		if err != nil {
+			return err
+		}
+		st.FileHashes[fp] = h
+	}
+	return nil
+}
+
+// recordFeedsEdit records the hash of a feeds file that feeder edited, so
+// that config-change-warning doesn't report the edit.
+func recordFeedsEdit(cfg *Config, fp string) error {
+	if cfg.ConfigChangeWarning == "" {
+		return nil
+	}
+
+	st, err := readState(cfg.stateFile())
+	if err != nil {
+		return err
+	}
+
+	err = st.recordFileHashes([]string{fp})
+	if err != nil {
+		return err
+	}
+
+	return writeState(cfg.stateFile(), st)
+}
+
+// warnChangedFiles reports config and feeds files that changed since the last
+// run other than by feeder itself, via log and optionally an email.
+func warnChangedFiles(cfg *Config, st *State) error {
+	fps, err := cfg.watchedFiles()
+	if err != nil {
+		return err
+	}
+
+	changed, err := st.changedFiles(fps)
+	if err != nil {
+		return err
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	msg := fmt.Sprintf("files changed since the last run: %s", strings.Join(changed, ", "))
+	log.Printf("warning: %s", msg)
+
+	if cfg.ConfigChangeWarning != "email" || cfg.OutputFile != "" {
+		return nil
+	}
+
+	err = deliver(cfg.Email, &message{
+		To:      cfg.Email.From,
+		Subject: "feeder warning: config changed",
+		Body:    fmt.Sprintf("<p>%s</p>", html.EscapeString(msg)),
+		Text:    msg,
+	})
+	if err != nil {
+		log.Printf("failed to send config change warning err=%v", err)
+	}
+	return nil
+}
+
+func seenKey(f *Feed, e *FeedEntry) string {
+	return f.conf.URL + " " + entryKey(e)
+}
+
+// dedupWindow drops entries that were sent before and were seen within the
+// last window runs, so entries that briefly disappear from a feed aren't sent
+// again when they reappear. Entries that are still in the feed stay in the
+// window.
+func (st *State) dedupWindow(fs []*Feed, window int) {
+	st.Runs += 1
+	if st.Seen == nil {
+		st.Seen = map[string]int{}
+	}
+
+	for k, r := range st.Seen {
+		if st.Runs-r > window {
+			delete(st.Seen, k)
+		}
+	}
+
+	for _, f := range fs {
+		kept := []*FeedEntry{}
+		for _, e := range f.Entries {
+			k := seenKey(f, e)
+			if _, ok := st.Seen[k]; ok {
+				st.Seen[k] = st.Runs
+				continue
+			}
+			kept = append(kept, e)
+		}
+		if len(kept) < len(f.Entries) {
+			log.Printf("dropped %v previously sent entries for feed %#v", len(f.Entries)-len(kept), f.Title)
+		}
+		f.Entries = kept
+	}
+}
+
+// markSent adds the sent entries to the dedup window.
+func (st *State) markSent(fs []*Feed) {
+	if st.Seen == nil {
+		st.Seen = map[string]int{}
+	}
+	for _, f := range fs {
+		for _, e := range f.Entries {
+			st.Seen[seenKey(f, e)] = st.Runs
+		}
+	}
+}
+
+// parseWeekday parses the full or three letter name of a weekday.
+func parseWeekday(s string) (time.Weekday, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		n := strings.ToLower(d.String())
+		if s == n || s == n[:3] {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+// isSendDay checks whether emails are sent on the day of the given time, all
+// days are send days unless send-days is configured.
+func (cfg *Config) isSendDay(t time.Time) bool {
+	if len(cfg.SendDays) == 0 {
+		return true
+	}
+	for _, s := range cfg.SendDays {
+		if d, ok := parseWeekday(s); ok && d == t.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// spool adds the new entries to the state's spool, skipping entries that
+// were spooled on a previous run already.
+func (st *State) spool(fs []*Feed) {
+	if st.Spool == nil {
+		st.Spool = map[string]*SpooledFeed{}
+	}
+	for _, f := range fs {
+		if len(f.Entries) == 0 {
+			continue
+		}
+		sf, ok := st.Spool[f.conf.URL]
+		if !ok {
+			sf = &SpooledFeed{}
+			st.Spool[f.conf.URL] = sf
+		}
+		sf.ID, sf.Title, sf.Link = f.ID, f.Title, f.Link
+		sf.Entries = mergeEntries(sf.Entries, f.Entries)
+	}
+}
+
+// unspool merges the spooled entries into the new data. Spooled feeds
+// without new entries are taken from the downloaded feeds, or restored from
+// the spool if they failed to download.
+func (st *State) unspool(nd, downloaded []*Feed) []*Feed {
+	for u, sf := range st.Spool {
+		var f *Feed
+		for _, c := range nd {
+			if c.conf.URL == u {
+				f = c
+			}
+		}
+		if f == nil {
+			f = &Feed{ID: sf.ID, Title: sf.Title, Link: sf.Link, conf: &ConfigFeed{URL: u}}
+			for _, c := range downloaded {
+				if c.conf == nil || c.conf.URL != u {
+					continue
+				}
+				f.conf = c.conf
+				if c.Failure == nil {
+					f = &Feed{Title: c.Title, Subtitle: c.Subtitle, ID: c.ID, Link: c.Link, Updated: c.Updated, conf: c.conf, sharedLink: c.sharedLink}
+				}
+			}
+			nd = append(nd, f)
+		}
+		f.Entries = mergeEntries(sf.Entries, f.Entries)
+	}
+	return nd
+}
+
+// mergeEntries appends the entries of b that aren't in a, sorted by update
+// time ascending.
+func mergeEntries(a, b []*FeedEntry) []*FeedEntry {
+	seen := map[string]bool{}
+	result := []*FeedEntry{}
+	for _, e := range append(append([]*FeedEntry{}, a...), b...) {
+		if k := entryKey(e); !seen[k] {
+			seen[k] = true
+			result = append(result, e)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Updated.Before(result[j].Updated) })
+	return result
+}
+
+// stateFile defaults to a file next to the timestamps file.
+func (cfg *Config) stateFile() string {
+	if cfg.StateFile != "" {
+		return cfg.StateFile
+	}
+	ext := filepath.Ext(cfg.TimestampFile)
+	return strings.TrimSuffix(cfg.TimestampFile, ext) + "-state" + ext
+}
+
+func readState(fn string) (*State, error) {
+	st := &State{}
+	bt, err := os.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file %#v err=%w", fn, err)
+	}
+
+	err = yaml.Unmarshal(bt, st)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal state file %#v err=%w", fn, err)
+	}
+
+	return st, nil
+}
+
+func writeState(fn string, st *State) error {
+	bt, err := yaml.Marshal(st)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state err=%w", err)
+	}
+
+	err = os.WriteFile(fn, bt, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write state file err=%w", err)
+	}
+
+	return nil
+}
+
+// FormatTime prints a time with layout "2006-01-02 15:04 MST"
+func FormatTime(t time.Time) string {
+	return t.Format("2006-01-02 15:04 MST")
+}
+
+// FormatLayoutTime prints a time according to the given layout.
+func FormatLayoutTime(layout string, t *time.Time) string {
+	return t.Format(layout)
+}
+
+// humanSize formats the given number of bytes, e.g. "12.3 MB". It returns an
+// empty string for unknown sizes.
+func humanSize(bytes int64) string {
+	if bytes <= 0 {
+		return ""
+	}
+	if bytes < 1000 {
+		return fmt.Sprintf("%v B", bytes)
+	}
+
+	size := float64(bytes)
+	for _, unit := range []string{"kB", "MB", "GB"} {
+		size /= 1000
+		if size < 1000 || unit == "GB" {
+			return fmt.Sprintf("%.1f %s", size, unit)
+		}
+	}
+	return ""
+}
+
+// mediaKind classifies the given MIME type as audio, video, image or file.
+func mediaKind(mime string) string {
+	kind, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(mime)), "/")
+	switch kind {
+	case "audio", "video", "image":
+		return kind
+	}
+	return "file"
+}
+
+var templateFuncs = map[string]any{
+	"FormatTime":       FormatTime,
+	"FormatLayoutTime": FormatLayoutTime,
+	"humanSize":        humanSize,
+	"mediaKind":        mediaKind,
+}
+
+// templateFuncs returns the functions available in email templates, including
+// those that depend on the config.
+func (cfg *Config) templateFuncs() map[string]any {
+	loc := cfg.displayLocation()
+	fs := map[string]any{}
+	for n, f := range templateFuncs {
+		fs[n] = f
+	}
+
+	fs["GroupByDay"] = func(es []*FeedEntry) []*EntryDay {
+		return groupEntriesByDay(es, loc)
+	}
+
+	// times keep their own zone unless display-timezone is set.
+	if cfg.DisplayTimezone != "" {
+		fs["FormatTime"] = func(t time.Time) string {
+			return FormatTime(t.In(loc))
+		}
+		fs["FormatLayoutTime"] = func(layout string, t *time.Time) string {
+			return t.In(loc).Format(layout)
+		}
+	}
+
+	return fs
+}
+
+// displayLocation returns the configured display-timezone, or the local
+// timezone if it isn't set.
+func (cfg *Config) displayLocation() *time.Location {
+	if cfg.DisplayTimezone == "" {
+		return time.Local
+	}
+
+	loc, err := time.LoadLocation(cfg.DisplayTimezone)
+	if err != nil {
+		log.Printf("ignoring invalid display-timezone %#v err=%v", cfg.DisplayTimezone, err)
+		return time.Local
+	}
+	return loc
+}
+
+var defaultEmailTemplate = `
+{{ define "entry" }}
+  <h2 style="border: 1px solid #acb0bf; border-radius: 3px; background: #f4f4f4; padding: 1em; margin: 1.6em 0;">{{ if .Boosted }}<span style="color: Goldenrod;">&#9733;</span> {{ end }}<a href="{{ .Link }}" style="text-decoration: none; color: RoyalBlue; ">{{ .Title }}</a><span style="font-size:0.75rem;margin-left:1rem;">{{ FormatTime .Updated }}</span>{{ if .Author }}<span style="font-size:0.75rem;margin-left:1rem;">by {{ .Author }}</span>{{ end }}{{ if .CommentCount }}<span style="font-size:0.75rem;margin-left:1rem;">{{ .CommentCount }} comments</span>{{ end }}</h2>
+  <div>
+    {{ .Content }}
+  </div>
+  {{ with .Podcast }}{{ template "podcast" . }}{{ end }}
+  {{ range .Enclosures }}{{ $kind := mediaKind .Type }}{{ if or (eq $kind "audio") (eq $kind "video") }}{{ template "enclosure" . }}{{ end }}{{ end }}
+{{ end }}
+
+{{ define "podcast" }}
+  {{ if or .Season .Episode .Duration }}<p style="font-size:0.75rem; color: #6a6e7c;">{{ if .Season }}Season {{ .Season }}{{ end }}{{ if and .Season .Episode }}, {{ end }}{{ if .Episode }}Episode {{ .Episode }}{{ end }}{{ if and (or .Season .Episode) .Duration }} &middot; {{ end }}{{ if .Duration }}{{ .FormatDuration }}{{ end }}</p>{{ end }}
+{{ end }}
+
+{{ define "enclosure" }}
+  {{ $kind := mediaKind .Type }}
+  <p style="font-size:0.75rem;"><a href="{{ .URL }}" style="text-decoration: none; color: RoyalBlue;">{{ if eq $kind "audio" }}&#127911;{{ else if eq $kind "video" }}&#127916;{{ else if eq $kind "image" }}&#128444;{{ else }}&#128206;{{ end }} Download {{ $kind }}</a>{{ with humanSize .Length }} <span style="color: #6a6e7c;">({{ . }})</span>{{ end }}</p>
+{{ end }}
+
+{{ define "video" }}
+  {{ if .Thumbnail }}
+  <h2 style="border: 1px solid #acb0bf; border-radius: 3px; background: #f4f4f4; padding: 1em; margin: 1.6em 0;">{{ if .Boosted }}<span style="color: Goldenrod;">&#9733;</span> {{ end }}<a href="{{ .Link }}" style="text-decoration: none; color: RoyalBlue; ">{{ .Title }}</a><span style="font-size:0.75rem;margin-left:1rem;">{{ FormatTime .Updated }}</span>{{ if .Author }}<span style="font-size:0.75rem;margin-left:1rem;">by {{ .Author }}</span>{{ end }}</h2>
+  <div class="video">
+    <a href="{{ .Link }}"><img src="{{ .Thumbnail }}" style="max-width: 100%;" /></a>
+    {{ if or .Views .Rating }}<p style="font-size:0.75rem; color: #6a6e7c;">{{ if .Views }}{{ .Views }} views{{ end }}{{ if and .Views .Rating }} &middot; {{ end }}{{ if .Rating }}rated {{ printf "%.1f" .Rating }}{{ end }}</p>{{ end }}
+  </div>
+  {{ else }}{{ template "entry" . }}{{ end }}
+{{ end }}
+
+{{ define "successes" }}
+{{ if .Chronological }}
+{{ range .Days }}
+<h1 style="border: 1px solid #acb0bf; border-radius: 3px; background: #f4f4f4; padding: 1em; margin: 1.6em 0; color: #6a6e7c;">{{ .Label }}</h1>
+  {{ range .Entries }}
+  <p style="font-size:0.75rem; margin: 1.6em 0 -1.2em 0;"><a href="{{ .FeedLink }}" style="text-decoration: none; color: #6a6e7c;">{{ .FeedTitle }}</a></p>
+  {{ if .FeedFragment }}{{ fragment .FeedFragment . }}{{ else if eq .FeedLayout "video" }}{{ template "video" . }}{{ else }}{{ template "entry" . }}{{ end }}
+  {{ end }}
+{{ end }}
+{{ else }}
+{{ range .Successes}}
+<h1 style="border: 1px solid #acb0bf; border-radius: 3px; background: #f4f4f4; padding: 1em; margin: 1.6em 0;"><a href="{{ .Link }}" style="text-decoration: none; color: RoyalBlue; ">{{ .Title }}</a>{{ if and $.ShowUpdated (not .Updated.IsZero) }}<span style="font-size:0.75rem;margin-left:1rem;">updated {{ FormatTime .Updated }}</span>{{ end }}</h1>
+  {{ if .Subtitle }}<p style="color: #6a6e7c; margin: -1em 0 1.6em 1em;">{{ .Subtitle }}</p>{{ end }}
+  {{ if not .Entries }}<p style="color: #6a6e7c; margin: 1.6em 0;">No new entries.</p>{{ else if .Fragment }}{{ $fragment := .Fragment }}{{ range .Entries }}{{ fragment $fragment . }}{{ end }}{{ else if eq .Layout "video" }}{{ range .Entries }}{{ template "video" . }}{{ end }}{{ else }}{{ range .Entries }}{{ template "entry" . }}{{ end }}{{ end }}
+{{ end }}
+{{ end }}
+{{ end }}
+
+{{ define "failures" }}
+{{ range .Failures}}
+<h1 style="border: 1px solid #acb0bf; border-radius: 3px; background: #f4f4f4; padding: 1em; margin: 1.6em 0;"><a href="{{ .Link }}" style="text-decoration: none; color: RoyalBlue; ">{{ .Title }}</a></h1>
+Failed to process feed: {{ .Failure }}
+{{ if .AutoDisabled }}<p>The feed was disabled after repeated failures, remove <code>disabled: true</code> from the feeds file to enable it again.</p>{{ end }}
+{{ end }}
+{{ end }}
+
+{{ if .Greeting }}<p style="margin: 1.6em 0;">{{ .Greeting }}</p>{{ end }}
+{{ if .ShowSummary }}<p style="color: #6a6e7c; margin: 1.6em 0;">{{ .Summary }}</p>{{ end }}
+
+{{ if .FailuresFirst }}{{ template "failures" . }}{{ else }}{{ template "successes" . }}{{ end }}
+
+<br />
+<hr />
+<br />
+
+{{ if .FailuresFirst }}{{ template "successes" . }}{{ else }}{{ template "failures" . }}{{ end }}
+
+{{ if .Signature }}<p style="color: #6a6e7c; margin: 1.6em 0;">{{ .Signature }}</p>{{ end }}
+`
+
+var defaultTextEmailTemplate = `{{ if .Greeting }}{{ .Greeting }}
+
+{{ end }}{{ if .ShowSummary }}{{ .Summary }}
+
+{{ end }}{{ if and .FailuresFirst .Failures }}{{ template "failures" . }}
+{{ end }}{{ if .Chronological }}{{ range .Days }}{{ .Label }}
+{{ range .Entries }}
+  * {{ .Title }} ({{ .FeedTitle }}, {{ FormatTime .Updated }}{{ if .Author }}, by {{ .Author }}{{ end }})
+    {{ .Link }}
+{{ end }}
+{{ end }}{{ else }}{{ range .Successes }}{{ .Title }}
+{{ .Link }}
+{{ if not .Entries }}
+  No new entries.
+{{ end }}{{ range .Entries }}
+  * {{ if .Boosted }}★ {{ end }}{{ .Title }} ({{ FormatTime .Updated }}{{ if .Author }}, by {{ .Author }}{{ end }})
+    {{ .Link }}
+{{ end }}
+{{ end }}{{ end }}{{ if and (not .FailuresFirst) .Failures }}{{ template "failures" . }}{{ end }}{{ if .Signature }}
+{{ .Signature }}
+{{ end }}{{ define "failures" }}Failures
+{{ range .Failures }}
+  * {{ .Title }}: {{ .Failure }}
+{{ end }}{{ end }}`
+
+func readTextEmailTemplate(fn string) (string, error) {
+	if fn == "" {
+		return defaultTextEmailTemplate, nil
+	}
+
+	bt, err := os.ReadFile(fn)
+	if err != nil {
+		return "", fmt.Errorf("failed to read text email template file %#v err=%w", fn, err)
+	}
+
+	return string(bt), nil
+}
+
+func readEmailTemplate(fn string) (string, error) {
+	if fn == "" {
+		return defaultEmailTemplate, nil
+	}
+
+	bt, err := os.ReadFile(fn)
+	if err != nil {
+		return "", fmt.Errorf("failed to read email template file %#v err=%w", fn, err)
+	}
+
+	return string(bt), nil
+}
+
+type templateData struct {
+	Successes     []*Feed
+	Failures      []*Feed
+	Chronological bool
+	FailuresFirst bool
+	Days          []*DayGroup
+	ShowSummary   bool
+	ShowUpdated   bool
+	EntryCount    int
+	FeedCount     int
+	FailureCount  int
+	Greeting      string
+	Signature     string
+}
+
+func plural(n int, singular, plural string) string {
+	if n == 1 {
+		return fmt.Sprintf("%v %s", n, singular)
+	}
+	return fmt.Sprintf("%v %s", n, plural)
+}
+
+// Summary describes the counts of the email, e.g. "12 new entries across 5
+// feeds, 1 failure."
+func (td *templateData) Summary() string {
+	s := fmt.Sprintf("%s across %s", plural(td.EntryCount, "new entry", "new entries"), plural(td.FeedCount, "feed", "feeds"))
+	if td.FailureCount > 0 {
+		s += ", " + plural(td.FailureCount, "failure", "failures")
+	}
+	return s + "."
+}
+
+// DayGroup holds the entries of all feeds updated on the same calendar day.
+type DayGroup struct {
+	Date    time.Time
+	Label   string
+	Entries []*SourcedEntry
+}
+
+// SourcedEntry annotates an entry with the feed it came from, for listings
+// that mix entries of different feeds.
+type SourcedEntry struct {
+	*FeedEntry
+	FeedTitle    string
+	FeedLink     string
+	FeedLayout   string
+	FeedFragment string
+}
+
+// now is the current time, tests replace it to control the clock.
+var now = time.Now
+
+// groupByDay buckets entries by their calendar day in the given location,
+// oldest day and entry first. Days are labelled relative to today.
+func groupByDay(fs []*Feed, loc *time.Location, today time.Time) []*DayGroup {
+	es := []*FeedEntry{}
+	sourced := map[*FeedEntry]*SourcedEntry{}
+	for _, f := range fs {
+		for _, e := range f.Entries {
+			es = append(es, e)
+			sourced[e] = &SourcedEntry{FeedEntry: e, FeedTitle: f.Title, FeedLink: f.Link, FeedLayout: f.Layout(), FeedFragment: f.Fragment()}
+		}
+	}
+
+	ty, tm, td := today.In(loc).Date()
+	todayDate := time.Date(ty, tm, td, 0, 0, 0, 0, loc)
+
+	result := []*DayGroup{}
+	for _, ed := range groupEntriesByDay(es, loc) {
+		dg := &DayGroup{Date: ed.Date, Label: dayLabel(ed.Date, todayDate)}
+		for _, e := range ed.Entries {
+			dg.Entries = append(dg.Entries, sourced[e])
+		}
+		result = append(result, dg)
+	}
+
+	return result
+}
+
+// EntryDay holds the entries of a single feed updated on the same calendar day.
+type EntryDay struct {
+	Date    time.Time
+	Entries []*FeedEntry
+}
+
+// groupEntriesByDay buckets the given entries by their calendar day in the
+// given location, oldest day and entry first.
+func groupEntriesByDay(es []*FeedEntry, loc *time.Location) []*EntryDay {
+	sorted := append([]*FeedEntry{}, es...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Updated.Before(sorted[j].Updated)
+	})
+
+	result := []*EntryDay{}
+	var current *EntryDay
+	for _, e := range sorted {
+		y, m, d := e.Updated.In(loc).Date()
+		date := time.Date(y, m, d, 0, 0, 0, 0, loc)
+		if current == nil || !current.Date.Equal(date) {
+			current = &EntryDay{Date: date}
+			result = append(result, current)
+		}
+		current.Entries = append(current.Entries, e)
+	}
+
+	return result
+}
+
+func dayLabel(date, today time.Time) string {
+	switch {
+	case date.Equal(today):
+		return "Today"
+	case date.Equal(today.AddDate(0, 0, -1)):
+		return "Yesterday"
+	default:
+		return date.Format("Monday, 2 January 2006")
+	}
+}
+
+// timeOfDay names the part of the day of the given time, e.g. "morning".
+func timeOfDay(t time.Time) string {
+	switch h := t.Hour(); {
+	case h >= 5 && h < 12:
+		return "morning"
+	case h >= 12 && h < 17:
+		return "afternoon"
+	case h >= 17 && h < 22:
+		return "evening"
+	}
+	return "night"
+}
+
+// renderSubject renders the subject-template, which can refer to .EntryCount,
+// .FeedCount, .FailureCount and .Now, e.g. "{{ .EntryCount }} new items".
+// It returns an empty subject if no template is configured.
+func renderSubject(tmpl string, succs, fails []*Feed, t time.Time) (string, error) {
+	if tmpl == "" {
+		return "", nil
+	}
+
+	st, err := texttemplate.New("subject").Funcs(templateFuncs).Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse subject-template %#v err=%w", tmpl, err)
+	}
+
+	var buf bytes.Buffer
+	err = st.Execute(&buf, struct {
+		EntryCount   int
+		FeedCount    int
+		FailureCount int
+		Now          time.Time
+	}{countEntries(succs), countFeedsWithEntries(succs), len(fails), t})
+	if err != nil {
+		return "", fmt.Errorf("failed to execute subject-template %#v err=%w", tmpl, err)
+	}
+
+	// headers can't span lines, so newlines from the template are folded.
+	return strings.Join(strings.Fields(buf.String()), " "), nil
+}
+
+// renderSalutation renders the greeting or signature template, which can
+// refer to .Now and .TimeOfDay, e.g. "Good {{ .TimeOfDay }}!".
+func renderSalutation(tmpl string, t time.Time) (string, error) {
+	if tmpl == "" {
+		return "", nil
+	}
+
+	st, err := texttemplate.New("salutation").Funcs(templateFuncs).Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse greeting or signature %#v err=%w", tmpl, err)
+	}
+
+	var buf bytes.Buffer
+	err = st.Execute(&buf, struct {
+		Now       time.Time
+		TimeOfDay string
+	}{t, timeOfDay(t)})
+	if err != nil {
+		return "", fmt.Errorf("failed to execute greeting or signature %#v err=%w", tmpl, err)
+	}
+
+	return buf.String(), nil
+}
+
+func newTemplateData(cfg *Config, succs []*Feed, fails []*Feed) *templateData {
+	greeting, err := renderSalutation(cfg.Greeting, now())
+	if err != nil {
+		log.Printf("ignoring greeting err=%v", err)
+	}
+
+	signature, err := renderSalutation(cfg.Signature, now())
+	if err != nil {
+		log.Printf("ignoring signature err=%v", err)
+	}
+
+	return &templateData{
+		Greeting:      greeting,
+		Signature:     signature,
+		Successes:     succs,
+		Failures:      fails,
+		Chronological: cfg.Chronological,
+		FailuresFirst: cfg.SectionOrder == "failures-first",
+		Days:          groupByDay(succs, cfg.displayLocation(), now()),
+		ShowSummary:   cfg.ShowSummaryHeader,
+		ShowUpdated:   cfg.ShowFeedUpdated,
+		EntryCount:    countEntries(succs),
+		FeedCount:     countFeedsWithEntries(succs),
+		FailureCount:  len(fails),
+	}
+}
+
+func makeEmailBody(cfg *Config, succs []*Feed, fails []*Feed, emailTemplate string) (string, error) {
+	var tmpl *template.Template
+	fs := cfg.templateFuncs()
+	// fragment renders the named template, as the template action requires
+	// a constant name.
+	fs["fragment"] = func(name string, data any) (template.HTML, error) {
+		if tmpl.Lookup(name) == nil {
+			return "", fmt.Errorf("undefined template fragment %#v", name)
+		}
+		var buf bytes.Buffer
+		err := tmpl.ExecuteTemplate(&buf, name, data)
+		return template.HTML(buf.String()), err
+	}
+
+	tmpl, err := template.New("email").Funcs(fs).Parse(emailTemplate)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template err=%w", err)
+	}
+
+	for n, f := range cfg.TemplateFragments {
+		_, err = tmpl.New(n).Parse(f)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse template fragment %#v err=%w", n, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, newTemplateData(cfg, succs, fails))
+	if err != nil {
+		return "", fmt.Errorf("failed to execute template err=%w", err)
+	}
+
+	buf.WriteString(cfg.FooterHTML)
+
+	return buf.String(), nil
+}
+
+// makeTextEmailBody renders the plain text alternative of the email body.
+func makeTextEmailBody(cfg *Config, succs []*Feed, fails []*Feed, textTemplate string) (string, error) {
+	tmpl, err := texttemplate.New("text").Funcs(cfg.templateFuncs()).Parse(textTemplate)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse text template err=%w", err)
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, newTemplateData(cfg, succs, fails))
+	if err != nil {
+		return "", fmt.Errorf("failed to execute text template err=%w", err)
+	}
+
+	return buf.String(), nil
+}
+
+var rxURLAttr = regexp.MustCompile(`(?i)\b(src|href)(\s*=\s*)("[^"]*"|'[^']*'|[^\s"'>]+)`)
+
+// rxSwallowedURLAttr matches markup with a src or href attribute inside an
+// attribute value, e.g. after an unterminated quote.
+var rxSwallowedURLAttr = regexp.MustCompile(`(?i)<[a-z][^>]*\b(src|href)\s*=`)
+
+// absolutifyAttrs is the fallback for absolutifyHTML if the content cannot be
+// handled as HTML, it resolves anything that looks like a src or href attribute.
+func absolutifyAttrs(in string, base *url.URL) string {
+	return rxURLAttr.ReplaceAllStringFunc(in, func(m string) string {
+		sm := rxURLAttr.FindStringSubmatch(m)
+		val, quote := sm[3], ""
+		if strings.HasPrefix(val, `"`) || strings.HasPrefix(val, "'") {
+			quote = val[:1]
+			val = val[1 : len(val)-1]
+		}
+
+		pu, err := url.Parse(strings.TrimSpace(val))
+		if err != nil || pu.IsAbs() {
+			return m
+		}
+
+		return sm[1] + sm[2] + quote + base.ResolveReference(pu).String() + quote
+	})
+}
+
+func absolutifyHTML(in string, base *url.URL) (string, error) {
+	absolutify := func(u string) (string, error) {
+		pu, err := url.Parse(u)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse url=%#v err=%w", u, err)
+		}
+
+		if pu.IsAbs() {
+			return u, nil
+		}
+		ru := base.ResolveReference(pu)
+		return ru.String(), nil
+	}
+
+	swallowed := false
+	result, err := transformHTML(in, func(n *html.Node) {
+		if n.Type != html.ElementNode {
+			return
+		}
+
+		for _, a := range n.Attr {
+			swallowed = swallowed || rxSwallowedURLAttr.MatchString(a.Val)
+		}
+
+		switch strings.ToLower(n.Data) {
+		case "img":
+			for i, a := range n.Attr {
+				if strings.ToLower(a.Key) == "src" {
+					nval, err := absolutify(a.Val)
+					if err != nil {
+						log.Printf("ignoring url parse error: %s", err)
+						continue
+					}
+					n.Attr[i].Val = nval
+				}
+			}
+		case "a":
+			for i, a := range n.Attr {
+				if strings.ToLower(a.Key) == "href" {
+					nval, err := absolutify(a.Val)
+					if err != nil {
+						log.Printf("ignoring url parse error: %s", err)
+						continue
+					}
+					n.Attr[i].Val = nval
+				}
+			}
+		}
+	})
+	if err != nil {
+		log.Printf("falling back to resolving attributes, %v", err)
+		return absolutifyAttrs(in, base), nil
+	}
+
+	if swallowed {
+		log.Printf("falling back to resolving attributes, found markup in attribute values")
+		return absolutifyAttrs(in, base), nil
+	}
+
+	return result, nil
+}
+
+// transformHTML parses the given HTML fragment, calls visit for each of its
+// nodes, parents before their children, and renders the result back to HTML.
+func transformHTML(in string, visit func(n *html.Node)) (string, error) {
+	node, err := html.ParseFragment(strings.NewReader(in), nil)
+	if err != nil {
+		return in, fmt.Errorf("failed to parse as HTML err=%w", err)
+	}
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		visit(n)
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(in)))
+	for _, n := range node {
+		walk(n)
+		err = html.Render(buf, n)
+		if err != nil {
+			return in, fmt.Errorf("failed to render back to html err=%w", err)
+		}
+	}
+
+	return buf.String(), nil
+}
+
+// upgradeImagesHTML rewrites http image sources to https. Unless always is
+// set, only images served from the https base's host are upgraded, as other
+// hosts might not support https.
+func upgradeImagesHTML(in string, base *url.URL, always bool) (string, error) {
+	upgrade := func(u string) string {
+		pu, err := url.Parse(strings.TrimSpace(u))
+		if err != nil || pu.Scheme != "http" {
+			return u
+		}
+		if !always && (base.Scheme != "https" || !strings.EqualFold(pu.Host, base.Host)) {
+			return u
+		}
+		pu.Scheme = "https"
+		return pu.String()
+	}
+
+	return transformHTML(in, func(n *html.Node) {
+		if n.Type != html.ElementNode || strings.ToLower(n.Data) != "img" {
+			return
+		}
+
+		for i, a := range n.Attr {
+			switch strings.ToLower(a.Key) {
+			case "src":
+				n.Attr[i].Val = upgrade(a.Val)
+			case "srcset":
+				cs := strings.Split(a.Val, ",")
+				for ci, c := range cs {
+					fs := strings.Fields(c)
+					if len(fs) == 0 {
+						continue
+					}
+					fs[0] = upgrade(fs[0])
+					cs[ci] = strings.Join(fs, " ")
+				}
+				n.Attr[i].Val = strings.Join(cs, ", ")
+			}
+		}
+	})
+}
+
+var defaultAllowedHTMLTags = []string{
+	"a", "abbr", "b", "blockquote", "br", "caption", "cite", "code", "dd", "del",
+	"div", "dl", "dt", "em", "figcaption", "figure", "h1", "h2", "h3", "h4", "h5",
+	"h6", "hr", "i", "img", "ins", "li", "ol", "p", "pre", "q", "s", "small",
+	"span", "strong", "sub", "sup", "table", "tbody", "td", "tfoot", "th",
+	"thead", "tr", "u", "ul",
+}
+
+var defaultAllowedHTMLAttrs = []string{
+	"alt", "colspan", "height", "href", "rowspan", "src", "srcset", "title", "width",
+}
+
+// unsafeHTMLTags are removed including their children, rather than being
+// replaced by their children like other tags that aren't allowed.
+var unsafeHTMLTags = map[string]bool{
+	"applet":   true,
+	"base":     true,
+	"embed":    true,
+	"form":     true,
+	"frame":    true,
+	"frameset": true,
+	"iframe":   true,
+	"link":     true,
+	"math":     true,
+	"meta":     true,
+	"noscript": true,
+	"object":   true,
+	"script":   true,
+	"style":    true,
+	"svg":      true,
+	"template": true,
+}
+
+// isTrackingPixel checks for images that are at most one pixel wide and high,
+// which are used to track when an email is opened.
+func isTrackingPixel(n *html.Node) bool {
+	if strings.ToLower(n.Data) != "img" {
+		return false
+	}
+
+	size := map[string]int{}
+	for _, a := range n.Attr {
+		key := strings.ToLower(a.Key)
+		if key != "width" && key != "height" {
+			continue
+		}
+		v, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(a.Val), "px"))
+		if err != nil {
+			return false
+		}
+		size[key] = v
+	}
+
+	w, wok := size["width"]
+	h, hok := size["height"]
+	return wok && hok && w <= 1 && h <= 1
+}
+
+// isSafeSrcset checks the URLs of all image candidates in a srcset attribute.
+func isSafeSrcset(v string) bool {
+	for _, c := range strings.Split(v, ",") {
+		fs := strings.Fields(c)
+		if len(fs) > 0 && !isSafeURL(fs[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+var rxHTMLName = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+func validateAllowlist(tags, attrs []string) error {
+	for _, t := range tags {
+		if !rxHTMLName.MatchString(t) {
+			return fmt.Errorf("config has invalid allowed-html-tags entry %#v", t)
+		}
+		if unsafeHTMLTags[t] {
+			return fmt.Errorf("config has unsafe allowed-html-tags entry %#v", t)
+		}
+	}
+
+	for _, a := range attrs {
+		if !rxHTMLName.MatchString(a) {
+			return fmt.Errorf("config has invalid allowed-html-attrs entry %#v", a)
+		}
+		if strings.HasPrefix(a, "on") || a == "style" {
+			return fmt.Errorf("config has unsafe allowed-html-attrs entry %#v", a)
+		}
+	}
+
+	return nil
+}
+
+// htmlAllowlist returns the configured tags and attributes that survive
+// sanitization, falling back to the defaults.
+func (cfg *Config) htmlAllowlist() (map[string]bool, map[string]bool) {
+	toSet := func(l, def []string) map[string]bool {
+		if len(l) == 0 {
+			l = def
+		}
+		s := make(map[string]bool, len(l))
+		for _, v := range l {
+			s[v] = true
+		}
+		return s
+	}
+	return toSet(cfg.AllowedHTMLTags, defaultAllowedHTMLTags), toSet(cfg.AllowedHTMLAttrs, defaultAllowedHTMLAttrs)
+}
+
+func isSafeURL(u string) bool {
+	pu, err := url.Parse(strings.TrimSpace(u))
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(pu.Scheme) {
+	case "", "http", "https", "mailto":
+		return true
+	}
+	return false
+}
+
+// sanitizeHTML strips all tags and attributes that aren't allowed. Tags that
+// aren't allowed are replaced by their children, unless they are unsafe.
+func sanitizeHTML(in string, tags, attrs map[string]bool) (string, error) {
+	body := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	node, err := html.ParseFragment(strings.NewReader(in), body)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse as HTML err=%w", err)
+	}
+
+	for _, n := range node {
+		body.AppendChild(n)
+	}
+
+	var visit func(n *html.Node)
+	visit = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; {
+			next := c.NextSibling
+			switch c.Type {
+			case html.ElementNode:
+				name := strings.ToLower(c.Data)
+				if unsafeHTMLTags[name] || isTrackingPixel(c) {
+					n.RemoveChild(c)
+					break
+				}
+
+				visit(c)
+				if !tags[name] {
+					for gc := c.FirstChild; gc != nil; gc = c.FirstChild {
+						c.RemoveChild(gc)
+						n.InsertBefore(gc, c)
+					}
+					n.RemoveChild(c)
+					break
+				}
+
+				as := []html.Attribute{}
+				for _, a := range c.Attr {
+					key := strings.ToLower(a.Key)
+					if a.Namespace != "" || !attrs[key] {
+						continue
+					}
+					if (key == "href" || key == "src") && !isSafeURL(a.Val) {
+						continue
+					}
+					if key == "srcset" && !isSafeSrcset(a.Val) {
+						continue
+					}
+					as = append(as, a)
+				}
+				c.Attr = as
+			case html.TextNode:
+			default:
+				n.RemoveChild(c)
+			}
+			c = next
+		}
+	}
+	visit(body)
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(in)))
+	for c := body.FirstChild; c != nil; c = c.NextSibling {
+		err := html.Render(buf, c)
+		if err != nil {
+			return "", fmt.Errorf("failed to render back to html err=%w", err)
+		}
+	}
+
+	return buf.String(), nil
+}
+
+func sanitizeFeeds(fs []*Feed, tags, attrs map[string]bool) {
+	for _, f := range fs {
+		for _, e := range f.Entries {
+			nc, err := sanitizeHTML(string(e.Content), tags, attrs)
+			if err != nil {
+				log.Printf("dropping content that failed to sanitize err=%v", err)
+				nc = ""
+			}
+			e.Content = template.HTML(nc)
+		}
+	}
+}
+
+// stopWords are frequent words that identify a language.
+var stopWords = map[string][]string{
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ein", "eine", "mit", "auf", "den", "von", "zu", "sich", "auch", "dem", "wir", "ich", "für", "wird"},
+	"en": {"the", "and", "is", "of", "to", "in", "that", "it", "with", "for", "was", "on", "are", "this", "be", "by", "have", "from", "not", "which"},
+	"es": {"el", "la", "los", "las", "y", "es", "de", "que", "en", "un", "una", "por", "con", "para", "del", "se", "no", "lo", "como", "pero"},
+	"fr": {"le", "la", "les", "et", "est", "des", "une", "un", "du", "que", "qui", "dans", "pour", "pas", "sur", "au", "avec", "ce", "il", "sont"},
+	"it": {"il", "lo", "la", "gli", "e", "è", "di", "che", "un", "una", "per", "con", "non", "del", "della", "sono", "nel", "alla", "anche", "come"},
+	"nl": {"de", "het", "een", "en", "is", "van", "dat", "niet", "op", "te", "zijn", "met", "voor", "ook", "er", "maar", "om", "aan", "bij", "wordt"},
+}
+
+var stopWordLanguages = func() map[string][]string {
+	result := map[string][]string{}
+	for lang, ws := range stopWords {
+		for _, w := range ws {
+			result[w] = append(result[w], lang)
+		}
+	}
+	return result
+}()
+
+var rxWord = regexp.MustCompile(`\pL+`)
+
+// htmlText returns the text contents of the given HTML.
+func htmlText(in string) string {
+	var b strings.Builder
+	z := html.NewTokenizer(strings.NewReader(in))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return b.String()
+		case html.TextToken:
+			b.Write(z.Text())
+			b.WriteString(" ")
+		}
+	}
+}
+
+// detectLanguage guesses the language of the given text by counting stop
+// words. It returns an empty string when no language clearly stands out.
+func detectLanguage(text string) string {
+	counts := map[string]int{}
+	for _, w := range rxWord.FindAllString(strings.ToLower(text), -1) {
+		for _, lang := range stopWordLanguages[w] {
+			counts[lang] += 1
+		}
+	}
+
+	best := ""
+	for lang, c := range counts {
+		if best == "" || c > counts[best] {
+			best = lang
+		}
+	}
+	if counts[best] < 3 {
+		return ""
+	}
+
+	for lang, c := range counts {
+		if lang != best && c == counts[best] {
+			return ""
+		}
+	}
+	return best
+}
+
+// detectLanguages sets the language of entries whose feed didn't declare one.
+func detectLanguages(fs []*Feed) {
+	for _, f := range fs {
+		for _, e := range f.Entries {
+			if e.Language == "" {
+				e.Language = detectLanguage(e.Title + " " + htmlText(string(e.Content)))
+			}
+		}
+	}
+}
+
+func countEntries(fs []*Feed) int {
+	c := 0
+	for _, f := range fs {
+		c += len(f.Entries)
+	}
+	return c
+}
+
+// countFeedsWithEntries counts feeds with entries, as always-show feeds are
+// included without any.
+func countFeedsWithEntries(fs []*Feed) int {
+	c := 0
+	for _, f := range fs {
+		if len(f.Entries) > 0 {
+			c += 1
+		}
+	}
+	return c
+}
+
+func getRedditBearerToken(cfg ConfigReddit) (string, error) {
+	req, err := http.NewRequest(
+		http.MethodPost,
+		"https://www.reddit.com/api/v1/access_token",
+		strings.NewReader(`grant_type=client_credentials`),
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request for reddit bearer token err=%w", err)
+	}
+
+	creds := fmt.Sprintf("%s:%s", cfg.ClientID, cfg.ClientSecret)
+	auth := base64.URLEncoding.EncodeToString([]byte(creds))
+	req.Header.Add("Authorization", fmt.Sprintf("Basic %s", auth))
+	req.Header.Add("User-Agent", UserAgent)
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request reddit bearer token err=%w", err)
+	}
+
+	var tok struct {
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tok)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode reddit response err=%w", err)
+	}
+
+	log.Printf("successfully requested reddit bearer token")
+
+	return tok.AccessToken, nil
+}
+
+// cookieJar records which URLs received cookies so that the otherwise opaque
+// cookiejar.Jar can be persisted between runs.
+type cookieJar struct {
+	*cookiejar.Jar
+
+	mu   sync.Mutex
+	urls map[string]*url.URL
+}
+
+type savedCookie struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+func newCookieJar() *cookieJar {
+	jar, _ := cookiejar.New(nil) // never fails without options
+	return &cookieJar{Jar: jar, urls: map[string]*url.URL{}}
+}
+
+func (j *cookieJar) SetCookies(u *url.URL, cs []*http.Cookie) {
+	j.Jar.SetCookies(u, cs)
+
+	ru := &url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}
+	j.mu.Lock()
+	j.urls[ru.String()] = ru
+	j.mu.Unlock()
+}
+
+func readCookies(fn string, j *cookieJar) error {
+	bt, err := os.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read cookie file %#v err=%w", fn, err)
+	}
+
+	var saved map[string][]savedCookie
+	err = yaml.Unmarshal(bt, &saved)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal cookie file %#v err=%w", fn, err)
+	}
+
+	for su, scs := range saved {
+		u, err := url.Parse(su)
+		if err != nil {
+			log.Printf("ignoring cookies for invalid url=%#v err=%v", su, err)
+			continue
+		}
+		cs := []*http.Cookie{}
+		for _, sc := range scs {
+			cs = append(cs, &http.Cookie{Name: sc.Name, Value: sc.Value})
+		}
+		j.SetCookies(u, cs)
+	}
+
+	return nil
+}
+
+func writeCookies(fn string, j *cookieJar) error {
+	saved := map[string][]savedCookie{}
+
+	j.mu.Lock()
+	for su, u := range j.urls {
+		for _, c := range j.Cookies(u) {
+			saved[su] = append(saved[su], savedCookie{Name: c.Name, Value: c.Value})
+		}
+	}
+	j.mu.Unlock()
+
+	bt, err := yaml.Marshal(saved)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cookies err=%w", err)
+	}
+
+	err = os.WriteFile(fn, bt, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write cookie file err=%w", err)
+	}
+
+	return nil
+}
+
+// httpClient returns the client shared by all requests of a run, so that
+// cookies set by one response are sent along with subsequent requests.
+func (cfg *Config) httpClient() *http.Client {
+	cfg.clientOnce.Do(func() {
+		cfg.client = &http.Client{
+			Timeout: cfg.feedTimeout(nil),
+		}
+		cfg.resetCookieJar()
+	})
+	return cfg.client
+}
+
+// resetCookieJar gives the client a new cookie jar, if configured, seeded
+// from the cookie file, so that each run starts without the session cookies
+// of earlier runs. It does nothing before the client is created.
+func (cfg *Config) resetCookieJar() {
+	if cfg.client == nil || (!cfg.CookieJar && cfg.CookieFile == "") {
+		return
+	}
+
+	cfg.jar = newCookieJar()
+	cfg.client.Jar = cfg.jar
+	if cfg.CookieFile != "" {
+		err := readCookies(cfg.CookieFile, cfg.jar)
+		if err != nil {
+			log.Printf("ignoring failure to read cookies err=%v", err)
+		}
+	}
+}
+
+// requestTimeout returns the timeout set via -timeout, if any, or the given
+// default.
+func (cfg *Config) requestTimeout(def time.Duration) time.Duration {
+	if cfg.timeout > 0 {
+		return cfg.timeout
+	}
+	return def
+}
+
+// defaultHTTPTimeout is the request timeout unless http-timeout is set.
+const defaultHTTPTimeout = 30 * time.Second
+
+// feedTimeout resolves the request timeout for the given feed, which may be
+// nil: -timeout takes precedence over the feed's timeout, which takes
+// precedence over http-timeout.
+func (cfg *Config) feedTimeout(fc *ConfigFeed) time.Duration {
+	switch {
+	case cfg.timeout > 0:
+		return cfg.timeout
+	case fc != nil && fc.Timeout > 0:
+		return fc.Timeout
+	case cfg.HTTPTimeout > 0:
+		return cfg.HTTPTimeout
+	}
+	return defaultHTTPTimeout
+}
+
+// userAgent resolves the User-Agent header for the given feed, which may be
+// nil, preferring the feed's over the global setting and the default.
+func (cfg *Config) userAgent(fc *ConfigFeed) string {
+	switch {
+	case fc != nil && fc.UserAgent != "":
+		return fc.UserAgent
+	case cfg.UserAgent != "":
+		return cfg.UserAgent
+	}
+	return UserAgent
+}
+
+// get requests the given url, applying the feed's request settings if fc is
+// not nil.
+func get(cfg *Config, fc *ConfigFeed, url string) ([]byte, error) {
+	byt, _, err := getContext(context.Background(), cfg, fc, url)
+	return byt, err
+}
+
+// getCanonical is like get, but also returns the url that the given url
+// permanently redirects to, or the given url if it doesn't.
+func getCanonical(cfg *Config, fc *ConfigFeed, url string) ([]byte, string, error) {
+	return getContext(context.Background(), cfg, fc, url)
+}
+
+// maxRetryAfter caps the wait requested by a Retry-After header.
+const maxRetryAfter = 5 * time.Minute
+
+// retryableError marks request failures that are worth retrying, after the
+// given duration if the server asked for one.
+type retryableError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// retryAfter parses a Retry-After header value given in seconds or as a date.
+func retryAfter(v string) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+
+	var d time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = t.Sub(now())
+	}
+
+	return min(max(d, 0), maxRetryAfter)
+}
+
+// getContext requests the given url, retrying timeouts and temporary server
+// errors with exponential backoff.
+func getContext(ctx context.Context, cfg *Config, fc *ConfigFeed, url string) ([]byte, string, error) {
+	backoff := cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		byt, canonical, err := getOnce(ctx, cfg, fc, url)
+
+		var re *retryableError
+		if err == nil || !errors.As(err, &re) || attempt >= cfg.Retries {
+			return byt, canonical, err
+		}
+
+		wait := backoff
+		if re.after > 0 {
+			wait = re.after
+		}
+		log.Printf("retrying request in %v, retry %v of %v err=%v", wait, attempt+1, cfg.Retries, err)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, "", err
+		}
+		backoff *= 2
+	}
+}
+
+func getOnce(ctx context.Context, cfg *Config, fc *ConfigFeed, url string) ([]byte, string, error) {
+	client := *cfg.httpClient()
+	client.Timeout = cfg.feedTimeout(fc)
+
+	// canonical follows redirects only as long as they are permanent.
+	canonical := url
+	permanent := true
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		switch req.Response.StatusCode {
+		case http.StatusMovedPermanently, http.StatusPermanentRedirect:
+			if permanent {
+				canonical = req.URL.String()
+			}
+		default:
+			permanent = false
+		}
+		return nil
+	}
+
+	method, body, contentType := fc.request()
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create request for url=%s err=%w", url, err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if cfg.Reddit.bearerToken != "" && rxReddit.MatchString(url) {
+		req.Header.Add("Authorization", fmt.Sprintf("bearer %s", cfg.Reddit.bearerToken))
+	}
+
+	req.Header.Add("User-Agent", cfg.userAgent(fc))
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+
+	if fc != nil {
+		switch {
+		case fc.BearerToken != "":
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", fc.BearerToken))
+		case fc.Username != "" || fc.Password != "":
+			req.SetBasicAuth(fc.Username, fc.Password)
+		}
+		for k, v := range fc.Headers {
+			req.Header.Set(k, v)
+		}
+		for k, v := range fc.Cookies {
+			req.AddCookie(&http.Cookie{Name: k, Value: v})
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		err = fmt.Errorf("failed to request url=%s err=%w", url, err)
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			return nil, "", &retryableError{err: err}
+		}
+		return nil, "", err
+	}
+
+	byt, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read body contents for url=%s err=%w", url, err)
+	}
+	defer resp.Body.Close()
+
+	byt, err = decodeBody(resp.Header.Get("Content-Encoding"), byt)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode body contents for url=%s err=%w", url, err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		err = fmt.Errorf("unexpected status for url=%s status=%s", url, resp.Status)
+		return nil, "", &retryableError{err: err, after: retryAfter(resp.Header.Get("Retry-After"))}
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+		err = fmt.Errorf("unexpected status for url=%s status=%s", url, resp.Status)
+		return nil, "", &retryableError{err: err}
+	}
+
+	return byt, canonical, nil
+}
+
+// decodeBody decompresses the body according to its Content-Encoding. Bodies
+// that aren't actually compressed are returned as they are, as some servers
+// declare an encoding they didn't apply.
+func decodeBody(encoding string, byt []byte) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		if !bytes.HasPrefix(byt, []byte{0x1f, 0x8b}) {
+			return byt, nil
+		}
+		r, err := gzip.NewReader(bytes.NewReader(byt))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(r)
+	case "deflate":
+		// deflate is supposed to be zlib wrapped, but some servers send raw
+		// deflate data.
+		r, err := zlib.NewReader(bytes.NewReader(byt))
+		if err == nil {
+			dec, err := io.ReadAll(r)
+			if err == nil {
+				return dec, nil
+			}
+		}
+		dec, err := io.ReadAll(flate.NewReader(bytes.NewReader(byt)))
+		if err != nil {
+			return byt, nil
+		}
+		return dec, nil
+	}
+	return byt, nil
+}
+
+func findFeedInfo(byt []byte) (feedTitle, link string) {
+	doc, err := html.Parse(bytes.NewReader(byt))
+	if err != nil {
+		log.Fatalf("failed to parse feed as HTML err=%s", err)
+	}
+
+	var f func(*html.Node)
+	f = func(n *html.Node) {
+		if feedTitle == "" && n.Type == html.ElementNode && n.Data == "title" && n.FirstChild != nil {
+			feedTitle = strings.TrimSpace(n.FirstChild.Data)
+			log.Printf("found title: %#v", feedTitle)
+		}
+		if n.Type == html.ElementNode && n.Data == "link" {
+			href := getAttr(n, "href")
+			title := getAttr(n, "title")
+			typ := getAttr(n, "type")
+			rel := getAttr(n, "rel")
+			if rel == "alternate" && (typ == "application/rss+xml" || typ == "application/atom+xml" || typ == "application/feed+json") {
+				log.Printf("found alternate title=%s type=%s href=%s", title, typ, href)
+				link = href
+				if feedTitle == "" {
+					feedTitle = strings.TrimSpace(title)
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c)
+		}
+	}
+	f(doc)
+
+	return
+}
+
+const (
+	openGraphTimeout = 10 * time.Second
+
+	defaultContentFetchConcurrency = 4
+)
+
+// OpenGraph holds the preview metadata of a linked page.
+type OpenGraph struct {
+	Title       string
+	Description string
+	Image       string
+}
+
+func parseOpenGraph(byt []byte) (*OpenGraph, error) {
+	doc, err := html.Parse(bytes.NewReader(byt))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse page as HTML err=%w", err)
+	}
+
+	og := &OpenGraph{}
+	var f func(*html.Node)
+	f = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "meta" {
+			content := strings.TrimSpace(getAttr(n, "content"))
+			switch getAttr(n, "property") {
+			case "og:title":
+				og.Title = content
+			case "og:description":
+				og.Description = content
+			case "og:image":
+				og.Image = content
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c)
+		}
+	}
+	f(doc)
+
+	return og, nil
+}
+
+// HTML renders a preview card linking to the given url.
+func (og *OpenGraph) HTML(link string) string {
+	if og.Title == "" && og.Description == "" && og.Image == "" {
+		return ""
+	}
+
+	l := html.EscapeString(link)
+	var b strings.Builder
+	b.WriteString(`<div class="preview">`)
+	if og.Image != "" {
+		fmt.Fprintf(&b, `<a href="%s"><img src="%s" style="max-width: 100%%"></a>`, l, html.EscapeString(og.Image))
+	}
+	if og.Title != "" {
+		fmt.Fprintf(&b, `<h3><a href="%s">%s</a></h3>`, l, html.EscapeString(og.Title))
+	}
+	if og.Description != "" {
+		fmt.Fprintf(&b, `<p>%s</p>`, html.EscapeString(og.Description))
+	}
+	b.WriteString(`</div>`)
+	return b.String()
+}
+
+// contentFetches returns the semaphore shared by all requests for entry
+// contents, separate from feed downloads.
+func (cfg *Config) contentFetches() chan struct{} {
+	cfg.fetchesOnce.Do(func() {
+		n := cfg.MaxContentFetches
+		if n <= 0 {
+			n = defaultContentFetchConcurrency
+		}
+		cfg.fetches = make(chan struct{}, n)
+	})
+	return cfg.fetches
+}
+
+// addOpenGraphPreviews fetches the linked page of entries without content
+// and uses its OpenGraph metadata as the entry's content.
+func addOpenGraphPreviews(cfg *Config, fs []*Feed) {
+	var wg sync.WaitGroup
+	sem := cfg.contentFetches()
+
+	for _, f := range fs {
+		for _, e := range f.Entries {
+			if e.Link == "" || strings.TrimSpace(string(e.Content)) != "" {
+				continue
+			}
+
+			wg.Add(1)
+			go func(e *FeedEntry) {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+
+				ctx, cancel := context.WithTimeout(context.Background(), cfg.requestTimeout(openGraphTimeout))
+				defer cancel()
+
+				byt, _, err := getContext(ctx, cfg, nil, e.Link)
+				if err != nil {
+					log.Printf("ignoring failure to fetch open graph data err=%v", err)
+					return
+				}
+
+				og, err := parseOpenGraph(byt)
+				if err != nil {
+					log.Printf("ignoring failure to parse open graph data for url=%s err=%v", e.Link, err)
+					return
+				}
+
+				e.Content = template.HTML(og.HTML(e.Link))
+			}(e)
+		}
+	}
+
+	wg.Wait()
+}
+
+func getAttr(n *html.Node, name string) string {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func subscribe(w io.Writer, cfg *Config, fu string, strict, asJSON bool) {
+	log.Printf("downloading feed %#v\n", fu)
+	byt, canonical, err := getCanonical(cfg, nil, fu)
+	if err != nil {
+		log.Fatalf("failed get feed err=%s", err)
+	}
+	if canonical != fu {
+		log.Printf("feed %#v moved permanently to %#v", fu, canonical)
+		fu = canonical
+	}
+
+	fc := &ConfigFeed{}
+
+	uf, err := unmarshal(byt)
+	if err == nil {
+		fc.Name = uf.Title
+		fc.URL = fu
+	} else {
+		log.Printf("could not unmarshal as RSS, Atom or JSON Feed err=%v", err)
+		log.Printf("checking for alternate link")
+		fc.Name, fc.URL = findFeedInfo(byt)
+		if fc.Name == "" || fc.URL == "" {
+			log.Fatalf("failed to find both required title and url")
+		}
+
+		u, err := url.Parse(fc.URL)
+		if err != nil {
+			log.Fatalf("failed to parse feed href=%s as valid url", fc.URL)
+		}
+
+		if !u.IsAbs() {
+			base, err := url.Parse(fu)
+			if err != nil {
+				log.Fatalf("failed to parse feed url err=%s", err)
+			}
+			fc.URL = base.ResolveReference(u).String()
+		}
+
+		byt, err = get(cfg, nil, fc.URL)
+		if err == nil {
+			uf, err = unmarshal(byt)
+		}
+		if err != nil {
+			log.Printf("could not download feed to check for recent entries err=%v", err)
+		}
+	}
+
+	if uf != nil {
+		err = checkStale(uf, cfg.StaleFeedAge, strict)
+		if err != nil {
+			log.Fatalf("refusing to subscribe err=%s", err)
+		}
+	}
+
+	added, _, err := addFeeds(cfg, []*ConfigFeed{fc})
+	if err != nil {
+		log.Fatalf("failed to subscribe err=%s", err)
+	}
+
+	if added == 0 {
+		log.Printf("feed URL already present in existing feeds, no need to subscribe")
+	} else {
+		log.Printf("successfully subscribed to feed title=%#v url=%#v", fc.Name, fc.URL)
+	}
+
+	if asJSON && added > 0 {
+		err = json.NewEncoder(w).Encode(fc)
+		if err != nil {
+			log.Fatalf("failed to print feed err=%s", err)
+		}
+	}
+}
+
+const defaultStaleFeedAge = 180 * 24 * time.Hour
+
+// checkStale warns when the newest entry of the given feed is older than
+// maxAge, as the feed might be abandoned. When strict is set, it returns an
+// error instead.
+func checkStale(f *Feed, maxAge time.Duration, strict bool) error {
+	var newest time.Time
+	for _, e := range f.Entries {
+		if e.Updated.After(newest) {
+			newest = e.Updated
+		}
+	}
+
+	var msg string
+	switch {
+	case newest.IsZero():
+		msg = fmt.Sprintf("feed %#v has no dated entries", f.Title)
+	case now().Sub(newest) > maxAge:
+		msg = fmt.Sprintf("feed %#v might be abandoned, its newest entry is from %s", f.Title, newest.Format("2006-01-02"))
+	default:
+		return nil
+	}
+
+	if strict {
+		return errors.New(msg)
+	}
+	log.Printf("warning: %s", msg)
+	return nil
+}
+
+// addFeeds appends the given feeds to the subscribe file, skipping feeds whose
+// url is already present in any of the feeds files.
+func addFeeds(cfg *Config, fcs []*ConfigFeed) (added, skipped int, err error) {
+	fps, err := cfg.feedsFiles()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to find feeds config files err=%w", err)
+	}
+
+	ef, err := readFeedsConfigs(fps)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read feeds config err=%w", err)
+	}
+	log.Printf("read feeds config: %v feeds.", len(ef))
+
+	present := map[string]bool{}
+	for _, f := range ef {
+		present[strings.ToLower(f.URL)] = true
+	}
+
+	sf, err := cfg.subscribeFile()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to find feeds config file to subscribe to err=%w", err)
+	}
+
+	nf, err := readFeedsConfig(sf)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read feeds config err=%w", err)
+	}
+
+	for _, fc := range fcs {
+		u := strings.ToLower(fc.URL)
+		if present[u] {
+			skipped += 1
+			continue
+		}
+		present[u] = true
+		nf = append(nf, fc)
+		added += 1
+	}
+
+	if added == 0 {
+		return added, skipped, nil
+	}
+
+	bt, err := yaml.Marshal(nf)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to marshal feeds err=%w", err)
+	}
+
+	err = os.WriteFile(sf, bt, 0o677)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to write feeds config file err=%w", err)
+	}
+
+	err = recordFeedsEdit(cfg, sf)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return added, skipped, nil
+}
+
+type OPML struct {
+	XMLName  xml.Name      `xml:"opml"`
+	Outlines []OPMLOutline `xml:"body>outline"`
+}
+
+type OPMLOutline struct {
+	Text     string        `xml:"text,attr"`
+	Title    string        `xml:"title,attr"`
+	XMLURL   string        `xml:"xmlUrl,attr"`
+	Outlines []OPMLOutline `xml:"outline"`
+}
+
+// feeds flattens the outline and its nested outlines into feed configs.
+func (o *OPMLOutline) feeds() []*ConfigFeed {
+	result := []*ConfigFeed{}
+	if u := strings.TrimSpace(o.XMLURL); u != "" {
+		name := strings.TrimSpace(o.Title)
+		if name == "" {
+			name = strings.TrimSpace(o.Text)
+		}
+		result = append(result, &ConfigFeed{Name: name, URL: u})
+	}
+	for _, c := range o.Outlines {
+		result = append(result, c.feeds()...)
+	}
+	return result
+}
+
+func readOPML(fn string) ([]*ConfigFeed, error) {
+	bt, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read opml file %#v err=%w", fn, err)
+	}
+
+	var doc OPML
+	decoder := xml.NewDecoder(bytes.NewReader(bt))
+	decoder.CharsetReader = charset.NewReaderLabel
+	err = decoder.Decode(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse opml file %#v err=%w", fn, err)
+	}
+
+	result := []*ConfigFeed{}
+	for _, o := range doc.Outlines {
+		result = append(result, o.feeds()...)
+	}
+	return result, nil
+}
+
+// explain downloads the feed at the given url and prints how it's parsed,
+// including the raw date strings of entries and any issues found.
+func explain(w io.Writer, cfg *Config, url string) error {
+	byt, err := get(cfg, nil, url)
+	if err != nil {
+		return err
+	}
+
+	f, err := unmarshal(byt)
+	if err != nil {
+		return fmt.Errorf("failed to parse feed err=%w", err)
+	}
+
+	fmt.Fprintf(w, "url:     %s\n", url)
+	fmt.Fprintf(w, "format:  %s\n", f.format)
+	fmt.Fprintf(w, "title:   %s\n", f.Title)
+	fmt.Fprintf(w, "id:      %s\n", f.ID)
+	fmt.Fprintf(w, "link:    %s\n", f.Link)
+	fmt.Fprintf(w, "updated: %s\n", explainTime(f.Updated))
+	fmt.Fprintf(w, "entries: %v\n", len(f.Entries))
+
+	warnings := f.warnings
+	ids := map[string]bool{}
+	for i, e := range f.Entries {
+		fmt.Fprintf(w, "\n%v. %s\n", i+1, e.Title)
+		fmt.Fprintf(w, "   id:      %s\n", e.ID)
+		fmt.Fprintf(w, "   link:    %s\n", e.Link)
+		fmt.Fprintf(w, "   updated: %s (from %#v)\n", explainTime(e.Updated), e.rawUpdated)
+
+		switch {
+		case e.ID == "":
+			warnings = append(warnings, fmt.Sprintf("entry %v %#v has no id", i+1, e.Title))
+		case ids[e.ID]:
+			warnings = append(warnings, fmt.Sprintf("entry %v %#v has duplicate id %#v", i+1, e.Title, e.ID))
+		}
+		ids[e.ID] = true
+		if e.Link == "" {
+			warnings = append(warnings, fmt.Sprintf("entry %v %#v has no link", i+1, e.Title))
+		}
+		if e.Updated.IsZero() {
+			warnings = append(warnings, fmt.Sprintf("entry %v %#v has no date", i+1, e.Title))
+		} else if e.Updated.After(now().Add(futureDateSkew)) {
+			warnings = append(warnings, fmt.Sprintf("entry %v %#v is dated in the future", i+1, e.Title))
+		}
+	}
+
+	if len(warnings) > 0 {
+		fmt.Fprintf(w, "\nwarnings:\n")
+		for _, m := range warnings {
+			fmt.Fprintf(w, "- %s\n", m)
+		}
+	}
+
+	return nil
+}
+
+func explainTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func importOPML(cfg *Config, fn string) error {
+	fcs, err := readOPML(fn)
+	if err != nil {
+		return err
+	}
+
+	added, skipped, err := addFeeds(cfg, fcs)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("imported %v feeds, skipped %v duplicates", added, skipped)
+	return nil
+}
+
+func feed(cfg *Config, flg *FeederFlags) error {
+	var err error
+	var fs []*ConfigFeed
+	var ts map[string]time.Time
+	var succs, fails, nd []*Feed
+	var et, tt string
+
+	st, err := readState(cfg.stateFile())
+	if err != nil {
+		return err
+	}
+
+	// entries selected via -since are sent again, so it doesn't update the
+	// state, like the timestamps.
+	saveState := func() error {
+		if flg.Since > 0 {
+			return nil
+		}
+		return writeState(cfg.stateFile(), st)
+	}
+
+	if cfg.MinSendInterval > 0 && now().Sub(st.LastSend) < cfg.MinSendInterval {
+		log.Printf("last email was sent at %v, deferring until %v", FormatTime(st.LastSend), FormatTime(st.LastSend.Add(cfg.MinSendInterval)))
+		return nil
+	}
+
+	var lastRun time.Time
+	if flg.SinceLastRun {
+		lastRun, err = lastRunTime(cfg.TimestampFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	ts, err = readTimestamps(cfg.TimestampFile)
+	if err != nil {
+		return err
+	}
+	log.Printf("read timestamps from %#v\n", cfg.TimestampFile)
+
+	et, err = readEmailTemplate(cfg.EmailTemplateFile)
+	if err != nil {
+		return err
+	}
+
+	tt, err = readTextEmailTemplate(cfg.TextTemplateFile)
+	if err != nil {
+		return err
+	}
+
+	fps, err := cfg.feedsFiles()
+	if err != nil {
+		return err
+	}
+
+	fs, err = readFeedsConfigs(fps)
+	if err != nil {
+		return err
+	}
+	log.Printf("read feeds config: %v feeds.", len(fs))
+
+	if cfg.ConfigChangeWarning != "" {
+		err = warnChangedFiles(cfg, st)
+		if err != nil {
+			return err
+		}
+	}
+
+	if flg.Only != "" {
+		fs, err = onlyFeeds(fs, flg.Only)
+		if err != nil {
+			return err
+		}
+		log.Printf("processing only %v feeds.", len(fs))
+	}
+
+	cfg.resetCookieJar()
+	succs, fails = downloadFeeds(cfg, fs)
+	log.Printf("downloaded %v feeds successfully, %v failures\n", len(succs), len(fails))
+
+	if cfg.CookieFile != "" && cfg.jar != nil {
+		err = writeCookies(cfg.CookieFile, cfg.jar)
+		if err != nil {
+			return err
+		}
+		log.Printf("wrote cookies to %#v\n", cfg.CookieFile)
+	}
+
+	markSharedLinks(succs)
+
+	if cfg.ClampFutureDates {
+		st.clampFutureDates(succs, now())
+	}
+
+	err = trackFailures(cfg, st, succs, fails)
+	if err != nil {
+		return err
+	}
+
+	trackFormats(st, succs)
+
+	filterEntries(succs)
+
+	if cfg.DedupByTitle {
+		dedupByTitle(succs)
+	}
+
+	if cfg.DedupSimilarity > 0 {
+		dedupBySimilarity(succs, cfg.DedupSimilarity)
+	}
+
+	// -since is for seeing entries again, so the filters that drop entries
+	// that were sent before don't apply.
+	if flg.Since == 0 {
+		if cfg.DedupWindowRuns > 0 {
+			st.dedupWindow(succs, cfg.DedupWindowRuns)
+		}
+
+		if cfg.DedupByID {
+			st.dropSent(succs)
+		}
+
+		if cfg.SkipUnchangedContent {
+			st.dropUnchanged(succs)
+		}
+	}
+
+	bs := ts
+	if flg.SinceLastRun {
+		log.Printf("using timestamps file modification time %v for all feeds", FormatTime(lastRun))
+		bs = uniformTimestamps(succs, lastRun)
+	}
+
+	if flg.Since > 0 {
+		since := now().Add(-flg.Since)
+		log.Printf("selecting entries since %v for all feeds", FormatTime(since))
+		bs = uniformTimestamps(succs, since)
+	}
+
+	nd = pickNewData(succs, cfg.MaxEntriesPerFeed, bs)
+
+	var deduped []*Feed
+	if cfg.GlobalDedup {
+		nd, deduped = globalDedup(nd, fs)
+	}
+	for _, f := range nd {
+		st.feed(f.conf.URL).NewEntries = len(f.Entries)
+	}
+
+	if flg.Stats != "" {
+		err = writeStats(flg.Stats, fs, succs, fails, nd)
+		if err != nil {
+			return err
+		}
+		log.Printf("wrote stats to %#v\n", flg.Stats)
+	}
+
+	var failErr error
+	if cfg.ExitNonzeroOnFailures && len(fails) > 0 {
+		failErr = fmt.Errorf("%v of %v feeds failed: %w", len(fails), len(succs)+len(fails), ErrFeedFailures)
+	}
+
+	if !cfg.isSendDay(now()) {
+		st.spool(nd)
+		log.Printf("spooled %v new entries until the next send day", countEntries(nd))
+		err = saveState()
+		if err != nil {
+			return err
+		}
+		return failErr
+	}
+	nd = st.unspool(nd, append(append([]*Feed{}, succs...), fails...))
+
+	err = saveState()
+	if err != nil {
+		return err
+	}
+
+	if countEntries(nd) == 0 && len(fails) == 0 {
+		log.Printf("found no new entries")
+		return nil
+	}
+	log.Printf("found %v new entries\n", countEntries(nd))
+
+	if cfg.FetchOpenGraph {
+		addOpenGraphPreviews(cfg, nd)
+	}
+
+	if cfg.DetectLanguage {
+		detectLanguages(nd)
+	}
+
+	runContentPipeline(cfg, nd)
+
+	var sentFeeds []*Feed
+	sent := func(fs []*Feed) {
+		sentFeeds = append(sentFeeds, fs...)
+		updateTimestamps(ts, fs)
+		for _, f := range fs {
+			delete(st.Spool, f.conf.URL)
+		}
+		if cfg.DedupWindowRuns > 0 {
+			st.markSent(fs)
+		}
+		if cfg.DedupByID {
+			st.recordSent(fs)
+		}
+		if cfg.SkipUnchangedContent {
+			st.recordContentHashes(fs)
+		}
+		st.LastSend = now()
+		// feeds that only had entries of other feeds advance with the first
+		// sent email.
+		updateTimestamps(ts, deduped)
+		deduped = nil
+	}
+
+	var sendErr error
+	if cfg.OutputFile != "" {
+		emailBody, err := makeEmailBody(cfg, nd, fails, et)
+		if err != nil {
+			return err
+		}
+
+		err = writeOutput(cfg.OutputFile, emailBody)
+		if err != nil {
+			return err
+		}
+		log.Printf("wrote email body to %#v\n", cfg.OutputFile)
+		sent(nd)
+	} else {
+		for _, r := range groupByRecipient(cfg, nd, fails) {
+			if countEntries(r.Successes) == 0 && len(r.Failures) == 0 {
+				continue
+			}
+
+			emailBody, err := makeEmailBody(cfg, r.Successes, r.Failures, et)
+			if err != nil {
+				return err
+			}
+
+			textBody, err := makeTextEmailBody(cfg, r.Successes, r.Failures, tt)
+			if err != nil {
+				return err
+			}
+
+			subject, err := renderSubject(cfg.SubjectTemplate, r.Successes, r.Failures, now())
+			if err != nil {
+				return err
+			}
+
+			err = sendEmailWithRetries(cfg, &message{To: r.To, Subject: subject, Body: emailBody, Text: textBody})
+			if err != nil {
+				log.Printf("failed to send email to %#v err=%v", r.To, err)
+				sendErr = err
+				continue
+			}
+			log.Printf("sent email to %#v\n", r.To)
+			sent(r.Successes)
+		}
+	}
+
+	if cfg.ArchiveFile != "" && countEntries(sentFeeds) > 0 {
+		err = archiveEntries(cfg.ArchiveFile, sentFeeds)
+		if err != nil {
+			return err
+		}
+		log.Printf("archived sent entries to %#v\n", cfg.ArchiveFile)
+	}
+
+	err = saveState()
+	if err != nil {
+		return err
+	}
+
+	if flg.Since > 0 {
+		log.Printf("not updating state and timestamps as entries were selected via -since")
+	} else {
+		err = writeTimestamps(cfg.TimestampFile, ts)
+		if err != nil {
+			return err
+		}
+		log.Printf("wrote updated timestamps to %#v\n", cfg.TimestampFile)
+	}
+
+	if sendErr != nil {
+		return sendErr
+	}
+
+	return failErr
+}
+
+// onlyFeeds selects the feeds with the given comma separated names or urls.
+func onlyFeeds(fs []*ConfigFeed, only string) ([]*ConfigFeed, error) {
+	selected := map[*ConfigFeed]bool{}
+	for _, n := range strings.Split(only, ",") {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+
+		found := false
+		for _, fc := range fs {
+			if strings.EqualFold(fc.Name, n) || strings.EqualFold(fc.URL, n) {
+				selected[fc] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("found no feed with name or url %#v", n)
+		}
+	}
+
+	result := []*ConfigFeed{}
+	for _, fc := range fs {
+		if selected[fc] {
+			result = append(result, fc)
+		}
+	}
+	return result, nil
+}
+
+// FeedStats summarizes a feed's download and new entries for -stats.
+type FeedStats struct {
+	Name            string `json:"name"`
+	URL             string `json:"url"`
+	Success         bool   `json:"success"`
+	Error           string `json:"error,omitempty"`
+	NewEntries      int    `json:"new_entries"`
+	FetchDurationMS int64  `json:"fetch_duration_ms"`
+}
+
+// writeStats writes the stats of the downloaded feeds as JSON to the given
+// file, in the order they are configured.
+func writeStats(fn string, cs []*ConfigFeed, succs, fails, nd []*Feed) error {
+	byConf := map[*ConfigFeed]*FeedStats{}
+	for _, f := range append(append([]*Feed{}, succs...), fails...) {
+		s := &FeedStats{
+			Name:            f.conf.Name,
+			URL:             f.conf.URL,
+			Success:         f.Failure == nil,
+			FetchDurationMS: f.FetchDuration.Milliseconds(),
+		}
+		if s.Name == "" {
+			s.Name = f.Title
+		}
+		if f.Failure != nil {
+			s.Error = f.Failure.Error()
+		}
+		byConf[f.conf] = s
+	}
+	for _, f := range nd {
+		if s, ok := byConf[f.conf]; ok {
+			s.NewEntries = len(f.Entries)
+		}
+	}
+
+	stats := []*FeedStats{}
+	for _, fc := range cs {
+		if s, ok := byConf[fc]; ok {
+			stats = append(stats, s)
+		}
+	}
+
+	byt, err := json.MarshalIndent(struct {
+		Time  time.Time    `json:"time"`
+		Feeds []*FeedStats `json:"feeds"`
+	}{now(), stats}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(fn, append(byt, '\n'), 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write stats file %#v err=%w", fn, err)
+	}
+
+	return nil
+}
+
+// writeOutput writes the email body to the given file, or stdout for "-".
+func writeOutput(fn string, body string) error {
+	if fn == "-" {
+		_, err := fmt.Fprint(os.Stdout, body)
+		return err
+	}
+
+	err := os.WriteFile(fn, []byte(body), 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write output file %#v err=%w", fn, err)
+	}
+
+	return nil
+}
+
+// ErrFeedFailures is returned by feed when exit-nonzero-on-failures is set
+// and feeds failed to download, after the email was sent.
+var ErrFeedFailures = errors.New("feeds failed")
+
+// exitFeedFailures is the exit status for runs that return ErrFeedFailures.
+const exitFeedFailures = 2
+
+// recipient holds the feeds to be sent to a single To address.
+type recipient struct {
+	To        string
+	Successes []*Feed
+	Failures  []*Feed
+}
+
+// groupByRecipient batches feeds by their configured To address, falling back
+// to the email's from address. Recipients are ordered by their first feed.
+func groupByRecipient(cfg *Config, succs, fails []*Feed) []*recipient {
+	result := []*recipient{}
+	byTo := map[string]*recipient{}
+	lookup := func(f *Feed) *recipient {
+		to := cfg.Email.From
+		if f.conf != nil && strings.TrimSpace(f.conf.To) != "" {
+			to = strings.TrimSpace(f.conf.To)
+		}
+		r, ok := byTo[to]
+		if !ok {
+			r = &recipient{To: to}
+			byTo[to] = r
+			result = append(result, r)
+		}
+		return r
+	}
+
+	for _, f := range succs {
+		r := lookup(f)
+		r.Successes = append(r.Successes, f)
+	}
+	for _, f := range fails {
+		r := lookup(f)
+		r.Failures = append(r.Failures, f)
+	}
+
+	return result
+}
+
+func splitAddresses(to string) []string {
+	result := []string{}
+	for _, a := range strings.Split(to, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			result = append(result, a)
+		}
+	}
+	return result
+}
+
+// contentTransform modifies the contents of the entries of the given feeds.
+type contentTransform func(cfg *Config, fs []*Feed)
+
+var contentTransforms = map[string]contentTransform{
+	"sanitize": func(cfg *Config, fs []*Feed) {
+		tags, attrs := cfg.htmlAllowlist()
+		sanitizeFeeds(fs, tags, attrs)
+	},
+	"resolve-relative-urls": func(cfg *Config, fs []*Feed) {
+		resolveRelativeURLs(fs, cfg.ReplaceRelativeURLs || len(cfg.ContentPipeline) > 0)
+	},
+	"upgrade-insecure-images": func(cfg *Config, fs []*Feed) {
+		upgradeInsecureImages(fs, cfg.UpgradeInsecureImages == "always")
+	},
+	"strip-tracking-params": func(cfg *Config, fs []*Feed) {
+		stripTrackingParams(fs, cfg.trackingParams())
+	},
+	"style-code": func(cfg *Config, fs []*Feed) {
+		styleCodeBlocks(fs)
+	},
+	"old-reddit": func(cfg *Config, fs []*Feed) {
+		useOldReddit(fs)
+	},
+	"truncate": func(cfg *Config, fs []*Feed) {
+		truncateContents(fs, cfg.MaxContentChars)
+	},
+}
+
+// contentPipeline returns the names of the transforms to run in order. Unless
+// configured explicitly, it runs the transforms that are enabled by their
+// respective options.
+func (cfg *Config) contentPipeline() []string {
+	if len(cfg.ContentPipeline) > 0 {
+		return cfg.ContentPipeline
+	}
+
+	ps := []string{}
+	if cfg.SanitizeHTML {
+		ps = append(ps, "sanitize")
+	}
+	ps = append(ps, "resolve-relative-urls")
+	if cfg.UpgradeInsecureImages != "" {
+		ps = append(ps, "upgrade-insecure-images")
+	}
+	if cfg.StripTrackingParams {
+		ps = append(ps, "strip-tracking-params")
+	}
+	if cfg.StyleCodeBlocks {
+		ps = append(ps, "style-code")
+	}
+	if cfg.Reddit.UseOldReddit {
+		ps = append(ps, "old-reddit")
+	}
+	ps = append(ps, "truncate")
+	return ps
+}
+
+func runContentPipeline(cfg *Config, fs []*Feed) {
+	for _, n := range cfg.contentPipeline() {
+		contentTransforms[n](cfg, fs)
+	}
+}
+
+func resolveRelativeURLs(fs []*Feed, global bool) {
+	for _, f := range fs {
+		if !f.conf.replaceRelativeURLs(global) {
+			continue
+		}
+
+		bu, err := url.Parse(f.Link)
+		if err != nil {
+			log.Printf("ignoring url parse error when trying to replace relative urls err=%v", err)
+			continue
+		}
+		for _, e := range f.Entries {
+			nc, err := absolutifyHTML(string(e.Content), bu)
+			if err != nil {
+				log.Printf("ignoring error from replacing relative url err=%v", err)
+				continue
+			}
+			e.Content = template.HTML(nc)
+		}
+	}
+}
+
+// oldRedditURL rewrites links to reddit to use old.reddit.com.
+func oldRedditURL(u string) string {
+	pu, err := url.Parse(strings.TrimSpace(u))
+	if err != nil {
+		return u
+	}
+
+	switch strings.ToLower(pu.Hostname()) {
+	case "reddit.com", "www.reddit.com", "new.reddit.com", "np.reddit.com":
+		pu.Host = "old.reddit.com"
+		return pu.String()
+	}
+	return u
+}
+
+func oldRedditHTML(in string) (string, error) {
+	body := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	node, err := html.ParseFragment(strings.NewReader(in), body)
+	if err != nil {
+		return in, fmt.Errorf("failed to parse as HTML err=%w", err)
+	}
+
+	var visit func(n *html.Node)
 	visit = func(n *html.Node) {
-		if n.Type == html.ElementNode {
-			switch strings.ToLower(n.Data) {
-			case "img":
-				for i, a := range n.Attr {
-					if strings.ToLower(a.Key) == "src" {
-						nval, err := absolutify(a.Val)
-						if err != nil {
-							log.Printf("ignoring url parse error: %s", err)
-							continue
-						}
-						n.Attr[i].Val = nval
-					}
+		if n.Type == html.ElementNode && strings.ToLower(n.Data) == "a" {
+			for i, a := range n.Attr {
+				if strings.ToLower(a.Key) == "href" {
+					n.Attr[i].Val = oldRedditURL(a.Val)
 				}
-			case "a":
-				for i, a := range n.Attr {
-					if strings.ToLower(a.Key) == "href" {
-						nval, err := absolutify(a.Val)
-						if err != nil {
-							log.Printf("ignoring url parse error: %s", err)
-							continue
-						}
-						n.Attr[i].Val = nval
-					}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			visit(c)
+		}
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(in)))
+	for _, n := range node {
+		visit(n)
+		err := html.Render(buf, n)
+		if err != nil {
+			return in, fmt.Errorf("failed to render back to html err=%w", err)
+		}
+	}
+
+	return buf.String(), nil
+}
+
+func useOldReddit(fs []*Feed) {
+	for _, f := range fs {
+		for _, e := range f.Entries {
+			e.Link = oldRedditURL(e.Link)
+			nc, err := oldRedditHTML(string(e.Content))
+			if err != nil {
+				log.Printf("ignoring error from rewriting reddit links err=%v", err)
+				continue
+			}
+			e.Content = template.HTML(nc)
+		}
+	}
+}
+
+// truncateHTML cuts the text of the given HTML after limit characters and
+// drops all following nodes. It reports whether anything was cut.
+func truncateHTML(in string, limit int) (string, bool, error) {
+	body := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	node, err := html.ParseFragment(strings.NewReader(in), body)
+	if err != nil {
+		return in, false, fmt.Errorf("failed to parse as HTML err=%w", err)
+	}
+	for _, n := range node {
+		body.AppendChild(n)
+	}
+
+	remaining := limit
+	var visit func(n *html.Node) bool
+	visit = func(n *html.Node) bool {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			cut := false
+			if c.Type == html.TextNode {
+				rs := []rune(c.Data)
+				if len(rs) > remaining {
+					c.Data = strings.TrimRightFunc(string(rs[:remaining]), unicode.IsSpace) + "…"
+					cut = true
+				}
+				remaining -= len(rs)
+			} else {
+				cut = visit(c)
+			}
+
+			if cut {
+				for c.NextSibling != nil {
+					n.RemoveChild(c.NextSibling)
 				}
+				return true
+			}
+		}
+		return false
+	}
+
+	if !visit(body) {
+		return in, false, nil
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(in)))
+	for c := body.FirstChild; c != nil; c = c.NextSibling {
+		err := html.Render(buf, c)
+		if err != nil {
+			return in, false, fmt.Errorf("failed to render back to html err=%w", err)
+		}
+	}
+
+	return buf.String(), true, nil
+}
+
+// truncateContents shortens entry contents to their feed's limit and links to
+// the entry to read the rest.
+func truncateContents(fs []*Feed, global int) {
+	for _, f := range fs {
+		limit := f.conf.maxContentChars(global)
+		if limit <= 0 {
+			continue
+		}
+
+		for _, e := range f.Entries {
+			nc, cut, err := truncateHTML(string(e.Content), limit)
+			if err != nil {
+				log.Printf("ignoring error from truncating content err=%v", err)
+				continue
+			}
+			if cut {
+				nc += fmt.Sprintf(`<p><a href="%s">Read more</a></p>`, html.EscapeString(e.Link))
+			}
+			e.Content = template.HTML(nc)
+		}
+	}
+}
+
+// codeStyles are the inline styles for code, as email clients often ignore
+// style sheets.
+var codeStyles = map[string]string{
+	"pre":      "font-family: Menlo, Consolas, monospace; font-size: 0.85em; white-space: pre-wrap; background: #f4f4f4; border: 1px solid #acb0bf; border-radius: 3px; padding: 0.8em; overflow-x: auto;",
+	"pre code": "font-family: Menlo, Consolas, monospace;",
+	"code":     "font-family: Menlo, Consolas, monospace; font-size: 0.85em; background: #f4f4f4; border-radius: 3px; padding: 0 0.2em;",
+}
+
+func styleCodeBlocks(fs []*Feed) {
+	for _, f := range fs {
+		for _, e := range f.Entries {
+			nc, err := styleCodeHTML(string(e.Content))
+			if err != nil {
+				log.Printf("ignoring error from styling code blocks err=%v", err)
+				continue
 			}
+			e.Content = template.HTML(nc)
+		}
+	}
+}
+
+// styleCodeHTML adds monospace inline styles to pre and code elements. The
+// styles are appended to existing ones, so they take precedence.
+func styleCodeHTML(in string) (string, error) {
+	return transformHTML(in, func(n *html.Node) {
+		if n.Type != html.ElementNode {
+			return
+		}
+
+		name := strings.ToLower(n.Data)
+		key := name
+		if name == "code" && insidePre(n) {
+			key = "pre code"
+		}
+		if st, ok := codeStyles[key]; ok {
+			addStyle(n, st)
+		}
+	})
+}
+
+// insidePre checks whether the given node is nested in a pre element.
+func insidePre(n *html.Node) bool {
+	for p := n.Parent; p != nil; p = p.Parent {
+		if p.Type == html.ElementNode && strings.ToLower(p.Data) == "pre" {
+			return true
 		}
+	}
+	return false
+}
 
-		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			visit(c)
+func addStyle(n *html.Node, style string) {
+	for i, a := range n.Attr {
+		if strings.ToLower(a.Key) == "style" {
+			existing := strings.TrimSpace(a.Val)
+			if existing != "" && !strings.HasSuffix(existing, ";") {
+				existing += ";"
+			}
+			n.Attr[i].Val = strings.TrimSpace(existing + " " + style)
+			return
 		}
 	}
+	n.Attr = append(n.Attr, html.Attribute{Key: "style", Val: style})
+}
 
-	result := ""
-	for _, n := range node {
-		visit(n)
-		buf := bytes.NewBuffer(make([]byte, 0, len(in)))
-		err := html.Render(buf, n)
+func upgradeInsecureImages(fs []*Feed, always bool) {
+	for _, f := range fs {
+		bu, err := url.Parse(f.Link)
 		if err != nil {
-			return in, fmt.Errorf("failed to render back to html err=%#v", err)
+			log.Printf("ignoring url parse error when trying to upgrade image urls err=%v", err)
+			continue
+		}
+		for _, e := range f.Entries {
+			nc, err := upgradeImagesHTML(string(e.Content), bu, always)
+			if err != nil {
+				log.Printf("ignoring error from upgrading image urls err=%v", err)
+				continue
+			}
+			e.Content = template.HTML(nc)
 		}
-		result += buf.String()
-		result += " "
 	}
+}
 
-	return result, nil
+// defaultTrackingParams are the query parameters removed by
+// strip-tracking-params, in addition to the configured tracking-params.
+var defaultTrackingParams = []string{"utm_*", "fbclid", "gclid"}
+
+func (cfg *Config) trackingParams() []string {
+	return append(append([]string{}, defaultTrackingParams...), cfg.TrackingParams...)
 }
 
-func countEntries(fs []*Feed) int {
-	c := 0
+func stripTrackingParams(fs []*Feed, patterns []string) {
 	for _, f := range fs {
-		c += len(f.Entries)
+		for _, e := range f.Entries {
+			e.Link = stripQueryParams(e.Link, patterns)
+			nc, err := stripTrackingParamsHTML(string(e.Content), patterns)
+			if err != nil {
+				log.Printf("ignoring error from stripping tracking params err=%v", err)
+				continue
+			}
+			e.Content = template.HTML(nc)
+		}
 	}
-	return c
 }
 
-func getRedditBearerToken(cfg ConfigReddit) (string, error) {
-	req, err := http.NewRequest(
-		http.MethodPost,
-		"https://www.reddit.com/api/v1/access_token",
-		strings.NewReader(`grant_type=client_credentials`),
-	)
-	if err != nil {
-		return "", fmt.Errorf("failed to create request for reddit bearer token err=%w", err)
+// stripQueryParams removes the query parameters whose name matches one of
+// the given patterns from u. The remaining parameters are kept as they are, in
+// their original order.
+func stripQueryParams(u string, patterns []string) string {
+	rest, frag, hasFrag := strings.Cut(u, "#")
+	base, query, ok := strings.Cut(rest, "?")
+	if !ok {
+		return u
 	}
 
-	creds := fmt.Sprintf("%s:%s", cfg.ClientID, cfg.ClientSecret)
-	auth := base64.URLEncoding.EncodeToString([]byte(creds))
-	req.Header.Add("Authorization", fmt.Sprintf("Basic %s", auth))
-	req.Header.Add("User-Agent", UserAgent)
-
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+	ps := strings.Split(query, "&")
+	kept := []string{}
+	for _, p := range ps {
+		name, _, _ := strings.Cut(p, "=")
+		if un, err := url.QueryUnescape(name); err == nil {
+			name = un
+		}
+		if !matchesParam(name, patterns) {
+			kept = append(kept, p)
+		}
 	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to request reddit bearer token err=%w", err)
+	if len(kept) == len(ps) {
+		return u
 	}
 
-	var tok struct {
-		AccessToken string `json:"access_token"`
+	result := base
+	if len(kept) > 0 {
+		result += "?" + strings.Join(kept, "&")
 	}
-	err = json.NewDecoder(resp.Body).Decode(&tok)
-	if err != nil {
-		return "", fmt.Errorf("failed to decode reddit response err=%w", err)
+	if hasFrag {
+		result += "#" + frag
 	}
-
-	log.Printf("successfully requested reddit bearer token")
-
-	return tok.AccessToken, nil
+	return result
 }
 
-func get(cfg *Config, url string) ([]byte, error) {
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+func matchesParam(name string, patterns []string) bool {
+	name = strings.ToLower(name)
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), name); ok {
+			return true
+		}
 	}
+	return false
+}
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request for url=%s err=%w", url, err)
-	}
+func stripTrackingParamsHTML(in string, patterns []string) (string, error) {
+	return transformHTML(in, func(n *html.Node) {
+		if n.Type != html.ElementNode || strings.ToLower(n.Data) != "a" {
+			return
+		}
 
-	if cfg.Reddit.bearerToken != "" && rxReddit.MatchString(url) {
-		req.Header.Add("Authorization", fmt.Sprintf("bearer %s", cfg.Reddit.bearerToken))
-	}
+		for i, a := range n.Attr {
+			if strings.ToLower(a.Key) == "href" {
+				n.Attr[i].Val = stripQueryParams(a.Val, patterns)
+			}
+		}
+	})
+}
 
-	req.Header.Add("User-Agent", UserAgent)
+// sampleFeeds returns feeds to render templates with, including a failure.
+func sampleFeeds() ([]*Feed, []*Feed) {
+	t := now().Truncate(time.Hour)
+	succs := []*Feed{
+		{
+			Title:    "Sample Blog",
+			Subtitle: "Thoughts on sample data",
+			ID:       "https://blog.example.com/feed",
+			Link:     "https://blog.example.com",
+			Updated:  t,
+			Entries: []*FeedEntry{
+				{
+					Title:        "Sample Entry One",
+					Link:         "https://blog.example.com/one",
+					ID:           "https://blog.example.com/one",
+					Updated:      t.Add(-26 * time.Hour),
+					Content:      "<p>The first sample entry with a <a href=\"https://example.com\">link</a>.</p>",
+					Author:       "Jane Doe",
+					CommentCount: 3,
+				},
+				{
+					Title:   "Sample Entry Two",
+					Link:    "https://blog.example.com/two",
+					ID:      "https://blog.example.com/two",
+					Updated: t.Add(-2 * time.Hour),
+					Content: "<p>The second sample entry.</p><ul><li>with</li><li>a list</li></ul>",
+					Author:  "John Doe",
+				},
+			},
+		},
+		{
+			Title:   "Sample Videos",
+			ID:      "https://videos.example.com/feed",
+			Link:    "https://videos.example.com",
+			Updated: t,
+			Entries: []*FeedEntry{
+				{
+					Title:     "Sample Video",
+					Link:      "https://videos.example.com/watch",
+					ID:        "https://videos.example.com/watch",
+					Updated:   t.Add(-time.Hour),
+					Thumbnail: "https://videos.example.com/thumbnail.jpg",
+					Content:   "<p>A sample video description.</p>",
+				},
+			},
+		},
+	}
+	fails := []*Feed{
+		{
+			Title:   "Sample Broken Feed",
+			Link:    "https://broken.example.com/feed",
+			Failure: fmt.Errorf("failed to request url=https://broken.example.com/feed err=connection refused"),
+		},
+	}
+	return succs, fails
+}
 
-	resp, err := client.Do(req)
+// renderTemplate renders the given email template with sample data, to
+// iterate on templates without downloading feeds or sending emails.
+func renderTemplate(w io.Writer, fn string) error {
+	et, err := readEmailTemplate(fn)
 	if err != nil {
-		return nil, fmt.Errorf("failed to request url=%s err=%w", url, err)
+		return err
 	}
 
-	byt, err := io.ReadAll(resp.Body)
+	succs, fails := sampleFeeds()
+	body, err := makeEmailBody(&Config{}, succs, fails, et)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read body contents for url=%s err=%w", url, err)
+		return err
 	}
-	defer resp.Body.Close()
 
-	return byt, nil
+	_, err = fmt.Fprint(w, body)
+	return err
 }
 
-func findFeedInfo(byt []byte) (feedTitle, link string) {
-	doc, err := html.Parse(bytes.NewReader(byt))
+func printStatus(w io.Writer, cfg *Config) error {
+	st, err := readState(cfg.stateFile())
 	if err != nil {
-		log.Fatalf("failed to parse feed as HTML err=%s", err)
+		return err
 	}
 
-	var f func(*html.Node)
-	f = func(n *html.Node) {
-		if feedTitle == "" && n.Type == html.ElementNode && n.Data == "title" && n.FirstChild != nil {
-			feedTitle = strings.TrimSpace(n.FirstChild.Data)
-			log.Printf("found title: %#v", feedTitle)
-		}
-		if n.Type == html.ElementNode && n.Data == "link" {
-			href := getAttr(n, "href")
-			title := getAttr(n, "title")
-			typ := getAttr(n, "type")
-			rel := getAttr(n, "rel")
-			if rel == "alternate" && (typ == "application/rss+xml" || typ == "application/atom+xml") {
-				log.Printf("found alternate title=%s type=%s href=%s", title, typ, href)
-				link = href
-				if feedTitle == "" {
-					feedTitle = strings.TrimSpace(title)
-				}
-			}
-		}
-		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			f(c)
-		}
+	fs := st.Feeds
+	if fs == nil {
+		fs = map[string]*FeedStatus{}
 	}
-	f(doc)
 
-	return
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		LastSend time.Time              `json:"last_send"`
+		Feeds    map[string]*FeedStatus `json:"feeds"`
+	}{st.LastSend, fs})
 }
 
-func getAttr(n *html.Node, name string) string {
-	for _, a := range n.Attr {
-		if a.Key == name {
-			return a.Val
-		}
+func printVersion(w io.Writer, asJSON bool) error {
+	if asJSON {
+		return json.NewEncoder(w).Encode(struct {
+			Version string `json:"version"`
+		}{AppVersion})
 	}
-	return ""
+
+	v := fmt.Sprintf("feeder %s", AppVersion)
+	_, err := fmt.Fprintln(w, v)
+	return err
 }
 
-func subscribe(cfg *Config, fu string) {
-	log.Printf("downloading feed %#v\n", fu)
-	byt, err := get(cfg, fu)
-	if err != nil {
-		log.Fatalf("failed get feed err=%s", err)
+func printBuildInfo(w io.Writer, asJSON bool) error {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return fmt.Errorf("failed to read build info")
 	}
 
-	fc := &ConfigFeed{}
+	if asJSON {
+		return json.NewEncoder(w).Encode(bi)
+	}
 
-	uf, err := unmarshal(byt)
-	if err == nil {
-		fc.Name = uf.Title
-		fc.URL = fu
-	} else {
-		log.Printf("could not unmarshal as RSS or Atom err=%v", err)
-		log.Printf("checking for alternate link")
-		fc.Name, fc.URL = findFeedInfo(byt)
-		if fc.Name == "" || fc.URL == "" {
-			log.Fatalf("failed to find both required title and url")
-		}
+	_, err := fmt.Fprintf(w, "%+v\n", bi)
+	return err
+}
 
-		u, err := url.Parse(fc.URL)
-		if err != nil {
-			log.Fatalf("failed to parse feed href=%s as valid url", fc.URL)
-		}
+func main() {
+	var err error
+	var flg *FeederFlags
+	var cfg *Config
 
-		if !u.IsAbs() {
-			base, err := url.Parse(fu)
-			if err != nil {
-				log.Fatalf("failed to parse feed url err=%s", err)
-			}
-			fc.URL = base.ResolveReference(u).String()
-		}
-	}
+	flg, err = readFlags()
+	failOnErr(cfg, err)
 
-	ef, err := readFeedsConfig(cfg.FeedsFile)
-	if err != nil {
-		log.Fatalf("failed to read feeds config err=%s", err)
+	if flg.Version {
+		err = printVersion(os.Stdout, flg.JSON)
+		failOnErr(cfg, err)
+		return
 	}
-	log.Printf("read feeds config: %v feeds.", len(ef))
 
-	for _, f := range ef {
-		if strings.ToLower(f.URL) == strings.ToLower(fc.URL) {
-			log.Printf("feed URL already present in existing feeds, no need to subscribe")
-			os.Exit(0)
-		}
+	if flg.BuildInfo {
+		err = printBuildInfo(os.Stdout, flg.JSON)
+		failOnErr(cfg, err)
+		return
 	}
-	nf := append(ef, fc)
 
-	var bt []byte
-	bt, err = yaml.Marshal(nf)
-	if err != nil {
-		log.Fatalf("failed to marshal feeds err=%s", err)
+	if flg.Render != "" {
+		err = renderTemplate(os.Stdout, flg.Render)
+		failOnErr(cfg, err)
+		return
 	}
 
-	err = os.WriteFile(cfg.FeedsFile, bt, 0o677)
-	if err != nil {
-		log.Fatalf("failed to write timestamps file err=%s", err)
+	if flg.Explain != "" {
+		err = explain(os.Stdout, &Config{timeout: flg.Timeout}, flg.Explain)
+		failOnErr(cfg, err)
+		return
 	}
 
-	log.Printf("successfully subscribed to feed title=%#v url=%#v", fc.Name, fc.URL)
-}
-
-func feed(cfg *Config) {
-	var err error
-	var fs []*ConfigFeed
-	var ts map[string]time.Time
-	var succs, fails, nd []*Feed
-	var et string
-
-	ts, err = readTimestamps(cfg.TimestampFile)
+	cfg, err = readConfig(flg.Config, flg.Strict)
 	failOnErr(cfg, err)
-	log.Printf("read timestamps from %#v\n", cfg.TimestampFile)
+	log.Printf("read config\n")
+	cfg.timeout = flg.Timeout
+	if flg.Output != "" {
+		cfg.OutputFile = flg.Output
+	}
 
-	et, err = readEmailTemplate(cfg.EmailTemplateFile)
-	failOnErr(cfg, err)
+	if cfg.LogFile != "" {
+		lf, err := openRotatingFile(cfg.LogFile, cfg.LogFileMaxSize, cfg.LogFileKeep)
+		failOnErr(cfg, err)
+		defer lf.Close()
+		log.SetOutput(io.MultiWriter(os.Stderr, lf))
+	}
 
-	fs, err = readFeedsConfig(cfg.FeedsFile)
-	failOnErr(cfg, err)
-	log.Printf("read feeds config: %v feeds.", len(fs))
+	if flg.Subscribe != "" {
+		subscribe(os.Stdout, cfg, flg.Subscribe, flg.Strict, flg.JSON)
+		return
+	}
 
-	succs, fails = downloadFeeds(cfg, fs)
-	log.Printf("downloaded %v feeds successfully, %v failures\n", len(succs), len(fails))
+	if flg.ImportOPML != "" {
+		err = importOPML(cfg, flg.ImportOPML)
+		failOnErr(cfg, err)
+		return
+	}
 
-	nd = pickNewData(succs, cfg.MaxEntriesPerFeed, ts)
-	if len(nd) == 0 && len(fails) == 0 {
-		log.Printf("found no new entries")
+	if flg.Status {
+		err = printStatus(os.Stdout, cfg)
+		failOnErr(cfg, err)
 		return
 	}
-	log.Printf("found %v new entries\n", countEntries(nd))
 
-	if cfg.ReplaceRelativeURLs {
-		resolveRelativeURLs(nd)
+	if flg.Loop > 0 {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		loop(cfg, flg, stop, func(err error) { reportFailure(cfg, err) })
+		return
 	}
 
-	emailBody, err := makeEmailBody(nd, fails, et)
+	err = feed(cfg, flg)
+	if errors.Is(err, ErrFeedFailures) {
+		log.Print(err)
+		os.Exit(exitFeedFailures)
+	}
 	failOnErr(cfg, err)
+}
 
-	err = sendEmail(cfg.Email, emailBody)
-	failOnErr(cfg, err)
-	log.Printf("sent email\n")
+// defaultLogFileMaxSize is the size in bytes after which the log file is
+// rotated unless log-file-max-size is set.
+const defaultLogFileMaxSize = 1 << 20
+
+// rotatingFile appends to the file at path and rotates it once it would grow
+// beyond maxSize bytes, keeping up to keep rotated files suffixed .1 (the
+// most recent) to .<keep>.
+type rotatingFile struct {
+	sync.Mutex
+	path    string
+	maxSize int64
+	keep    int
+
+	f    *os.File
+	size int64
+}
 
-	updateTimestamps(ts, nd)
-	err = writeTimestamps(cfg.TimestampFile, ts)
-	failOnErr(cfg, err)
-	log.Printf("wrote updated timestamps to %#v\n", cfg.TimestampFile)
+func openRotatingFile(path string, maxSize int64, keep int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, keep: keep}
+	return rf, rf.open()
 }
 
-func resolveRelativeURLs(fs []*Feed) {
-	for _, f := range fs {
-		bu, err := url.Parse(f.Link)
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file %#v err=%w", rf.path, err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat log file %#v err=%w", rf.path, err)
+	}
+
+	rf.f, rf.size = f, fi.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.Lock()
+	defer rf.Unlock()
+
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		err := rf.rotate()
 		if err != nil {
-			log.Printf("ignoring url parse error when trying to replace relative urls err=%v", err)
-			continue
-		}
-		for _, e := range f.Entries {
-			nc, err := absolutifyHTML(string(e.Content), bu)
-			if err != nil {
-				log.Printf("ignoring error from replacing relative url err=%v", err)
-				continue
-			}
-			e.Content = template.HTML(nc)
+			return 0, err
 		}
 	}
-}
 
-func printVersion() {
-	v := fmt.Sprintf("feeder %s", AppVersion)
-	fmt.Println(v)
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
 }
 
-func printBuildInfo() {
-	bi, ok := debug.ReadBuildInfo()
-	if ok {
-		fmt.Printf("%+v\n", bi)
+func (rf *rotatingFile) rotate() error {
+	err := rf.f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close log file %#v err=%w", rf.path, err)
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.keep))
+	for i := rf.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+
+	if rf.keep > 0 {
+		err = os.Rename(rf.path, rf.path+".1")
 	} else {
-		fmt.Println("failed to read build info")
+		err = os.Remove(rf.path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to rotate log file %#v err=%w", rf.path, err)
 	}
-}
 
-func main() {
-	var err error
-	var flg *FeederFlags
-	var cfg *Config
+	return rf.open()
+}
 
-	flg, err = readFlags()
-	failOnErr(cfg, err)
+func (rf *rotatingFile) Close() error {
+	rf.Lock()
+	defer rf.Unlock()
+	return rf.f.Close()
+}
 
-	if flg.Version {
-		printVersion()
-		return
-	}
+// loop runs feed every flg.Loop until stop receives a signal. Failed runs are
+// passed to onErr rather than ending the loop.
+func loop(cfg *Config, flg *FeederFlags, stop <-chan os.Signal, onErr func(error)) {
+	ticker := time.NewTicker(flg.Loop)
+	defer ticker.Stop()
 
-	if flg.BuildInfo {
-		printBuildInfo()
-		return
-	}
+	for {
+		err := feed(cfg, flg)
+		if errors.Is(err, ErrFeedFailures) {
+			log.Print(err)
+		} else if err != nil {
+			log.Printf("run failed err=%v", err)
+			onErr(err)
+		}
 
-	cfg, err = readConfig(flg.Config)
-	failOnErr(cfg, err)
-	log.Printf("read config\n")
+		// check for a pending signal first, select picks randomly if the
+		// ticker fired during the run as well.
+		select {
+		case sig := <-stop:
+			log.Printf("received %v, stopping", sig)
+			return
+		default:
+		}
 
-	if flg.Subscribe != "" {
-		subscribe(cfg, flg.Subscribe)
-		return
+		log.Printf("next run in %v", flg.Loop)
+		select {
+		case sig := <-stop:
+			log.Printf("received %v, stopping", sig)
+			return
+		case <-ticker.C:
+		}
 	}
-
-	feed(cfg)
 }
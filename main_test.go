@@ -1,12 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
 )
 
 func TestUnmarshal_RDF(t *testing.T) {
@@ -17,6 +33,7 @@ func TestUnmarshal_RDF(t *testing.T) {
 	require.Nil(t, err)
 
 	require.Equal(t, "Slashdot", f.Title)
+	require.Equal(t, "News for nerds, stuff that matters", f.Subtitle)
 	require.Equal(t, "https://slashdot.org/", f.Link)
 	require.Len(t, f.Entries, 15)
 	require.Equal(t, time.Date(2022, 7, 28, 10, 52, 17, 0, time.UTC).Unix(), f.Updated.Unix())
@@ -26,6 +43,173 @@ func TestUnmarshal_RDF(t *testing.T) {
 	require.Equal(t, "https://yro.slashdot.org/story/22/07/27/2124200/charter-told-to-pay-73-billion-in-damages-after-cable-installer-murders-grandmother?utm_source=rss1.0mainlinkanon&utm_medium=feed", fst.Link)
 	require.Equal(t, "https://yro.slashdot.org/story/22/07/27/2124200/charter-told-to-pay-73-billion-in-damages-after-cable-installer-murders-grandmother?utm_source=rss1.0mainlinkanon&utm_medium=feed", fst.ID)
 	require.Equal(t, time.Date(2022, 7, 28, 10, 0, 0, 0, time.UTC).Unix(), fst.Updated.Unix())
+	require.Equal(t, 8, fst.CommentCount)
+}
+
+func TestWordPressComments(t *testing.T) {
+	byt, err := os.ReadFile("test-data/wordpress.rss")
+	require.Nil(t, err)
+
+	f, err := unmarshal(byt)
+	require.Nil(t, err)
+	require.Len(t, f.Entries, 2)
+
+	fst := f.Entries[0]
+	require.Equal(t, 7, fst.CommentCount)
+	require.Equal(t, "https://blog.example.com/2022/08/04/hello-again/feed/", fst.CommentsFeed)
+
+	snd := f.Entries[1]
+	require.Equal(t, 0, snd.CommentCount)
+	require.Equal(t, "", snd.CommentsFeed)
+
+	body, err := makeEmailBody(&Config{}, []*Feed{f}, nil, `{{ range .Successes }}{{ range .Entries }}{{ .CommentCount }} {{ .CommentsFeed }};{{ end }}{{ end }}`)
+	require.Nil(t, err)
+	require.Equal(t, "7 https://blog.example.com/2022/08/04/hello-again/feed/;0 ;", body)
+}
+
+func TestRSSDublinCore(t *testing.T) {
+	byt, err := os.ReadFile("test-data/dublin-core.rss")
+	require.Nil(t, err)
+
+	f, err := unmarshal(byt)
+	require.Nil(t, err)
+	require.Len(t, f.Entries, 2)
+	require.Len(t, f.warnings, 1)
+	require.Contains(t, f.warnings[0], "Undated")
+
+	fst := f.Entries[0]
+	require.Equal(t, "Only dc:date", fst.Title)
+	require.Equal(t, time.Date(2022, 8, 4, 6, 12, 45, 0, time.UTC).Unix(), fst.Updated.Unix())
+	require.Equal(t, "2022-08-04T08:12:45+02:00", fst.rawUpdated)
+	require.Equal(t, "Jane Doe", fst.Author)
+
+	snd := f.Entries[1]
+	require.Equal(t, time.Date(2022, 8, 2, 10, 0, 0, 0, time.UTC).Unix(), snd.Updated.Unix())
+	require.Equal(t, "John Doe", snd.Author)
+
+	body, err := makeEmailBody(&Config{}, []*Feed{f}, nil, `{{ range .Successes }}{{ range .Entries }}{{ .Author }};{{ end }}{{ end }}`)
+	require.Nil(t, err)
+	require.Equal(t, "Jane Doe;John Doe;", body)
+}
+
+func TestEntryAuthors(t *testing.T) {
+	rss := `<?xml version="1.0"?><rss version="2.0" xmlns:dc="http://purl.org/dc/elements/1.1/"><channel><title>RSS</title><link>https://example.com/</link>
+<item><title>Email and name</title><author>jane@example.com (Jane Doe)</author><pubDate>Mon, 01 Aug 2022 10:00:00 +0000</pubDate></item>
+<item><title>Email only</title><author> john@example.com </author><pubDate>Mon, 01 Aug 2022 10:00:00 +0000</pubDate></item>
+<item><title>Creator wins</title><author>jane@example.com (Jane Doe)</author><dc:creator>J. Doe</dc:creator><pubDate>Mon, 01 Aug 2022 10:00:00 +0000</pubDate></item>
+<item><title>Anonymous</title><pubDate>Mon, 01 Aug 2022 10:00:00 +0000</pubDate></item>
+</channel></rss>`
+	f, err := unmarshal([]byte(rss))
+	require.Nil(t, err)
+	authors := []string{}
+	for _, e := range f.Entries {
+		authors = append(authors, e.Author)
+	}
+	require.Equal(t, []string{"Jane Doe", "john@example.com", "J. Doe", ""}, authors)
+
+	rdf := `<?xml version="1.0"?><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#" xmlns="http://purl.org/rss/1.0/" xmlns:dc="http://purl.org/dc/elements/1.1/">
+<channel rdf:about="https://example.com/"><title>RDF</title><link>https://example.com/</link></channel>
+<item rdf:about="https://example.com/1"><title>One</title><link>https://example.com/1</link><dc:creator>Ada Lovelace</dc:creator><dc:date>2022-08-01T10:00:00Z</dc:date></item>
+</rdf:RDF>`
+	f, err = unmarshal([]byte(rdf))
+	require.Nil(t, err)
+	require.Equal(t, "Ada Lovelace", f.Entries[0].Author)
+
+	byt, err := os.ReadFile("test-data/wordpress.rss")
+	require.Nil(t, err)
+	f, err = unmarshal(byt)
+	require.Nil(t, err)
+	require.Equal(t, "Jane Doe", f.Entries[0].Author)
+
+	fs := []*Feed{{Title: "Feed", Entries: []*FeedEntry{{Title: "With", Author: "Jane Doe"}, {Title: "Without"}}}}
+	body, err := makeEmailBody(&Config{}, fs, nil, defaultEmailTemplate)
+	require.Nil(t, err)
+	require.Equal(t, 1, strings.Count(body, ">by "))
+	require.Contains(t, body, `<span style="font-size:0.75rem;margin-left:1rem;">by Jane Doe</span>`)
+
+	text, err := makeTextEmailBody(&Config{}, fs, nil, defaultTextEmailTemplate)
+	require.Nil(t, err)
+	require.Contains(t, text, ", by Jane Doe)")
+	require.Equal(t, 1, strings.Count(text, "by "))
+}
+
+// panickyFeed panics while being decoded or converted, like a decoder
+// tripping over malformed input.
+type panickyFeed struct {
+	Entries []*FeedEntry
+}
+
+func (p *panickyFeed) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	panic("unexpected element " + start.Name.Local)
+}
+
+func (p *panickyFeed) UnmarshalJSON(byt []byte) error {
+	panic("unexpected json")
+}
+
+func (p *panickyFeed) Feed() (*Feed, error) {
+	return &Feed{Link: p.Entries[0].Link}, nil
+}
+
+func TestUnmarshalRecoversFromPanics(t *testing.T) {
+	err := decodeXML([]byte(`<feed><entry/></feed>`), &panickyFeed{})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "panic while decoding xml")
+	require.Contains(t, err.Error(), "unexpected element feed")
+
+	err = decodeJSON([]byte(`{"items": []}`), &panickyFeed{})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "panic while decoding json")
+
+	f, err := convertFeed(&panickyFeed{}, "atom")
+	require.Nil(t, f)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "panic while converting atom feed")
+	require.Contains(t, err.Error(), "index out of range")
+
+	f, err = unmarshal([]byte(testRSS))
+	require.Nil(t, err)
+	require.Equal(t, "rss", f.format)
+}
+
+func TestRSSDoubleEscapedContent(t *testing.T) {
+	byt, err := os.ReadFile("test-data/double-escaped.rss")
+	require.Nil(t, err)
+
+	f, err := unmarshal(byt)
+	require.Nil(t, err)
+	require.Len(t, f.Entries, 4)
+	require.Equal(t, template.HTML("<p>Tom &amp; Jerry <b>return</b>.</p>"), f.Entries[0].Content)
+	require.Equal(t, template.HTML("<p>Escaped twice.</p>"), f.Entries[1].Content)
+	require.Equal(t, template.HTML("<p>Use &lt;div&gt; for blocks.</p>"), f.Entries[2].Content)
+	require.Equal(t, template.HTML("1 &lt; 2 and &lt;b&gt; is bold"), f.Entries[3].Content)
+}
+
+func TestRSSContentEncoded(t *testing.T) {
+	byt, err := os.ReadFile("test-data/content-encoded.rss")
+	require.Nil(t, err)
+
+	f, err := unmarshal(byt)
+	require.Nil(t, err)
+	require.Len(t, f.Entries, 3)
+	require.Equal(t, template.HTML("<p>The full text of the post.</p><p>With a second paragraph.</p>"), f.Entries[0].Content)
+	require.Equal(t, template.HTML("<p>Only a description.</p>"), f.Entries[1].Content)
+	require.Equal(t, template.HTML("<p>The description.</p>"), f.Entries[2].Content)
+
+	byt, err = os.ReadFile("test-data/wordpress.rss")
+	require.Nil(t, err)
+	f, err = unmarshal(byt)
+	require.Nil(t, err)
+	require.Contains(t, string(f.Entries[0].Content), "The full text of the post")
+	require.NotContains(t, string(f.Entries[0].Content), "A short summary")
+
+	rdf := `<?xml version="1.0"?><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#" xmlns="http://purl.org/rss/1.0/" xmlns:content="http://purl.org/rss/1.0/modules/content/">
+<channel rdf:about="https://example.com/"><title>RDF</title><link>https://example.com/</link></channel>
+<item rdf:about="https://example.com/1"><title>One</title><link>https://example.com/1</link><description>Summary</description><content:encoded>&lt;p&gt;Full&lt;/p&gt;</content:encoded></item>
+</rdf:RDF>`
+	f, err = unmarshal([]byte(rdf))
+	require.Nil(t, err)
+	require.Equal(t, template.HTML("<p>Full</p>"), f.Entries[0].Content)
 }
 
 func TestTakeOnRules(t *testing.T) {
@@ -46,6 +230,7 @@ func TestGarrit(t *testing.T) {
 	require.Nil(t, err)
 
 	require.Equal(t, "https://garrit.xyz", f.Link)
+	require.Equal(t, "Garrit Franke", f.Subtitle)
 }
 
 func TestReddit(t *testing.T) {
@@ -55,11 +240,13 @@ func TestReddit(t *testing.T) {
 	feed, err := unmarshal(byt)
 	require.Nil(t, err)
 	require.Equal(t, "programming", feed.Title)
+	require.Equal(t, "Computer Programming", feed.Subtitle)
 	require.Equal(t, "https://www.reddit.com/r/programming/", feed.Link)
 	require.Len(t, feed.Entries, 25)
 
 	first := feed.Entries[0]
 	require.Equal(t, first.Title, "Dark Mode Coming to GitHub After 7 Years")
+	require.Equal(t, "/u/rxsel", first.Author)
 }
 
 func TestYouTube(t *testing.T) {
@@ -74,9 +261,168 @@ func TestYouTube(t *testing.T) {
 
 	first := feed.Entries[0]
 	require.Equal(t, "26\" bandsaw sawdust drawer and bottom enclosure", first.Title)
+	require.Equal(t, "https://i2.ytimg.com/vi/9eRIUV94kgQ/hqdefault.jpg", first.Thumbnail)
 	require.Equal(t, "<div>Working on finishing up my 26\" bandsaw.  In this eposode, making the bottom enclosure and the sawdust drawer.  This directs nearly all the sawdust into the drawer, making for passive dust collection.\n\n\nhttp://woodgears.ca/big_bandsaw/bottom_enclosure.html</div><div><a href=\"https://www.youtube.com/v/9eRIUV94kgQ?version=3\"><img src=\"https://i2.ytimg.com/vi/9eRIUV94kgQ/hqdefault.jpg\" width=\"480\" height=\"360\" /></a></div>", string(first.Content))
 }
 
+func TestYouTubeLayout(t *testing.T) {
+	byt, err := os.ReadFile("test-data/wandel.xml")
+	require.Nil(t, err)
+
+	f, err := unmarshal(byt)
+	require.Nil(t, err)
+	require.Equal(t, "video", f.Layout())
+	require.Equal(t, int64(93851), f.Entries[0].Views)
+	require.Equal(t, 4.96, f.Entries[0].Rating)
+
+	f.Entries = f.Entries[:1]
+	body, err := makeEmailBody(&Config{}, []*Feed{f}, nil, defaultEmailTemplate)
+	require.Nil(t, err)
+	require.Contains(t, body, `<div class="video">`)
+	require.Contains(t, body, `<a href="https://www.youtube.com/watch?v=9eRIUV94kgQ"><img src="https://i2.ytimg.com/vi/9eRIUV94kgQ/hqdefault.jpg" style="max-width: 100%;" /></a>`)
+	require.Contains(t, body, "93851 views &middot; rated 5.0")
+	require.NotContains(t, body, "sawdust into the drawer")
+
+	f.conf = &ConfigFeed{Layout: "entry"}
+	body, err = makeEmailBody(&Config{}, []*Feed{f}, nil, defaultEmailTemplate)
+	require.Nil(t, err)
+	require.NotContains(t, body, `<div class="video">`)
+	require.Contains(t, body, "sawdust into the drawer")
+}
+
+func TestJSONFeed(t *testing.T) {
+	byt, err := os.ReadFile("test-data/jsonfeed.json")
+	require.Nil(t, err)
+
+	f, err := unmarshal(byt)
+	require.Nil(t, err)
+	require.Equal(t, "Example Notes", f.Title)
+	require.Equal(t, "Short notes on things.", f.Subtitle)
+	require.Equal(t, "https://notes.example.com/feed.json", f.ID)
+	require.Equal(t, "https://notes.example.com/", f.Link)
+	require.Len(t, f.Entries, 2)
+
+	first := f.Entries[0]
+	require.Equal(t, "An HTML note", first.Title)
+	require.Equal(t, "https://notes.example.com/2022/08/02/html", first.Link)
+	require.Equal(t, template.HTML("<p>Hello, <em>world</em>.</p>"), first.Content)
+	require.Equal(t, "https://notes.example.com/images/hello.png", first.Thumbnail)
+	require.Equal(t, time.Date(2022, 8, 2, 10, 30, 0, 0, time.UTC).Unix(), first.Updated.Unix())
+	require.Equal(t, "Jane Doe", first.Author)
+
+	second := f.Entries[1]
+	require.Equal(t, "2", second.ID)
+	require.Equal(t, template.HTML("<pre>Plain text with &lt;brackets&gt; &amp; ampersands.</pre>"), second.Content)
+	require.Equal(t, time.Date(2022, 8, 1, 8, 0, 0, 0, time.UTC).Unix(), second.Updated.Unix())
+	require.Equal(t, "John Doe", second.Author)
+}
+
+func TestHumanSize(t *testing.T) {
+	require.Equal(t, "", humanSize(0))
+	require.Equal(t, "512 B", humanSize(512))
+	require.Equal(t, "1.5 kB", humanSize(1500))
+	require.Equal(t, "12.3 MB", humanSize(12345678))
+	require.Equal(t, "4.2 GB", humanSize(4200000000))
+	require.Equal(t, "4200.0 GB", humanSize(4200000000000))
+}
+
+func TestMediaKind(t *testing.T) {
+	require.Equal(t, "audio", mediaKind("audio/mpeg"))
+	require.Equal(t, "video", mediaKind("Video/MP4"))
+	require.Equal(t, "image", mediaKind("image/png"))
+	require.Equal(t, "file", mediaKind("application/pdf"))
+	require.Equal(t, "file", mediaKind(""))
+}
+
+func TestAtomEnclosure(t *testing.T) {
+	byt, err := os.ReadFile("test-data/enclosure.atom")
+	require.Nil(t, err)
+
+	f, err := unmarshal(byt)
+	require.Nil(t, err)
+	require.Len(t, f.Entries, 1)
+	require.Equal(t, "https://podcast.example.com/episode-2", f.Entries[0].Link)
+	require.Equal(t, []Enclosure{{URL: "https://podcast.example.com/episode-2.mp3", Length: 12345678, Type: "audio/mpeg"}}, f.Entries[0].Enclosures)
+
+	body, err := makeEmailBody(&Config{}, []*Feed{f}, nil, defaultEmailTemplate)
+	require.Nil(t, err)
+	require.Contains(t, body, `<a href="https://podcast.example.com/episode-2.mp3" style="text-decoration: none; color: RoyalBlue;">&#127911; Download audio</a> <span style="color: #6a6e7c;">(12.3 MB)</span>`)
+}
+
+func TestPodcastEnclosures(t *testing.T) {
+	byt, err := os.ReadFile("test-data/podcast.rss")
+	require.Nil(t, err)
+
+	f, err := unmarshal(byt)
+	require.Nil(t, err)
+	require.Len(t, f.Entries, 2)
+	require.Equal(t, []Enclosure{{URL: "https://cdn.example.com/episode-1.mp3", Length: 48234120, Type: "audio/mpeg"}}, f.Entries[0].Enclosures)
+	require.Equal(t, []Enclosure{
+		{URL: "https://cdn.example.com/episode-2.mp4", Type: "video/mp4"},
+		{URL: "https://cdn.example.com/episode-2.jpg", Length: 1024, Type: "image/jpeg"},
+	}, f.Entries[1].Enclosures)
+
+	body, err := makeEmailBody(&Config{}, []*Feed{f}, nil, defaultEmailTemplate)
+	require.Nil(t, err)
+	require.Contains(t, body, `<a href="https://cdn.example.com/episode-1.mp3" style="text-decoration: none; color: RoyalBlue;">&#127911; Download audio</a> <span style="color: #6a6e7c;">(48.2 MB)</span>`)
+	require.Contains(t, body, `<a href="https://cdn.example.com/episode-2.mp4" style="text-decoration: none; color: RoyalBlue;">&#127916; Download video</a></p>`)
+	require.NotContains(t, body, "episode-2.jpg")
+
+	tmpl := `{{ range .Successes }}{{ range .Entries }}{{ range .Enclosures }}{{ .URL }} {{ .Type }} {{ humanSize .Length }};{{ end }}{{ end }}{{ end }}`
+	body, err = makeEmailBody(&Config{}, []*Feed{f}, nil, tmpl)
+	require.Nil(t, err)
+	require.Equal(t, "https://cdn.example.com/episode-1.mp3 audio/mpeg 48.2 MB;https://cdn.example.com/episode-2.mp4 video/mp4 ;https://cdn.example.com/episode-2.jpg image/jpeg 1.0 kB;", body)
+}
+
+func TestITunesPodcast(t *testing.T) {
+	byt, err := os.ReadFile("test-data/itunes.rss")
+	require.Nil(t, err)
+
+	f, err := unmarshal(byt)
+	require.Nil(t, err)
+	require.Len(t, f.Entries, 3)
+	require.Equal(t, &PodcastMeta{Duration: time.Hour + 2*time.Minute + 3*time.Second, Season: 2, Episode: 12, Image: "https://show.example.com/episodes/12.jpg"}, f.Entries[0].Podcast)
+	require.Equal(t, &PodcastMeta{Duration: 45*time.Minute + 30*time.Second, Episode: 13}, f.Entries[1].Podcast)
+	require.Equal(t, &PodcastMeta{Duration: 4*time.Minute + 5*time.Second}, f.Entries[2].Podcast)
+	require.Equal(t, "1:02:03", f.Entries[0].Podcast.FormatDuration())
+	require.Equal(t, "45:30", f.Entries[1].Podcast.FormatDuration())
+
+	body, err := makeEmailBody(&Config{}, []*Feed{f}, nil, defaultEmailTemplate)
+	require.Nil(t, err)
+	require.Contains(t, body, ">Season 2, Episode 12 &middot; 1:02:03</p>")
+	require.Contains(t, body, ">Episode 13 &middot; 45:30</p>")
+	require.Contains(t, body, ">4:05</p>")
+
+	tmpl := `{{ range .Successes }}{{ range .Entries }}{{ with .Podcast }}{{ .Episode }} {{ .FormatDuration }};{{ end }}{{ end }}{{ end }}`
+	body, err = makeEmailBody(&Config{}, []*Feed{f}, nil, tmpl)
+	require.Nil(t, err)
+	require.Equal(t, "12 1:02:03;13 45:30;0 4:05;", body)
+
+	byt, err = os.ReadFile("test-data/podcast.rss")
+	require.Nil(t, err)
+	f, err = unmarshal(byt)
+	require.Nil(t, err)
+	require.Nil(t, f.Entries[0].Podcast)
+
+	for _, raw := range []string{"", "abc", "1:2:3:4", "-5", "1:-1"} {
+		_, ok := parseITunesDuration(raw)
+		require.False(t, ok, raw)
+	}
+}
+
+func TestAtomSummaryFallback(t *testing.T) {
+	byt, err := os.ReadFile("test-data/summary-only.atom")
+	require.Nil(t, err)
+
+	f, err := unmarshal(byt)
+	require.Nil(t, err)
+	require.Len(t, f.Entries, 4)
+	require.Equal(t, template.HTML("<p>Just the summary.</p>"), f.Entries[0].Content)
+	require.Equal(t, template.HTML("<p>The full content.</p>"), f.Entries[1].Content)
+	require.Equal(t, template.HTML("<div>The media description.</div>"), f.Entries[2].Content)
+	require.Equal(t, template.HTML("The summary instead."), f.Entries[3].Content)
+}
+
 func TestNotUtf8(t *testing.T) {
 	byt, err := os.ReadFile("test-data/not-utf8.rss")
 	require.Nil(t, err)
@@ -85,6 +431,61 @@ func TestNotUtf8(t *testing.T) {
 	require.Nil(t, err)
 }
 
+func TestForcedCharset(t *testing.T) {
+	byt := []byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n" +
+		"<rss version=\"2.0\"><channel><title>Caf\xe9</title><link>https://example.com</link>" +
+		"<item><title>cr\xe8me br\xfbl\xe9e</title><pubDate>Mon, 01 Aug 2022 08:00:00 +0000</pubDate></item></channel></rss>")
+
+	_, err := unmarshal(byt)
+	require.NotNil(t, err)
+
+	fixed, err := forceCharset(byt, "windows-1252")
+	require.Nil(t, err)
+	f, err := unmarshal(fixed)
+	require.Nil(t, err)
+	require.Equal(t, "Café", f.Title)
+	require.Equal(t, "crème brûlée", f.Entries[0].Title)
+
+	_, err = forceCharset(byt, "no-such-charset")
+	require.NotNil(t, err)
+}
+
+func TestEmptyFeed(t *testing.T) {
+	_, err := unmarshal([]byte(" \n"))
+	require.ErrorIs(t, err, ErrEmptyFeed)
+	_, err = unmarshal([]byte(`<?xml version="1.0"?><rss version=`))
+	require.ErrorIs(t, err, ErrEmptyFeed)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(srv.Close)
+	fcs := []*ConfigFeed{{Name: "empty", URL: srv.URL}}
+
+	succs, fails := downloadFeeds(&Config{}, fcs)
+	require.Len(t, succs, 1)
+	require.Empty(t, succs[0].Entries)
+	require.Empty(t, fails)
+
+	succs, fails = downloadFeeds(&Config{EmptyFeedIsFailure: true}, fcs)
+	require.Empty(t, succs)
+	require.Len(t, fails, 1)
+	require.ErrorIs(t, fails[0].Failure, ErrEmptyFeed)
+}
+
+func TestDetectLanguage(t *testing.T) {
+	fs := []*Feed{{Entries: []*FeedEntry{
+		{Title: "Release notes", Content: "<p>This is the first release of the tool and it comes with a number of fixes for the parser.</p>"},
+		{Title: "Neue Version", Content: "<p>Das ist die erste Version des Programms und sie <b>ist</b> nicht mit der alten kompatibel, weil sich die Formate geändert haben.</p>"},
+		{Title: "Sample", Content: "<p>42</p>"},
+		{Title: "Declared", Content: "<p>This is in English but declared otherwise.</p>", Language: "fr"},
+	}}}
+	detectLanguages(fs)
+
+	require.Equal(t, "en", fs[0].Entries[0].Language)
+	require.Equal(t, "de", fs[0].Entries[1].Language)
+	require.Equal(t, "", fs[0].Entries[2].Language)
+	require.Equal(t, "fr", fs[0].Entries[3].Language)
+}
+
 func TestParseDateNoTime(t *testing.T) {
 	byt, err := os.ReadFile("test-data/date-no-time.rss")
 	require.Nil(t, err)
@@ -150,118 +551,522 @@ func TestSubstituteRelativeAHref(t *testing.T) {
 	require.NotContains(t, string(res), orig, "relative url should not be present anymore")
 }
 
-func TestFileExists(t *testing.T) {
-	exists := "readme.md"
-	doesNotExist := "does-not-exist"
-	require.True(t, fileExists(exists))
-	require.False(t, fileExists(doesNotExist))
+func TestSubstituteRelativeFallback(t *testing.T) {
+	in := `<p class="broken><img src="/img/a.jpg" alt=x <a href='/posts/1'>one</a> <A HREF=/posts/2>two</a> <a href="https://example.org/abs">abs</a> <a href="#frag">`
+	bu, err := url.Parse("https://example.com/blog/")
+	require.Nil(t, err)
+
+	res, err := absolutifyHTML(in, bu)
+	require.Nil(t, err)
+	require.Contains(t, res, `src="https://example.com/img/a.jpg"`)
+	require.Contains(t, res, `href='https://example.com/posts/1'`)
+	require.Contains(t, res, `HREF=https://example.com/posts/2`)
+	require.Contains(t, res, `href="https://example.org/abs"`)
+	require.Contains(t, res, `href="https://example.com/blog/#frag"`)
+	require.Contains(t, res, `<p class="broken>`, "leaves everything else alone")
 }
 
-func TestPickNewData(t *testing.T) {
-	td := map[string]struct {
-		feeds        []*Feed
-		limitPerFeed int
-		timestamps   map[string]time.Time
-		expected     []*Feed
-	}{
-		"one new entry": {
-			feeds: []*Feed{
-				{
-					Title:   "Test Feed",
-					ID:      "5db01937",
-					Link:    "http://example.com",
-					Updated: time.Date(2022, 7, 23, 1, 2, 3, 0, time.UTC),
-					Entries: []*FeedEntry{
-						{
-							Title:   "Old Entry",
-							Link:    "http://example.com/old",
-							ID:      "5db01937-old",
-							Updated: time.Date(2022, 7, 22, 1, 2, 3, 0, time.UTC),
-						},
-						{
-							Title:   "Latest Hidden Entry",
-							Link:    "http://example.com/new",
-							ID:      "5db01937-new",
-							Updated: time.Date(2022, 7, 23, 1, 2, 3, 0, time.UTC),
-						},
-					},
-				},
-			},
-			limitPerFeed: 1,
-			timestamps: map[string]time.Time{
-				"5db01937": time.Date(2022, 7, 22, 1, 2, 3, 0, time.UTC),
-			},
-			expected: []*Feed{
-				{
-					Title:   "Test Feed",
-					ID:      "5db01937",
-					Link:    "http://example.com",
-					Updated: time.Date(2022, 7, 23, 1, 2, 3, 0, time.UTC),
-					Entries: []*FeedEntry{
-						{
-							Title:   "Latest Hidden Entry",
-							Link:    "http://example.com/new",
-							ID:      "5db01937-new",
-							Updated: time.Date(2022, 7, 23, 1, 2, 3, 0, time.UTC),
-						},
-					},
-				},
-			},
-		},
-		"initial pick is latest entry": {
-			feeds: []*Feed{
-				{
-					Title:   "Test Feed",
-					ID:      "5db01937",
-					Link:    "http://example.com",
-					Updated: time.Date(2022, 7, 23, 1, 2, 3, 0, time.UTC),
-					Entries: []*FeedEntry{
-						{
-							Title:   "Old Entry",
-							Link:    "http://example.com/old",
-							ID:      "5db01937-old",
-							Updated: time.Date(2022, 7, 22, 1, 2, 3, 0, time.UTC),
-						},
-						{
-							Title:   "Latest Hidden Entry",
-							Link:    "http://example.com/new",
-							ID:      "5db01937-new",
-							Updated: time.Date(2022, 7, 23, 1, 2, 3, 0, time.UTC),
-						},
-					},
-				},
-			},
-			limitPerFeed: 1,
-			timestamps:   map[string]time.Time{},
-			expected: []*Feed{
-				{
-					Title:   "Test Feed",
-					ID:      "5db01937",
-					Link:    "http://example.com",
-					Updated: time.Date(2022, 7, 23, 1, 2, 3, 0, time.UTC),
-					Entries: []*FeedEntry{
-						{
-							Title:   "Latest Hidden Entry",
-							Link:    "http://example.com/new",
-							ID:      "5db01937-new",
-							Updated: time.Date(2022, 7, 23, 1, 2, 3, 0, time.UTC),
-						},
-					},
-				},
-			},
-		},
-		"oldest entry first": {
-			feeds: []*Feed{
-				{
-					Title:   "Test Feed",
-					ID:      "5db01937",
-					Link:    "http://example.com",
-					Updated: time.Date(2022, 7, 23, 3, 2, 3, 0, time.UTC),
-					Entries: []*FeedEntry{
-						{
-							Title:   "Entry 3",
-							Link:    "http://example.com/3",
-							ID:      "5db01937-3",
+func TestSubstituteRelativeMalformed(t *testing.T) {
+	in := `<div><p>See <a href=/posts/1>one<img src='img/a.jpg'></p></div></a><p>unclosed <a href="../about">about`
+	bu, err := url.Parse("https://example.com/blog/")
+	require.Nil(t, err)
+
+	res, err := absolutifyHTML(in, bu)
+	require.Nil(t, err)
+	require.Contains(t, res, `href="https://example.com/posts/1"`)
+	require.Contains(t, res, `src="https://example.com/blog/img/a.jpg"`)
+	require.Contains(t, res, `href="https://example.com/about"`)
+}
+
+func TestTransformHTMLStages(t *testing.T) {
+	in := `<p>one</p><p>two <code>x</code></p>`
+	bu, err := url.Parse("https://example.com/")
+	require.Nil(t, err)
+
+	out, err := absolutifyHTML(in, bu)
+	require.Nil(t, err)
+	out, err = upgradeImagesHTML(out, bu, false)
+	require.Nil(t, err)
+	out, err = stripTrackingParamsHTML(out, defaultTrackingParams)
+	require.Nil(t, err)
+	out, err = styleCodeHTML(out)
+	require.Nil(t, err)
+	require.Equal(t, `<html><head></head><body><p>one</p><p>two <code style="`+codeStyles["code"]+`">x</code></p></body></html>`, out, "stages don't add whitespace")
+}
+
+func TestSubstituteRelativeNoFallback(t *testing.T) {
+	in := `<p title="a &lt;b&gt; c"><a href="/posts/1?src=rss">one</a></p>`
+	bu, err := url.Parse("https://example.com/blog/")
+	require.Nil(t, err)
+
+	res, err := absolutifyHTML(in, bu)
+	require.Nil(t, err)
+	require.Contains(t, res, `<a href="https://example.com/posts/1?src=rss">`)
+}
+
+func TestCheckStale(t *testing.T) {
+	byt, err := os.ReadFile("test-data/stale.rss")
+	require.Nil(t, err)
+	f, err := unmarshal(byt)
+	require.Nil(t, err)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	err = checkStale(f, defaultStaleFeedAge, false)
+	require.Nil(t, err)
+	require.Contains(t, logs.String(), `feed "Abandoned Blog" might be abandoned, its newest entry is from 2015-03-03`)
+
+	err = checkStale(f, defaultStaleFeedAge, true)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "might be abandoned")
+
+	err = checkStale(&Feed{Title: "Empty"}, defaultStaleFeedAge, true)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "no dated entries")
+
+	orig := now
+	now = func() time.Time { return time.Date(2015, 4, 1, 0, 0, 0, 0, time.UTC) }
+	t.Cleanup(func() { now = orig })
+	logs.Reset()
+	require.Nil(t, checkStale(f, defaultStaleFeedAge, true))
+	require.Empty(t, logs.String())
+}
+
+func TestStyleCodeBlocks(t *testing.T) {
+	in := `<p>Call <code>main()</code>:</p><pre><code>func main() {
+	fmt.Println("hi")
+}</code></pre><pre style="color: red">plain</pre>`
+	fs := []*Feed{{Entries: []*FeedEntry{{Content: template.HTML(in)}}}}
+
+	runContentPipeline(&Config{StyleCodeBlocks: true, SanitizeHTML: true}, fs)
+	out := string(fs[0].Entries[0].Content)
+	require.Contains(t, out, `<code style="`+codeStyles["code"]+`">main()</code>`)
+	require.Contains(t, out, `<pre style="`+codeStyles["pre"]+`"><code style="`+codeStyles["pre code"]+`">func main() {`)
+	require.Contains(t, out, "\tfmt.Println(&#34;hi&#34;)\n}</code></pre>", "code is kept as it is")
+	require.Contains(t, out, `<pre style="`+codeStyles["pre"]+`">plain</pre>`, "sanitizing runs before styling")
+
+	out, err := styleCodeHTML(`<pre style="color: red">plain</pre>`)
+	require.Nil(t, err)
+	require.Contains(t, out, `<pre style="color: red; `+codeStyles["pre"]+`">`)
+
+	require.NotContains(t, (&Config{}).contentPipeline(), "style-code")
+}
+
+func TestStripQueryParams(t *testing.T) {
+	ps := defaultTrackingParams
+	sd := "https://yro.slashdot.org/story/22/07/27/2124200/charter-told-to-pay?utm_source=rss1.0mainlinkanon&utm_medium=feed"
+
+	require.Equal(t, "https://yro.slashdot.org/story/22/07/27/2124200/charter-told-to-pay", stripQueryParams(sd, ps))
+	require.Equal(t, "https://example.com/?b=2&a=1#top", stripQueryParams("https://example.com/?b=2&utm_source=x&a=1&fbclid=abc#top", ps))
+	require.Equal(t, "https://example.com/#top", stripQueryParams("https://example.com/?GCLID=1#top", ps))
+	require.Equal(t, "https://example.com/?ref=rss", stripQueryParams("https://example.com/?ref=rss", ps))
+	require.Equal(t, "https://example.com/", stripQueryParams("https://example.com/?ref=rss", append(ps, "ref")))
+	require.Equal(t, "https://example.com/?a=1&utm%5Fsource=x", stripQueryParams("https://example.com/?a=1&utm%5Fsource=x", []string{"fbclid"}))
+	require.Equal(t, "https://example.com/?a=1", stripQueryParams("https://example.com/?a=1&utm%5Fsource=x", ps))
+}
+
+func TestStripTrackingParams(t *testing.T) {
+	byt, err := os.ReadFile("test-data/slashdotMain.xml")
+	require.Nil(t, err)
+
+	f, err := unmarshal(byt)
+	require.Nil(t, err)
+	require.Contains(t, f.Entries[0].Link, "utm_source=")
+	require.Contains(t, string(f.Entries[0].Content), "utm_source=")
+
+	stripTrackingParams([]*Feed{f}, (&Config{}).trackingParams())
+	for _, e := range f.Entries {
+		require.NotContains(t, e.Link, "utm_")
+		require.NotContains(t, string(e.Content), "utm_source=")
+	}
+	require.Equal(t, "https://yro.slashdot.org/story/22/07/27/2124200/charter-told-to-pay-73-billion-in-damages-after-cable-installer-murders-grandmother", f.Entries[0].Link)
+	require.Contains(t, string(f.Entries[0].Content), `href="https://yro.slashdot.org/story/22/07/27/2124200/charter-told-to-pay-73-billion-in-damages-after-cable-installer-murders-grandmother"`)
+	require.Contains(t, string(f.Entries[0].Content), "%3Futm_source%3Dslashdot%26utm_medium%3Dfacebook", "values of other params are kept")
+
+	cfg := &Config{StripTrackingParams: true}
+	require.Contains(t, cfg.contentPipeline(), "strip-tracking-params")
+}
+
+func TestUpgradeInsecureImages(t *testing.T) {
+	in := `<p><img src="http://example.com/a.jpg" srcset="http://example.com/a.jpg 1x, http://example.com/a2.jpg 2x"/><img src="http://other.com/b.jpg"/><a href="http://example.com/c">c</a></p>`
+	bu, err := url.Parse("https://example.com/")
+	require.Nil(t, err)
+
+	res, err := upgradeImagesHTML(in, bu, false)
+	require.Nil(t, err)
+	require.Contains(t, res, `src="https://example.com/a.jpg"`)
+	require.Contains(t, res, `srcset="https://example.com/a.jpg 1x, https://example.com/a2.jpg 2x"`)
+	require.Contains(t, res, `src="http://other.com/b.jpg"`, "other hosts are not upgraded by default")
+	require.Contains(t, res, `href="http://example.com/c"`, "links are not upgraded")
+
+	res, err = upgradeImagesHTML(in, bu, true)
+	require.Nil(t, err)
+	require.Contains(t, res, `src="https://other.com/b.jpg"`)
+
+	fs := []*Feed{{Link: "https://example.com/", Entries: []*FeedEntry{{Content: template.HTML(in)}}}}
+	upgradeInsecureImages(fs, false)
+	body, err := makeEmailBody(&Config{}, fs, nil, defaultEmailTemplate)
+	require.Nil(t, err)
+	require.Contains(t, body, `src="https://example.com/a.jpg"`)
+	require.NotContains(t, body, `src="http://example.com/a.jpg"`)
+}
+
+func TestEmailBodySubtitle(t *testing.T) {
+	fs := []*Feed{
+		{Title: "With", Subtitle: "Feed description", Entries: []*FeedEntry{{Title: "e1"}}},
+		{Title: "Without", Entries: []*FeedEntry{{Title: "e2"}}},
+	}
+	body, err := makeEmailBody(&Config{}, fs, nil, defaultEmailTemplate)
+	require.Nil(t, err)
+	require.Contains(t, body, ">Feed description</p>")
+	require.Equal(t, 1, strings.Count(body, "<p style="))
+}
+
+func TestFeedSubtitle(t *testing.T) {
+	rss := strings.Replace(testRSS, "<link>https://example.com/</link>", "<link>https://example.com/</link>\n    <description>Feed description</description>", 1)
+	cfg := newTestConfig(t, rss)
+	msgs := captureDeliveries(t, 0)
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1)
+	require.Contains(t, (*msgs)[0].Body, ">Feed description</p>")
+}
+
+func TestEmailBodySummaryHeader(t *testing.T) {
+	succs := []*Feed{
+		{Title: "One", Entries: []*FeedEntry{{Title: "e1"}, {Title: "e2"}}},
+		{Title: "Two", Entries: []*FeedEntry{{Title: "e3"}}},
+	}
+	fails := []*Feed{{Title: "Broken", Failure: fmt.Errorf("boom")}}
+
+	body, err := makeEmailBody(&Config{ShowSummaryHeader: true}, succs, fails, defaultEmailTemplate)
+	require.Nil(t, err)
+	require.Contains(t, body, `<p style="color: #6a6e7c; margin: 1.6em 0;">3 new entries across 2 feeds, 1 failure.</p>`)
+	require.Less(t, strings.Index(body, "3 new entries"), strings.Index(body, ">One</a>"))
+
+	body, err = makeEmailBody(&Config{ShowSummaryHeader: true}, succs[1:], nil, defaultEmailTemplate)
+	require.Nil(t, err)
+	require.Contains(t, body, `>1 new entry across 1 feed.</p>`)
+
+	body, err = makeEmailBody(&Config{}, succs, fails, defaultEmailTemplate)
+	require.Nil(t, err)
+	require.NotContains(t, body, "new entries across")
+}
+
+func TestEmailBodySectionOrder(t *testing.T) {
+	updated := time.Date(2022, 8, 3, 8, 0, 0, 0, time.UTC)
+	succs := []*Feed{{Title: "One", Link: "https://example.com/", Entries: []*FeedEntry{{Title: "e1", Link: "https://example.com/e1", Updated: updated}}}}
+	fails := []*Feed{{Title: "Broken", Link: "https://broken.example.com/", Failure: fmt.Errorf("boom")}}
+
+	for _, order := range []string{"successes-first", "failures-first"} {
+		cfg := &Config{SectionOrder: order}
+
+		text, err := makeTextEmailBody(cfg, succs, fails, defaultTextEmailTemplate)
+		require.Nil(t, err)
+		expected, err := os.ReadFile(fmt.Sprintf("test-data/section-order-%s.txt", order))
+		require.Nil(t, err)
+		require.Equal(t, string(expected), text, order)
+
+		body, err := makeEmailBody(cfg, succs, fails, defaultEmailTemplate)
+		require.Nil(t, err)
+		succIdx, failIdx := strings.Index(body, ">One</a>"), strings.Index(body, ">Broken</a>")
+		require.True(t, succIdx >= 0 && failIdx >= 0, order)
+		require.Equal(t, order == "failures-first", failIdx < succIdx, order)
+		require.Equal(t, 1, strings.Count(body, "<hr />"), order)
+	}
+}
+
+func TestEmailBodyTemplateFragments(t *testing.T) {
+	updated := time.Date(2022, 8, 3, 8, 0, 0, 0, time.UTC)
+	succs := []*Feed{
+		{Title: "One", Link: "https://example.com/", Entries: []*FeedEntry{{Title: "e1", Link: "https://example.com/e1", Updated: updated}}, conf: &ConfigFeed{Fragment: "video"}},
+		{Title: "Two", Link: "https://example.org/", Entries: []*FeedEntry{{Title: "e2", Link: "https://example.org/e2", Updated: updated}}, conf: &ConfigFeed{Fragment: "text"}},
+		{Title: "Three", Link: "https://example.net/", Entries: []*FeedEntry{{Title: "e3", Link: "https://example.net/e3", Updated: updated}}},
+	}
+	cfg := &Config{TemplateFragments: map[string]string{
+		"video": `<div class="video-card">{{ .Title }}</div>`,
+		"text":  `<p class="text-card"><a href="{{ .Link }}">{{ .Title }}</a></p>`,
+	}}
+
+	for _, chronological := range []bool{false, true} {
+		cfg.Chronological = chronological
+		body, err := makeEmailBody(cfg, succs, nil, defaultEmailTemplate)
+		require.Nil(t, err)
+		require.Contains(t, body, `<div class="video-card">e1</div>`)
+		require.Contains(t, body, `<p class="text-card"><a href="https://example.org/e2">e2</a></p>`)
+		require.Contains(t, body, `>e3</a><span`)
+		require.NotContains(t, body, "card\">e3")
+	}
+
+	succs[0].conf.Fragment = "unknown"
+	_, err := makeEmailBody(cfg, succs, nil, defaultEmailTemplate)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), `undefined template fragment "unknown"`)
+}
+
+func TestFeedAlwaysShow(t *testing.T) {
+	cfg := newTestConfig(t, strings.ReplaceAll(testRSS, "Test Feed", "Pinned Feed"))
+	fs, err := readFeedsConfig(cfg.FeedsFile[0])
+	require.Nil(t, err)
+	fs[0].AlwaysShow = true
+
+	body := strings.ReplaceAll(testRSS, "https://example.com", "https://other.example.com")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	fs = append(fs, &ConfigFeed{Name: "other", URL: srv.URL})
+	bt, err := yaml.Marshal(fs)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(cfg.FeedsFile[0], bt, 0o677))
+	msgs := captureDeliveries(t, 0)
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1)
+	require.NotContains(t, (*msgs)[0].Body, "No new entries.")
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1, "no email with only empty feeds")
+
+	body = strings.ReplaceAll(body, "Aug 2022", "Aug 2023")
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 2)
+	require.Contains(t, (*msgs)[1].Body, ">Pinned Feed</a>")
+	require.Equal(t, 1, strings.Count((*msgs)[1].Body, "No new entries."))
+	require.Contains(t, (*msgs)[1].Text, "Pinned Feed\nhttps://example.com/\n\n  No new entries.\n")
+
+	ts := map[string]time.Time{}
+	updateTimestamps(ts, []*Feed{{ID: "empty", Link: "https://empty.example.com/", Entries: []*FeedEntry{}}})
+	require.Len(t, ts, 0, "always-show feeds without any entries have no timestamp")
+}
+
+func TestEmailBodyGreetingAndSignature(t *testing.T) {
+	clock := time.Date(2022, 8, 3, 8, 0, 0, 0, time.UTC)
+	orig := now
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { now = orig })
+
+	fs := []*Feed{{Title: "One", Entries: []*FeedEntry{{Title: "e1"}}}}
+	cfg := &Config{Greeting: "Good {{ .TimeOfDay }}!", Signature: "— feeder"}
+
+	body, err := makeEmailBody(cfg, fs, nil, defaultEmailTemplate)
+	require.Nil(t, err)
+	require.Contains(t, body, ">Good morning!</p>")
+	require.Contains(t, body, ">— feeder</p>")
+	require.Less(t, strings.Index(body, "Good morning!"), strings.Index(body, ">One</a>"))
+	require.Greater(t, strings.Index(body, "— feeder"), strings.Index(body, ">e1</a>"))
+
+	text, err := makeTextEmailBody(cfg, fs, nil, defaultTextEmailTemplate)
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(text, "Good morning!\n"))
+	require.True(t, strings.HasSuffix(text, "— feeder\n"))
+
+	clock = time.Date(2022, 8, 3, 19, 0, 0, 0, time.UTC)
+	body, err = makeEmailBody(cfg, fs, nil, defaultEmailTemplate)
+	require.Nil(t, err)
+	require.Contains(t, body, ">Good evening!</p>")
+
+	_, err = renderSalutation("{{ .Unknown", clock)
+	require.NotNil(t, err)
+}
+
+func TestEmailBodyFeedUpdated(t *testing.T) {
+	updated := time.Date(2022, 8, 2, 10, 0, 0, 0, time.UTC)
+	fs := []*Feed{{Title: "Status", Updated: updated, Entries: []*FeedEntry{{Title: "e1"}}}}
+
+	body, err := makeEmailBody(&Config{ShowFeedUpdated: true}, fs, nil, defaultEmailTemplate)
+	require.Nil(t, err)
+	require.Contains(t, body, ">Status</a><span style=\"font-size:0.75rem;margin-left:1rem;\">updated "+FormatTime(updated)+"</span></h1>")
+
+	body, err = makeEmailBody(&Config{}, fs, nil, defaultEmailTemplate)
+	require.Nil(t, err)
+	require.NotContains(t, body, "updated "+FormatTime(updated))
+
+	cfg := newTestConfig(t, testRSS)
+	fcs, err := readFeedsConfig(cfg.FeedsFile[0])
+	require.Nil(t, err)
+	f, err := downloadFeed(cfg, fcs[0])
+	require.Nil(t, err)
+	require.Equal(t, time.Date(2022, 8, 2, 10, 0, 0, 0, time.UTC).Unix(), f.Updated.Unix(), "falls back to latest entry")
+}
+
+func TestTextEmailBody(t *testing.T) {
+	succs := []*Feed{{
+		Title: "Blog",
+		Link:  "https://example.com",
+		Entries: []*FeedEntry{
+			{Title: "Entry 1", Link: "https://example.com/1", Updated: time.Date(2022, 8, 1, 10, 0, 0, 0, time.UTC), Content: "<p>Ignored</p>"},
+		},
+	}}
+	fails := []*Feed{{Title: "Broken", Failure: fmt.Errorf("boom")}}
+
+	body, err := makeTextEmailBody(&Config{}, succs, fails, defaultTextEmailTemplate)
+	require.Nil(t, err)
+	expected := "Blog\nhttps://example.com\n\n" +
+		"  * Entry 1 (" + FormatTime(succs[0].Entries[0].Updated) + ")\n" +
+		"    https://example.com/1\n\n" +
+		"Failures\n\n  * Broken: boom\n"
+	require.Equal(t, expected, body)
+
+	cfg := newTestConfig(t, testRSS)
+	msgs := captureDeliveries(t, 0)
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1)
+	require.Contains(t, (*msgs)[0].Text, "  * Entry 2 (")
+	require.NotContains(t, (*msgs)[0].Text, "<")
+}
+
+func TestEmailBodyFooter(t *testing.T) {
+	footer := `<p><a href="https://example.com/feeds">Manage feeds</a></p>`
+	fs := []*Feed{{Title: "Feed", Entries: []*FeedEntry{{Title: "e1"}}}}
+	body, err := makeEmailBody(&Config{FooterHTML: footer}, fs, nil, defaultEmailTemplate)
+	require.Nil(t, err)
+	require.True(t, strings.HasSuffix(body, footer))
+}
+
+func TestRenderTemplate(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "template.html")
+	tmpl := `{{ range .Successes }}<h1>{{ .Title }}</h1>{{ range .Entries }}<h2>{{ .Title }}</h2>{{ end }}{{ end }}` +
+		`{{ range .Failures }}<p>{{ .Title }}: {{ .Failure }}</p>{{ end }}`
+	require.Nil(t, os.WriteFile(fn, []byte(tmpl), 0o600))
+
+	buf := &bytes.Buffer{}
+	require.Nil(t, renderTemplate(buf, fn))
+	require.Contains(t, buf.String(), "<h1>Sample Blog</h1><h2>Sample Entry One</h2><h2>Sample Entry Two</h2>")
+	require.Contains(t, buf.String(), "<h1>Sample Videos</h1><h2>Sample Video</h2>")
+	require.Contains(t, buf.String(), "<p>Sample Broken Feed: failed to request")
+
+	buf.Reset()
+	require.Nil(t, renderTemplate(buf, ""))
+	require.Contains(t, buf.String(), "Sample Entry One")
+
+	require.NotNil(t, renderTemplate(buf, filepath.Join(t.TempDir(), "missing.html")))
+}
+
+func TestFileExists(t *testing.T) {
+	exists := "readme.md"
+	doesNotExist := "does-not-exist"
+	require.True(t, fileExists(exists))
+	require.False(t, fileExists(doesNotExist))
+}
+
+func TestPickNewData(t *testing.T) {
+	overridden := &ConfigFeed{Name: "Busy Feed", MaxEntries: 1}
+	unset := &ConfigFeed{Name: "Quiet Feed"}
+	newEntries := func(id string) []*FeedEntry {
+		return []*FeedEntry{
+			{Title: "Entry 1", ID: id + "-1", Updated: time.Date(2022, 7, 22, 1, 2, 3, 0, time.UTC)},
+			{Title: "Entry 2", ID: id + "-2", Updated: time.Date(2022, 7, 22, 2, 2, 3, 0, time.UTC)},
+			{Title: "Entry 3", ID: id + "-3", Updated: time.Date(2022, 7, 22, 3, 2, 3, 0, time.UTC)},
+		}
+	}
+
+	td := map[string]struct {
+		feeds        []*Feed
+		limitPerFeed int
+		timestamps   map[string]time.Time
+		expected     []*Feed
+	}{
+		"one new entry": {
+			feeds: []*Feed{
+				{
+					Title:   "Test Feed",
+					ID:      "5db01937",
+					Link:    "http://example.com",
+					Updated: time.Date(2022, 7, 23, 1, 2, 3, 0, time.UTC),
+					Entries: []*FeedEntry{
+						{
+							Title:   "Old Entry",
+							Link:    "http://example.com/old",
+							ID:      "5db01937-old",
+							Updated: time.Date(2022, 7, 22, 1, 2, 3, 0, time.UTC),
+						},
+						{
+							Title:   "Latest Hidden Entry",
+							Link:    "http://example.com/new",
+							ID:      "5db01937-new",
+							Updated: time.Date(2022, 7, 23, 1, 2, 3, 0, time.UTC),
+						},
+					},
+				},
+			},
+			limitPerFeed: 1,
+			timestamps: map[string]time.Time{
+				"5db01937": time.Date(2022, 7, 22, 1, 2, 3, 0, time.UTC),
+			},
+			expected: []*Feed{
+				{
+					Title:   "Test Feed",
+					ID:      "5db01937",
+					Link:    "http://example.com",
+					Updated: time.Date(2022, 7, 23, 1, 2, 3, 0, time.UTC),
+					Entries: []*FeedEntry{
+						{
+							Title:   "Latest Hidden Entry",
+							Link:    "http://example.com/new",
+							ID:      "5db01937-new",
+							Updated: time.Date(2022, 7, 23, 1, 2, 3, 0, time.UTC),
+						},
+					},
+				},
+			},
+		},
+		"initial pick is latest entry": {
+			feeds: []*Feed{
+				{
+					Title:   "Test Feed",
+					ID:      "5db01937",
+					Link:    "http://example.com",
+					Updated: time.Date(2022, 7, 23, 1, 2, 3, 0, time.UTC),
+					Entries: []*FeedEntry{
+						{
+							Title:   "Old Entry",
+							Link:    "http://example.com/old",
+							ID:      "5db01937-old",
+							Updated: time.Date(2022, 7, 22, 1, 2, 3, 0, time.UTC),
+						},
+						{
+							Title:   "Latest Hidden Entry",
+							Link:    "http://example.com/new",
+							ID:      "5db01937-new",
+							Updated: time.Date(2022, 7, 23, 1, 2, 3, 0, time.UTC),
+						},
+					},
+				},
+			},
+			limitPerFeed: 1,
+			timestamps:   map[string]time.Time{},
+			expected: []*Feed{
+				{
+					Title:   "Test Feed",
+					ID:      "5db01937",
+					Link:    "http://example.com",
+					Updated: time.Date(2022, 7, 23, 1, 2, 3, 0, time.UTC),
+					Entries: []*FeedEntry{
+						{
+							Title:   "Latest Hidden Entry",
+							Link:    "http://example.com/new",
+							ID:      "5db01937-new",
+							Updated: time.Date(2022, 7, 23, 1, 2, 3, 0, time.UTC),
+						},
+					},
+				},
+			},
+		},
+		"oldest entry first": {
+			feeds: []*Feed{
+				{
+					Title:   "Test Feed",
+					ID:      "5db01937",
+					Link:    "http://example.com",
+					Updated: time.Date(2022, 7, 23, 3, 2, 3, 0, time.UTC),
+					Entries: []*FeedEntry{
+						{
+							Title:   "Entry 3",
+							Link:    "http://example.com/3",
+							ID:      "5db01937-3",
 							Updated: time.Date(2022, 7, 22, 3, 2, 3, 0, time.UTC),
 						},
 						{
@@ -310,6 +1115,30 @@ func TestPickNewData(t *testing.T) {
 				},
 			},
 		},
+		"per-feed max entries override global limit": {
+			feeds: []*Feed{
+				{Title: "Busy Feed", ID: "busy", Entries: newEntries("busy"), conf: overridden},
+				{Title: "Quiet Feed", ID: "quiet", Entries: newEntries("quiet"), conf: unset},
+				{Title: "Unconfigured Feed", ID: "none", Entries: newEntries("none")},
+			},
+			limitPerFeed: 2,
+			timestamps:   map[string]time.Time{},
+			expected: []*Feed{
+				{Title: "Busy Feed", ID: "busy", Entries: newEntries("busy")[2:], conf: overridden},
+				{Title: "Quiet Feed", ID: "quiet", Entries: newEntries("quiet")[1:], conf: unset},
+				{Title: "Unconfigured Feed", ID: "none", Entries: newEntries("none")[1:]},
+			},
+		},
+		"per-feed max entries above global limit": {
+			feeds: []*Feed{
+				{Title: "Busy Feed", ID: "busy", Entries: newEntries("busy"), conf: &ConfigFeed{MaxEntries: 3}},
+			},
+			limitPerFeed: 1,
+			timestamps:   map[string]time.Time{},
+			expected: []*Feed{
+				{Title: "Busy Feed", ID: "busy", Entries: newEntries("busy"), conf: &ConfigFeed{MaxEntries: 3}},
+			},
+		},
 	}
 
 	for tn, tc := range td {
@@ -326,3 +1155,2675 @@ func TestFeedInfo(t *testing.T) {
 	require.Equal(t, "Sample Title", gotTitle)
 	require.Equal(t, "https://example.com/atom.xml", gotLink)
 }
+
+const testRSS = `<?xml version="1.0"?>
+<rss version="2.0">
+  <channel>
+    <title>Test Feed</title>
+    <link>https://example.com/</link>
+    <item>
+      <title>Entry 1</title>
+      <link>https://example.com/1</link>
+      <guid>https://example.com/1</guid>
+      <pubDate>Mon, 01 Aug 2022 10:00:00 +0000</pubDate>
+    </item>
+    <item>
+      <title>Entry 2</title>
+      <link>https://example.com/2</link>
+      <guid>https://example.com/2</guid>
+      <pubDate>Tue, 02 Aug 2022 10:00:00 +0000</pubDate>
+    </item>
+  </channel>
+</rss>`
+
+// newTestConfig serves the given feeds via httptest and returns a config
+// subscribed to them, with state files in a temporary directory.
+func newTestConfig(t *testing.T, feeds ...string) *Config {
+	dir := t.TempDir()
+	fcs := []*ConfigFeed{}
+	for i, f := range feeds {
+		body := f
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, body)
+		}))
+		t.Cleanup(srv.Close)
+		fcs = append(fcs, &ConfigFeed{Name: fmt.Sprintf("feed-%v", i), URL: srv.URL})
+	}
+
+	cfg := &Config{
+		TimestampFile:     filepath.Join(dir, "timestamps.yml"),
+		FeedsFile:         StringList{filepath.Join(dir, "feeds.yml")},
+		Email:             ConfigEmail{From: "hans@example.com"},
+		MaxEntriesPerFeed: 3,
+	}
+	bt, err := yaml.Marshal(fcs)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(cfg.FeedsFile[0], bt, 0o677))
+
+	return cfg
+}
+
+// captureDeliveries replaces deliver for the duration of the test, failing
+// the first failures attempts and recording the successful ones.
+func captureDeliveries(t *testing.T, failures int) *[]*message {
+	msgs := []*message{}
+	attempts := 0
+	orig := deliver
+	deliver = func(cfg ConfigEmail, msg *message) error {
+		attempts += 1
+		if attempts <= failures {
+			return fmt.Errorf("smtp failure %v", attempts)
+		}
+		msgs = append(msgs, msg)
+		return nil
+	}
+	t.Cleanup(func() { deliver = orig })
+	return &msgs
+}
+
+func TestFeedRetriesSendingEmail(t *testing.T) {
+	cfg := newTestConfig(t, testRSS)
+	cfg.SendRetries = 2
+	cfg.SendRetryBackoff = time.Millisecond
+	msgs := captureDeliveries(t, 2)
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1)
+	require.Contains(t, (*msgs)[0].Body, "Entry 2")
+
+	ts, err := readTimestamps(cfg.TimestampFile)
+	require.Nil(t, err)
+	require.Len(t, ts, 1, "the link is the ID, so there is no separate link key")
+	for _, v := range ts {
+		require.Equal(t, time.Date(2022, 8, 2, 10, 0, 0, 0, time.UTC).Unix(), v.Unix())
+	}
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1, "timestamps advanced, no new entries expected")
+}
+
+func TestFeedWritesOutputFile(t *testing.T) {
+	cfg := newTestConfig(t, testRSS)
+	cfg.OutputFile = filepath.Join(t.TempDir(), "digest.html")
+	msgs := captureDeliveries(t, 0)
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 0, "no email is sent when writing to a file")
+
+	byt, err := os.ReadFile(cfg.OutputFile)
+	require.Nil(t, err)
+	require.Contains(t, string(byt), ">Entry 1</a>")
+	require.Contains(t, string(byt), ">Entry 2</a>")
+
+	ts, err := readTimestamps(cfg.TimestampFile)
+	require.Nil(t, err)
+	require.Len(t, ts, 1, "timestamps advance after writing the file")
+
+	require.Nil(t, os.Remove(cfg.OutputFile))
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.NoFileExists(t, cfg.OutputFile, "no new entries expected")
+}
+
+func TestSubjectTemplate(t *testing.T) {
+	succs := []*Feed{
+		{Title: "One", Entries: []*FeedEntry{{Title: "e1"}, {Title: "e2"}}},
+		{Title: "Two", Entries: []*FeedEntry{{Title: "e3"}}},
+	}
+	fails := []*Feed{{Title: "Broken", Failure: fmt.Errorf("boom")}}
+	clock := time.Date(2022, 8, 3, 8, 0, 0, 0, time.UTC)
+
+	tmpl := `{{ .EntryCount }} new items from {{ .FeedCount }} feeds{{ if .FailureCount }}, {{ .FailureCount }} failed{{ end }}
+({{ .Now.Format "Jan 2" }})`
+	subject, err := renderSubject(tmpl, succs, fails, clock)
+	require.Nil(t, err)
+	require.Equal(t, "3 new items from 2 feeds, 1 failed (Aug 3)", subject)
+
+	subject, err = renderSubject("", succs, fails, clock)
+	require.Nil(t, err)
+	require.Empty(t, subject)
+
+	_, err = renderSubject("{{ .Missing }}", succs, fails, clock)
+	require.NotNil(t, err)
+
+	cfg := newTestConfig(t, testRSS)
+	cfg.SubjectTemplate = "{{ .EntryCount }} new items from {{ .FeedCount }} feeds"
+	msgs := captureDeliveries(t, 0)
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1)
+	require.Equal(t, "2 new items from 1 feeds", (*msgs)[0].Subject)
+}
+
+func TestFeedOnly(t *testing.T) {
+	cfg := newTestConfig(t,
+		strings.ReplaceAll(testRSS, "Test Feed", "Feed Zero"),
+		strings.ReplaceAll(testRSS, "Test Feed", "Feed One"),
+		strings.ReplaceAll(testRSS, "Test Feed", "Feed Two"),
+	)
+	fs, err := readFeedsConfig(cfg.FeedsFile[0])
+	require.Nil(t, err)
+	msgs := captureDeliveries(t, 0)
+
+	require.Nil(t, feed(cfg, &FeederFlags{Only: "FEED-0, " + fs[2].URL}))
+	require.Len(t, *msgs, 1)
+	require.Contains(t, (*msgs)[0].Body, "Feed Zero")
+	require.NotContains(t, (*msgs)[0].Body, "Feed One")
+	require.Contains(t, (*msgs)[0].Body, "Feed Two")
+
+	st, err := readState(cfg.stateFile())
+	require.Nil(t, err)
+	require.Len(t, st.Feeds, 2)
+	require.NotContains(t, st.Feeds, fs[1].URL)
+
+	err = feed(cfg, &FeederFlags{Only: "feed-0,unknown"})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), `"unknown"`)
+}
+
+func TestFeedWritesStats(t *testing.T) {
+	cfg := newTestConfig(t, testRSS, "<html><body>not a feed</body></html>", testRSS)
+	fs, err := readFeedsConfig(cfg.FeedsFile[0])
+	require.Nil(t, err)
+	fs[2].Disabled = true
+	bt, err := yaml.Marshal(fs)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(cfg.FeedsFile[0], bt, 0o677))
+	captureDeliveries(t, 0)
+
+	fn := filepath.Join(t.TempDir(), "stats.json")
+	require.Nil(t, feed(cfg, &FeederFlags{Stats: fn}))
+
+	byt, err := os.ReadFile(fn)
+	require.Nil(t, err)
+
+	var stats struct {
+		Time  time.Time                `json:"time"`
+		Feeds []map[string]interface{} `json:"feeds"`
+	}
+	require.Nil(t, json.Unmarshal(byt, &stats))
+	require.False(t, stats.Time.IsZero())
+	require.Len(t, stats.Feeds, 2)
+
+	require.Equal(t, "feed-0", stats.Feeds[0]["name"])
+	require.Equal(t, fs[0].URL, stats.Feeds[0]["url"])
+	require.Equal(t, true, stats.Feeds[0]["success"])
+	require.Equal(t, float64(2), stats.Feeds[0]["new_entries"])
+	require.Contains(t, stats.Feeds[0], "fetch_duration_ms")
+	require.NotContains(t, stats.Feeds[0], "error")
+
+	require.Equal(t, "feed-1", stats.Feeds[1]["name"])
+	require.Equal(t, false, stats.Feeds[1]["success"])
+	require.Equal(t, float64(0), stats.Feeds[1]["new_entries"])
+	require.NotEmpty(t, stats.Feeds[1]["error"])
+}
+
+func TestConfigChangeWarning(t *testing.T) {
+	cfg := newTestConfig(t, testRSS)
+	cfg.ConfigChangeWarning = "email"
+	cfg.path = filepath.Join(t.TempDir(), "config.yml")
+	require.Nil(t, os.WriteFile(cfg.path, []byte("feeds-file: feeds.yml\n"), 0o600))
+	msgs := captureDeliveries(t, 0)
+	warnings := func() []*message {
+		ws := []*message{}
+		for _, m := range *msgs {
+			if strings.HasPrefix(m.Subject, "feeder warning") {
+				ws = append(ws, m)
+			}
+		}
+		return ws
+	}
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1)
+	require.Len(t, warnings(), 0, "nothing recorded on the first run")
+
+	fc := &ConfigFeed{Name: "added", URL: "https://example.com/feed", Disabled: true}
+	added, _, err := addFeeds(cfg, []*ConfigFeed{fc})
+	require.Nil(t, err)
+	require.Equal(t, 1, added)
+	fs, err := readFeedsConfig(cfg.FeedsFile[0])
+	require.Nil(t, err)
+	require.Len(t, fs, 2)
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, warnings(), 0, "subscribing is not an unexpected change")
+
+	f, err := os.OpenFile(cfg.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	require.Nil(t, err)
+	_, err = f.WriteString("max-entries-per-feed: 5\n")
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	ws := warnings()
+	require.Len(t, ws, 1)
+	require.Equal(t, cfg.Email.From, ws[0].To)
+	require.Contains(t, ws[0].Text, cfg.path)
+	require.NotContains(t, ws[0].Text, cfg.FeedsFile[0])
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, warnings(), 1, "warns once per change")
+}
+
+func TestFeedSince(t *testing.T) {
+	clock := time.Date(2022, 8, 2, 20, 0, 0, 0, time.UTC)
+	orig := now
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { now = orig })
+
+	cfg := newTestConfig(t, testRSS)
+	msgs := captureDeliveries(t, 0)
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1)
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1, "no new entries")
+	ts, err := os.ReadFile(cfg.TimestampFile)
+	require.Nil(t, err)
+	st, err := os.ReadFile(cfg.stateFile())
+	require.Nil(t, err)
+
+	clock = clock.Add(time.Hour)
+
+	require.Nil(t, feed(cfg, &FeederFlags{Since: 24 * time.Hour}))
+	require.Len(t, *msgs, 2)
+	require.Contains(t, (*msgs)[1].Body, "Entry 2")
+	require.NotContains(t, (*msgs)[1].Body, "Entry 1")
+
+	require.Nil(t, feed(cfg, &FeederFlags{Since: 48 * time.Hour}))
+	require.Len(t, *msgs, 3)
+	require.Contains(t, (*msgs)[2].Body, "Entry 1")
+	require.Contains(t, (*msgs)[2].Body, "Entry 2")
+
+	after, err := os.ReadFile(cfg.TimestampFile)
+	require.Nil(t, err)
+	require.Equal(t, string(ts), string(after), "timestamps are left as they are")
+	after, err = os.ReadFile(cfg.stateFile())
+	require.Nil(t, err)
+	require.Equal(t, string(st), string(after), "state is left as it is")
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 3, "no new entries")
+
+	cfg = newTestConfig(t, testRSS)
+	cfg.DedupByID = true
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 4)
+
+	require.Nil(t, feed(cfg, &FeederFlags{Since: 48 * time.Hour}))
+	require.Len(t, *msgs, 5, "sent entries are shown again despite dedup-by-id")
+	require.Contains(t, (*msgs)[4].Body, "Entry 1")
+	require.Contains(t, (*msgs)[4].Body, "Entry 2")
+}
+
+func TestFeedGlobalDedup(t *testing.T) {
+	shared := `<item><title>Shared</title><link>https://shared.example.com/1</link><guid>shared-1</guid><pubDate>Wed, 03 Aug 2022 10:00:00 +0000</pubDate></item>`
+	first := strings.Replace(strings.ReplaceAll(testRSS, "Test Feed", "First Feed"), "<item>", shared+"<item>", 1)
+	second := strings.ReplaceAll(testRSS, "https://example.com", "https://second.example.com")
+	second = strings.Replace(strings.ReplaceAll(second, "Test Feed", "Second Feed"), "<item>", shared+"<item>", 1)
+	only := strings.ReplaceAll(testRSS, "https://example.com", "https://only.example.com")
+	only = strings.Replace(strings.ReplaceAll(only, "Test Feed", "Only Shared"), "<item>", shared+"<!--", 1)
+	only = strings.Replace(only, "</channel>", "--></channel>", 1)
+
+	cfg := newTestConfig(t, first, second, only)
+	cfg.GlobalDedup = true
+	msgs := captureDeliveries(t, 0)
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1)
+	body := (*msgs)[0].Body
+	require.Equal(t, 1, strings.Count(body, ">Shared</a>"))
+	section := body[strings.Index(body, ">First Feed</a>"):]
+	if end := strings.Index(section, "<h1"); end >= 0 {
+		section = section[:end]
+	}
+	require.Contains(t, section, ">Shared</a>", "the first feed in config order keeps the entry")
+	require.Contains(t, body, "https://second.example.com/2")
+	require.NotContains(t, body, "Only Shared")
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1, "dropped entries aren't sent later")
+
+	cfg = newTestConfig(t, first, second)
+	msgs = captureDeliveries(t, 0)
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1)
+	require.Equal(t, 2, strings.Count((*msgs)[0].Body, ">Shared</a>"), "only with global-dedup")
+}
+
+func TestFeedGivesUpSendingEmail(t *testing.T) {
+	cfg := newTestConfig(t, testRSS)
+	cfg.SendRetries = 1
+	cfg.SendRetryBackoff = time.Millisecond
+	msgs := captureDeliveries(t, 2)
+
+	require.NotNil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 0)
+
+	ts, err := readTimestamps(cfg.TimestampFile)
+	require.Nil(t, err)
+	require.Len(t, ts, 0, "timestamps should not advance without delivery")
+}
+
+func newCookieServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/first":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "5db01937", Path: "/"})
+			fmt.Fprint(w, "first")
+		case "/second":
+			c, err := r.Cookie("session")
+			if err != nil || c.Value != "5db01937" {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, "forbidden")
+				return
+			}
+			fmt.Fprint(w, "second")
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestCookieJar(t *testing.T) {
+	srv := newCookieServer(t)
+
+	cfg := &Config{}
+	_, err := get(cfg, nil, srv.URL+"/first")
+	require.Nil(t, err)
+	byt, err := get(cfg, nil, srv.URL+"/second")
+	require.Nil(t, err)
+	require.Equal(t, "forbidden", string(byt), "cookies are not kept without jar")
+
+	cfg = &Config{CookieJar: true}
+	_, err = get(cfg, nil, srv.URL+"/first")
+	require.Nil(t, err)
+	byt, err = get(cfg, nil, srv.URL+"/second")
+	require.Nil(t, err)
+	require.Equal(t, "second", string(byt))
+}
+
+func TestCookieJarPerRun(t *testing.T) {
+	var mu sync.Mutex
+	cookies := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		c, err := r.Cookie("session")
+		if err == nil {
+			cookies = append(cookies, c.Value)
+		}
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: fmt.Sprint(len(cookies))})
+		fmt.Fprint(w, testRSS)
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg := newTestConfig(t)
+	bt, err := yaml.Marshal([]*ConfigFeed{{Name: "session", URL: srv.URL}})
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(cfg.FeedsFile[0], bt, 0o677))
+	cfg.CookieJar = true
+	captureDeliveries(t, 0)
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Empty(t, cookies, "cookies are kept within a run only")
+}
+
+func TestCookieFile(t *testing.T) {
+	srv := newCookieServer(t)
+	fn := filepath.Join(t.TempDir(), "cookies.yml")
+
+	cfg := &Config{CookieFile: fn}
+	_, err := get(cfg, nil, srv.URL+"/first")
+	require.Nil(t, err)
+	require.Nil(t, writeCookies(fn, cfg.jar))
+
+	cfg = &Config{CookieFile: fn}
+	byt, err := get(cfg, nil, srv.URL+"/second")
+	require.Nil(t, err)
+	require.Equal(t, "second", string(byt), "cookies should be restored from file")
+}
+
+func TestPrintVersionJSON(t *testing.T) {
+	var buf bytes.Buffer
+	require.Nil(t, printVersion(&buf, true))
+
+	var v map[string]string
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &v))
+	require.Equal(t, map[string]string{"version": AppVersion}, v)
+
+	buf.Reset()
+	require.Nil(t, printBuildInfo(&buf, true))
+
+	var bi map[string]interface{}
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &bi))
+	require.Contains(t, bi, "GoVersion")
+	require.Contains(t, bi, "Path")
+}
+
+func TestResolveRelativeURLsPerFeed(t *testing.T) {
+	off := false
+	content := template.HTML(`<a href="/rel">rel</a>`)
+	fs := []*Feed{
+		{Link: "https://one.example.com/", Entries: []*FeedEntry{{Content: content}}, conf: &ConfigFeed{}},
+		{Link: "https://two.example.com/", Entries: []*FeedEntry{{Content: content}}, conf: &ConfigFeed{ReplaceRelativeURLs: &off}},
+	}
+
+	resolveRelativeURLs(fs, true)
+	require.Contains(t, string(fs[0].Entries[0].Content), `href="https://one.example.com/rel"`)
+	require.Contains(t, string(fs[1].Entries[0].Content), `href="/rel"`)
+
+	on := true
+	fs[1].conf.ReplaceRelativeURLs = &on
+	resolveRelativeURLs(fs, false)
+	require.Contains(t, string(fs[1].Entries[0].Content), `href="https://two.example.com/rel"`)
+}
+
+func TestAtomFeedAuthorInheritance(t *testing.T) {
+	byt, err := os.ReadFile("test-data/feed-author.atom")
+	require.Nil(t, err)
+
+	f, err := unmarshal(byt)
+	require.Nil(t, err)
+	require.Len(t, f.Entries, 2)
+	require.Equal(t, "Ada Lovelace", f.Entries[0].Author, "inherits feed author")
+	require.Equal(t, "Charles Babbage", f.Entries[1].Author, "keeps own author")
+}
+
+func TestTimestampsByIDAndLink(t *testing.T) {
+	entries := []*FeedEntry{
+		{Title: "e1", Updated: time.Date(2022, 8, 1, 8, 0, 0, 0, time.UTC)},
+		{Title: "e2", Updated: time.Date(2022, 8, 2, 8, 0, 0, 0, time.UTC)},
+	}
+	ts := map[string]time.Time{}
+	updateTimestamps(ts, pickNewData([]*Feed{{ID: "id-1", Link: "https://Example.com/blog/", Entries: entries}}, 3, ts))
+	require.Equal(t, entries[1].Updated, ts["id-1"])
+	require.Equal(t, entries[1].Updated, ts["link:https://example.com/blog"])
+
+	nd := pickNewData([]*Feed{{ID: "id-2", Link: "https://example.com/blog", Entries: entries}}, 3, ts)
+	require.Empty(t, nd, "changed ID with stable link should not resend")
+
+	nd = pickNewData([]*Feed{{ID: "id-1", Link: "https://example.com/moved", Entries: entries}}, 3, ts)
+	require.Empty(t, nd, "changed link with stable ID should not resend")
+
+	nd = pickNewData([]*Feed{{ID: "id-3", Link: "https://example.com/other", Entries: entries}}, 3, ts)
+	require.Len(t, nd, 1)
+
+	ts = map[string]time.Time{}
+	updateTimestamps(ts, pickNewData([]*Feed{{ID: "https://example.com/blog/", Link: "https://Example.com/blog", Entries: entries}}, 3, ts))
+	require.Equal(t, map[string]time.Time{"https://example.com/blog/": entries[1].Updated}, ts, "no link key when it's the ID")
+}
+
+func TestTimestampsSharedLink(t *testing.T) {
+	var mu sync.Mutex
+	entries := map[string][]int{"posts": {3}, "comments": {1}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		id := strings.TrimPrefix(r.URL.Path, "/")
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?><feed xmlns="http://www.w3.org/2005/Atom"><title>%[1]v</title><id>%[1]v</id><link rel="alternate" href="https://example.com/"/>`, id)
+		for _, d := range entries[id] {
+			fmt.Fprintf(w, `<entry><title>%[1]v %[2]v</title><id>%[1]v-%[2]v</id><link href="https://example.com/%[1]v/%[2]v"/><updated>2022-08-0%[2]vT10:00:00Z</updated><content type="html">%[1]v</content></entry>`, id, d)
+		}
+		fmt.Fprint(w, `</feed>`)
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg := newTestConfig(t)
+	bt, err := yaml.Marshal([]*ConfigFeed{{Name: "posts", URL: srv.URL + "/posts"}, {Name: "comments", URL: srv.URL + "/comments"}})
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(cfg.FeedsFile[0], bt, 0o677))
+	msgs := captureDeliveries(t, 0)
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1)
+
+	ts, err := readTimestamps(cfg.TimestampFile)
+	require.Nil(t, err)
+	require.NotContains(t, ts, "link:https://example.com", "shared link is no key")
+
+	mu.Lock()
+	entries["comments"] = []int{1, 2}
+	mu.Unlock()
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 2)
+	require.Contains(t, (*msgs)[1].Body, "comments 2", "the other feed's later timestamp must not hide the entry")
+}
+
+func TestArchiveEntries(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "archive.csv")
+	e1 := &FeedEntry{ID: "1", Title: "Entry, one", Link: "https://example.com/1", Updated: time.Date(2022, 8, 1, 10, 0, 0, 0, time.UTC), Author: "Jane"}
+	e2 := &FeedEntry{ID: "2", Title: "Entry \"two\"", Link: "https://example.com/2", Updated: time.Date(2022, 8, 2, 10, 0, 0, 0, time.UTC)}
+	e3 := &FeedEntry{Title: "Entry three", Link: "https://example.com/3", Updated: time.Date(2022, 8, 3, 10, 0, 0, 0, time.UTC)}
+
+	require.Nil(t, archiveEntries(fn, []*Feed{{Title: "Blog", Entries: []*FeedEntry{e1, e2}}}))
+	require.Nil(t, archiveEntries(fn, []*Feed{{Title: "Blog", Entries: []*FeedEntry{e2, e3}}}))
+
+	bt, err := os.ReadFile(fn)
+	require.Nil(t, err)
+	expected := `id,feed,title,link,updated,author
+1,Blog,"Entry, one",https://example.com/1,2022-08-01T10:00:00Z,Jane
+2,Blog,"Entry ""two""",https://example.com/2,2022-08-02T10:00:00Z,
+https://example.com/3,Blog,Entry three,https://example.com/3,2022-08-03T10:00:00Z,
+`
+	require.Equal(t, expected, string(bt))
+}
+
+func TestFeedArchivesSentEntries(t *testing.T) {
+	cfg := newTestConfig(t, testRSS)
+	cfg.ArchiveFile = filepath.Join(t.TempDir(), "archive.csv")
+	msgs := captureDeliveries(t, 1)
+
+	require.NotNil(t, feed(cfg, &FeederFlags{}))
+	require.Empty(t, *msgs)
+	_, err := os.Stat(cfg.ArchiveFile)
+	require.True(t, os.IsNotExist(err), "entries that weren't sent aren't archived")
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1)
+	bt, err := os.ReadFile(cfg.ArchiveFile)
+	require.Nil(t, err)
+	require.Contains(t, string(bt), "https://example.com/1,Test Feed,Entry 1")
+	require.Contains(t, string(bt), "https://example.com/2,Test Feed,Entry 2")
+}
+
+func TestLastRunTimestamps(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "timestamps.yml")
+	require.Nil(t, writeTimestamps(fn, map[string]time.Time{
+		"5db01937": time.Date(2022, 7, 20, 1, 2, 3, 0, time.UTC),
+	}))
+	lastRun := time.Date(2022, 7, 22, 12, 0, 0, 0, time.UTC)
+	require.Nil(t, os.Chtimes(fn, lastRun, lastRun))
+
+	fs := []*Feed{
+		{
+			ID: "5db01937",
+			Entries: []*FeedEntry{
+				{ID: "old", Updated: time.Date(2022, 7, 22, 1, 2, 3, 0, time.UTC)},
+				{ID: "new", Updated: time.Date(2022, 7, 23, 1, 2, 3, 0, time.UTC)},
+			},
+		},
+		{
+			ID: "never-seen",
+			Entries: []*FeedEntry{
+				{ID: "old", Updated: time.Date(2022, 7, 21, 1, 2, 3, 0, time.UTC)},
+			},
+		},
+	}
+
+	lr, err := lastRunTime(fn)
+	require.Nil(t, err)
+	bs := uniformTimestamps(fs, lr)
+	require.Len(t, bs, 2)
+	require.True(t, lastRun.Equal(bs["5db01937"]))
+	require.True(t, lastRun.Equal(bs["never-seen"]))
+
+	nd := pickNewData(fs, 3, bs)
+	require.Len(t, nd, 1)
+	require.Len(t, nd[0].Entries, 1)
+	require.Equal(t, "new", nd[0].Entries[0].ID)
+}
+
+func TestFeedSinceLastRunWithoutTimestamps(t *testing.T) {
+	cfg := newTestConfig(t, testRSS)
+	msgs := captureDeliveries(t, 0)
+
+	err := feed(cfg, &FeederFlags{SinceLastRun: true})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to stat timestamps file")
+	require.Empty(t, *msgs)
+	_, err = os.Stat(cfg.TimestampFile)
+	require.True(t, os.IsNotExist(err), "timestamps file isn't created")
+}
+
+func TestEmailBodyChronological(t *testing.T) {
+	orig := now
+	now = func() time.Time { return time.Date(2022, 8, 2, 18, 0, 0, 0, time.Local) }
+	t.Cleanup(func() { now = orig })
+
+	fs := []*Feed{
+		{
+			Title: "Feed A",
+			Entries: []*FeedEntry{
+				{Title: "A1", Updated: time.Date(2022, 8, 1, 9, 0, 0, 0, time.Local)},
+				{Title: "A2", Updated: time.Date(2022, 8, 2, 11, 0, 0, 0, time.Local)},
+			},
+		},
+		{
+			Title: "Feed B",
+			Entries: []*FeedEntry{
+				{Title: "B1", Updated: time.Date(2022, 8, 1, 13, 0, 0, 0, time.Local)},
+				{Title: "B2", Updated: time.Date(2022, 7, 28, 8, 0, 0, 0, time.Local)},
+			},
+		},
+	}
+
+	tmpl := `{{ range .Days }}[{{ .Label }}]{{ range .Entries }} {{ .Title }}{{ end }}
+{{ end }}`
+	body, err := makeEmailBody(&Config{Chronological: true}, fs, nil, tmpl)
+	require.Nil(t, err)
+	expected := `[Thursday, 28 July 2022] B2
+[Yesterday] A1 B1
+[Today] A2
+`
+	require.Equal(t, expected, body)
+
+	body, err = makeEmailBody(&Config{Chronological: true}, fs, nil, defaultEmailTemplate)
+	require.Nil(t, err)
+	require.NotContains(t, body, "<h1 style=\"border: 1px solid #acb0bf; border-radius: 3px; background: #f4f4f4; padding: 1em; margin: 1.6em 0;\"><a", "chronological mode doesn't render feed sections")
+	order := []string{"Thursday, 28 July 2022", ">Feed B<", ">B2<", ">Yesterday<", ">Feed A<", ">A1<", ">Feed B<", ">B1<", ">Today<", ">Feed A<", ">A2<"}
+	last := 0
+	for _, o := range order {
+		idx := strings.Index(body[last:], o)
+		require.GreaterOrEqual(t, idx, 0, o)
+		last += idx + len(o)
+	}
+
+	tmpl = `{{ range .Days }}{{ range .Entries }}{{ .Title }}@{{ .FeedTitle }}({{ .FeedLink }}) {{ end }}{{ end }}`
+	fs[0].Link = "https://a.example.com"
+	fs[1].Link = "https://b.example.com"
+	body, err = makeEmailBody(&Config{Chronological: true}, fs, nil, tmpl)
+	require.Nil(t, err)
+	require.Equal(t, "B2@Feed B(https://b.example.com) A1@Feed A(https://a.example.com) B1@Feed B(https://b.example.com) A2@Feed A(https://a.example.com) ", body)
+}
+
+func TestGroupEntriesByDay(t *testing.T) {
+	es := []*FeedEntry{
+		{Title: "e3", Updated: time.Date(2022, 8, 3, 9, 0, 0, 0, time.UTC)},
+		{Title: "e1", Updated: time.Date(2022, 8, 1, 23, 30, 0, 0, time.UTC)},
+		{Title: "e4", Updated: time.Date(2022, 8, 3, 8, 0, 0, 0, time.UTC)},
+		{Title: "e2", Updated: time.Date(2022, 8, 2, 12, 0, 0, 0, time.UTC)},
+	}
+
+	titles := func(ds []*EntryDay) []string {
+		result := []string{}
+		for _, d := range ds {
+			ts := []string{}
+			for _, e := range d.Entries {
+				ts = append(ts, e.Title)
+			}
+			result = append(result, d.Date.Format("2006-01-02")+": "+strings.Join(ts, " "))
+		}
+		return result
+	}
+
+	ds := groupEntriesByDay(es, time.UTC)
+	require.Equal(t, []string{"2022-08-01: e1", "2022-08-02: e2", "2022-08-03: e4 e3"}, titles(ds))
+
+	tz := time.FixedZone("UTC+2", 2*60*60)
+	ds = groupEntriesByDay(es, tz)
+	require.Equal(t, []string{"2022-08-02: e1 e2", "2022-08-03: e4 e3"}, titles(ds))
+	require.Equal(t, tz, ds[0].Date.Location())
+
+	fs := []*Feed{{Title: "Feed", Entries: es}}
+	tmpl := `{{ range .Successes }}{{ range GroupByDay .Entries }}[{{ FormatLayoutTime "Jan 2" .Date }}]{{ range .Entries }} {{ .Title }}{{ end }}
+{{ end }}{{ end }}`
+	cfg := &Config{DisplayTimezone: "Etc/GMT-2"}
+	body, err := makeEmailBody(cfg, fs, nil, tmpl)
+	require.Nil(t, err)
+	require.Equal(t, "[Aug 2] e1 e2\n[Aug 3] e4 e3\n", body)
+
+	text, err := makeTextEmailBody(cfg, fs, nil, tmpl)
+	require.Nil(t, err)
+	require.Equal(t, body, text)
+}
+
+func TestDisplayTimezone(t *testing.T) {
+	updated := time.Date(2022, 8, 1, 23, 30, 0, 0, time.UTC)
+	fs := []*Feed{{Title: "Feed", Entries: []*FeedEntry{{Title: "e1", Updated: updated}}}}
+	tmpl := `{{ range .Successes }}{{ range .Entries }}{{ FormatTime .Updated }}|{{ FormatLayoutTime "Jan 2 15:04" .Updated }}{{ end }}{{ end }}`
+
+	body, err := makeEmailBody(&Config{}, fs, nil, tmpl)
+	require.Nil(t, err)
+	require.Equal(t, "2022-08-01 23:30 UTC|Aug 1 23:30", body, "keeps the feed's zone by default")
+
+	cfg := &Config{DisplayTimezone: "Etc/GMT-2"}
+	body, err = makeEmailBody(cfg, fs, nil, tmpl)
+	require.Nil(t, err)
+	require.Equal(t, "2022-08-02 01:30 &#43;02|Aug 2 01:30", body)
+
+	text, err := makeTextEmailBody(cfg, fs, nil, defaultTextEmailTemplate)
+	require.Nil(t, err)
+	require.Contains(t, text, "(2022-08-02 01:30 +02)")
+
+	body, err = makeEmailBody(cfg, fs, nil, defaultEmailTemplate)
+	require.Nil(t, err)
+	require.Contains(t, body, ">2022-08-02 01:30 &#43;02</span>")
+}
+
+func TestReadConfigStrict(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "config.yml")
+	cfg := `feeds-file: feeds.yml
+timestamp-file: timestamps.yml
+max-entires-per-feed: 5
+email:
+  from: hans@example.com
+  smtp:
+    host: example.com
+    port: 587
+    user: hans@example.com
+    pass: password
+`
+	require.Nil(t, os.WriteFile(fn, []byte(cfg), 0o600))
+
+	_, err := readConfig(fn, true)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "max-entires-per-feed")
+
+	lenient, err := readConfig(fn, false)
+	require.Nil(t, err)
+	require.Equal(t, StringList{"feeds.yml"}, lenient.FeedsFile)
+	require.Equal(t, 3, lenient.MaxEntriesPerFeed)
+}
+
+func TestReadConfigLenientInvalid(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "config.yml")
+	cfg := `feeds-file: feeds.yml
+timestamp-file: timestamps.yml
+max-entries-per-feed: many
+email:
+  from: hans@example.com
+  smtp:
+    host: example.com
+    port: 587
+    user: hans@example.com
+    pass: password
+`
+	require.Nil(t, os.WriteFile(fn, []byte(cfg), 0o600))
+
+	_, err := readConfig(fn, false)
+	require.NotNil(t, err, "invalid values aren't ignored like unknown keys")
+	require.Contains(t, err.Error(), "many")
+}
+
+func TestReadConfigRetries(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "config.yml")
+	cfg := `feeds-file: feeds.yml
+timestamp-file: timestamps.yml
+output-file: out.html
+email:
+  from: hans@example.com
+`
+	require.Nil(t, os.WriteFile(fn, []byte(cfg), 0o600))
+
+	c, err := readConfig(fn, true)
+	require.Nil(t, err)
+	require.Equal(t, 3, c.Retries)
+	require.Equal(t, 2, c.SendRetries)
+
+	require.Nil(t, os.WriteFile(fn, []byte(cfg+"retries: 0\nsend-retries: 0\n"), 0o600))
+	c, err = readConfig(fn, true)
+	require.Nil(t, err)
+	require.Equal(t, 0, c.Retries, "0 disables retries")
+	require.Equal(t, 0, c.SendRetries, "0 disables retries")
+}
+
+func TestReadConfigFromStdin(t *testing.T) {
+	feeds := newTestConfig(t, testRSS)
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out.html")
+	cfg := fmt.Sprintf(`feeds-file: %s
+timestamp-file: %s
+output-file: %s
+email:
+  from: hans@example.com
+`, feeds.FeedsFile[0], filepath.Join(dir, "timestamps.yml"), out)
+
+	orig := stdin
+	stdin = strings.NewReader(cfg)
+	t.Cleanup(func() { stdin = orig })
+
+	c, err := readConfig("-", true)
+	require.Nil(t, err)
+	require.Equal(t, StringList{feeds.FeedsFile[0]}, c.FeedsFile)
+	require.Equal(t, out, c.OutputFile)
+
+	require.Nil(t, feed(c, &FeederFlags{}))
+	byt, err := os.ReadFile(out)
+	require.Nil(t, err)
+	require.Contains(t, string(byt), "Entry 2")
+}
+
+func TestFeedCookiesAndHeaders(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie("cf_clearance")
+		if err != nil || c.Value != "5db01937" || r.Header.Get("X-Bypass") != "yes" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "<html><body>checking your browser</body></html>")
+			return
+		}
+		fmt.Fprint(w, testRSS)
+	}))
+	t.Cleanup(srv.Close)
+
+	_, err := downloadFeed(&Config{}, &ConfigFeed{URL: srv.URL})
+	require.NotNil(t, err)
+
+	fc := &ConfigFeed{
+		URL:     srv.URL,
+		Headers: map[string]string{"X-Bypass": "yes"},
+		Cookies: map[string]string{"cf_clearance": "5db01937"},
+	}
+	f, err := downloadFeed(&Config{}, fc)
+	require.Nil(t, err)
+	require.Len(t, f.Entries, 2)
+}
+
+func TestFeedAuthorization(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		switch {
+		case r.URL.Path == "/basic" && ok && user == "hans" && pass == "s3cret":
+		case r.URL.Path == "/bearer" && r.Header.Get("Authorization") == "Bearer t0ken":
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, testRSS)
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg := &Config{EmptyFeedIsFailure: true}
+	for _, path := range []string{"/basic", "/bearer"} {
+		_, err := downloadFeed(cfg, &ConfigFeed{URL: srv.URL + path})
+		require.NotNil(t, err, path)
+	}
+
+	_, err := downloadFeed(cfg, &ConfigFeed{URL: srv.URL + "/basic", Username: "hans", Password: "wrong"})
+	require.NotNil(t, err)
+	require.NotContains(t, err.Error(), "wrong")
+
+	f, err := downloadFeed(cfg, &ConfigFeed{URL: srv.URL + "/basic", Username: "hans", Password: "s3cret"})
+	require.Nil(t, err)
+	require.Len(t, f.Entries, 2)
+
+	f, err = downloadFeed(cfg, &ConfigFeed{URL: srv.URL + "/bearer", BearerToken: "t0ken"})
+	require.Nil(t, err)
+	require.Len(t, f.Entries, 2)
+
+	_, err = downloadFeed(cfg, &ConfigFeed{URL: srv.URL + "/bearer", Username: "hans", Password: "s3cret"})
+	require.NotNil(t, err)
+
+	byt, err := json.Marshal(&ConfigFeed{URL: srv.URL, Username: "hans", Password: "s3cret", BearerToken: "t0ken"})
+	require.Nil(t, err)
+	require.NotContains(t, string(byt), "s3cret")
+	require.NotContains(t, string(byt), "t0ken")
+}
+
+func TestUserAgent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.ReplaceAll(testRSS, "Test Feed", r.UserAgent()))
+	}))
+	t.Cleanup(srv.Close)
+
+	download := func(cfg *Config, fc *ConfigFeed) string {
+		f, err := downloadFeed(cfg, fc)
+		require.Nil(t, err)
+		return f.Title
+	}
+
+	require.Equal(t, UserAgent, download(&Config{}, &ConfigFeed{URL: srv.URL}))
+	require.Equal(t, "Mozilla/5.0", download(&Config{UserAgent: "Mozilla/5.0"}, &ConfigFeed{URL: srv.URL}))
+	require.Equal(t, "Feed/1.0", download(&Config{UserAgent: "Mozilla/5.0"}, &ConfigFeed{URL: srv.URL, UserAgent: "Feed/1.0"}))
+	require.Equal(t, "Feed/1.0", download(&Config{}, &ConfigFeed{URL: srv.URL, UserAgent: "Feed/1.0"}))
+}
+
+func TestDedupBySimilarity(t *testing.T) {
+	entries := func() []*FeedEntry {
+		return []*FeedEntry{
+			{Title: "Go 1.19 is released", Link: "https://a.example.com/go", Content: "<p>The Go team announced Go 1.19 today, with a revised memory model and doc comment improvements.</p>"},
+			{Title: "Go 1.19 released", Link: "https://b.example.com/go", Content: "<p>The Go team announced Go 1.19 today, with a revised memory model and doc comment improvements!</p>"},
+			{Title: "Rust 1.62 is released", Link: "https://a.example.com/rust", Content: "<p>The Rust team shipped a new version with cargo add and default enum variants.</p>"},
+		}
+	}
+
+	sim := jaccard(shingles(entries()[0]), shingles(entries()[1]))
+	require.Greater(t, sim, 0.7)
+	require.Less(t, sim, 0.95)
+	require.Less(t, jaccard(shingles(entries()[0]), shingles(entries()[2])), 0.2)
+
+	links := func(f *Feed) []string {
+		result := []string{}
+		for _, e := range f.Entries {
+			result = append(result, e.Link)
+		}
+		return result
+	}
+
+	f := &Feed{Title: "Aggregator", Entries: entries()}
+	dedupBySimilarity([]*Feed{f}, 0.7)
+	require.Equal(t, []string{"https://a.example.com/go", "https://a.example.com/rust"}, links(f), "near-duplicates collapse into the first")
+
+	f = &Feed{Title: "Aggregator", Entries: entries()}
+	dedupBySimilarity([]*Feed{f}, 0.95)
+	require.Len(t, f.Entries, 3, "entries are kept when they're less similar than required")
+
+	require.Equal(t, 1.0, jaccard(shingles(&FeedEntry{Title: "Same"}), shingles(&FeedEntry{Title: "same!"})))
+	require.Equal(t, 0.0, jaccard(shingles(&FeedEntry{}), shingles(&FeedEntry{})))
+}
+
+func TestDedupByTitle(t *testing.T) {
+	fs := []*Feed{
+		{
+			Title: "Test Feed",
+			Entries: []*FeedEntry{
+				{Title: "Big News: Go 2 Released!", Link: "https://example.com/go2?utm_source=rss"},
+				{Title: "Something else", Link: "https://example.com/else"},
+				{Title: "big news -- go 2 released", Link: "https://m.example.com/go2"},
+			},
+		},
+		{
+			Title: "Other Feed",
+			Entries: []*FeedEntry{
+				{Title: "Big News: Go 2 Released!", Link: "https://other.com/go2"},
+			},
+		},
+	}
+
+	dedupByTitle(fs)
+	require.Len(t, fs[0].Entries, 2)
+	require.Equal(t, "https://example.com/go2?utm_source=rss", fs[0].Entries[0].Link)
+	require.Equal(t, "https://example.com/else", fs[0].Entries[1].Link)
+	require.Len(t, fs[1].Entries, 1, "dedup is per feed")
+}
+
+func TestFilterEntriesByAuthor(t *testing.T) {
+	newFeed := func(fc *ConfigFeed) *Feed {
+		return &Feed{
+			Title: "Multi Author Blog",
+			Entries: []*FeedEntry{
+				{ID: "1", Author: "Jane Doe"},
+				{ID: "2", Author: "john doe"},
+				{ID: "3", Author: "Someone Else"},
+				{ID: "4"},
+			},
+			conf: fc,
+		}
+	}
+	ids := func(f *Feed) []string {
+		r := []string{}
+		for _, e := range f.Entries {
+			r = append(r, e.ID)
+		}
+		return r
+	}
+
+	td := map[string]struct {
+		conf     *ConfigFeed
+		expected []string
+	}{
+		"no filters": {
+			conf:     &ConfigFeed{},
+			expected: []string{"1", "2", "3", "4"},
+		},
+		"include": {
+			conf:     &ConfigFeed{IncludeAuthors: []string{"JANE DOE", "John Doe"}},
+			expected: []string{"1", "2", "4"},
+		},
+		"exclude": {
+			conf:     &ConfigFeed{ExcludeAuthors: []string{"someone else"}},
+			expected: []string{"1", "2", "4"},
+		},
+		"include and exclude": {
+			conf:     &ConfigFeed{IncludeAuthors: []string{"jane doe", "john doe"}, ExcludeAuthors: []string{"john doe"}},
+			expected: []string{"1", "4"},
+		},
+	}
+
+	for tn, tc := range td {
+		f := newFeed(tc.conf)
+		filterEntries([]*Feed{f})
+		require.Equal(t, tc.expected, ids(f), tn)
+	}
+}
+
+func TestFilterEntriesByKeywords(t *testing.T) {
+	newFeed := func(fc *ConfigFeed) *Feed {
+		return &Feed{
+			Title: "News",
+			Entries: []*FeedEntry{
+				{ID: "1", Title: "Go 1.21 released"},
+				{ID: "2", Title: "Election results", Content: "<p>Votes for <b>Golang</b> party</p>"},
+				{ID: "3", Title: "Football scores"},
+				{ID: "4", Title: "Rust and Go compared", Content: "sponsored"},
+			},
+			conf: fc,
+		}
+	}
+	ids := func(f *Feed) []string {
+		r := []string{}
+		for _, e := range f.Entries {
+			r = append(r, e.ID)
+		}
+		return r
+	}
+
+	td := map[string]struct {
+		conf     *ConfigFeed
+		expected []string
+	}{
+		"include": {
+			conf:     &ConfigFeed{Include: []string{"GO"}},
+			expected: []string{"1", "2", "4"},
+		},
+		"include regex": {
+			conf:     &ConfigFeed{Include: []string{`/\bgo\b/`}},
+			expected: []string{"1", "4"},
+		},
+		"exclude": {
+			conf:     &ConfigFeed{Exclude: []string{"football", "Sponsored"}},
+			expected: []string{"1", "2"},
+		},
+		"include and exclude": {
+			conf:     &ConfigFeed{Include: []string{"go"}, Exclude: []string{"/^election/"}},
+			expected: []string{"1", "4"},
+		},
+	}
+
+	for tn, tc := range td {
+		f := newFeed(tc.conf)
+		filterEntries([]*Feed{f})
+		require.Equal(t, tc.expected, ids(f), tn)
+	}
+
+	f := newFeed(&ConfigFeed{Include: []string{"go"}})
+	filterEntries([]*Feed{f})
+	nd := pickNewData([]*Feed{f}, 2, map[string]time.Time{})
+	require.Len(t, nd[0].Entries, 2, "filtered entries don't count toward the limit")
+	for _, e := range nd[0].Entries {
+		require.Contains(t, strings.ToLower(e.Title+string(e.Content)), "go")
+	}
+
+	fp := filepath.Join(t.TempDir(), "feeds.yml")
+	require.Nil(t, os.WriteFile(fp, []byte("- url: https://example.com\n  exclude: ['/(/']\n"), 0o644))
+	_, err := readFeedsConfig(fp)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid include, exclude or boost pattern")
+}
+
+func TestBoostKeywords(t *testing.T) {
+	f := &Feed{
+		Title: "News",
+		Entries: []*FeedEntry{
+			{ID: "1", Title: "Weather", Updated: time.Date(2022, 8, 1, 8, 0, 0, 0, time.UTC)},
+			{ID: "2", Title: "Go release", Updated: time.Date(2022, 8, 1, 9, 0, 0, 0, time.UTC)},
+			{ID: "3", Title: "Sports", Updated: time.Date(2022, 8, 1, 10, 0, 0, 0, time.UTC)},
+			{ID: "4", Title: "Security", Content: "<p>Patch your <b>go</b> toolchain</p>", Updated: time.Date(2022, 8, 1, 11, 0, 0, 0, time.UTC)},
+		},
+		conf: &ConfigFeed{BoostKeywords: []string{`/\bgo\b/`}},
+	}
+
+	nd := pickNewData([]*Feed{f}, 10, map[string]time.Time{})
+	ids := []string{}
+	for _, e := range nd[0].Entries {
+		ids = append(ids, e.ID)
+	}
+	require.Equal(t, []string{"2", "4", "1", "3"}, ids, "boosted entries first, then by time")
+	require.True(t, nd[0].Entries[0].Boosted)
+	require.False(t, nd[0].Entries[2].Boosted)
+	require.False(t, f.Entries[1].Boosted, "downloaded entries aren't modified")
+
+	body, err := makeEmailBody(&Config{}, nd, nil, defaultEmailTemplate)
+	require.Nil(t, err)
+	require.Equal(t, 2, strings.Count(body, "&#9733;"))
+	require.Less(t, strings.Index(body, ">Security</a>"), strings.Index(body, ">Weather</a>"))
+
+	text, err := makeTextEmailBody(&Config{}, nd, nil, defaultTextEmailTemplate)
+	require.Nil(t, err)
+	require.Contains(t, text, "* ★ Go release")
+	require.Contains(t, text, "* Weather")
+}
+
+func TestSaveRawFeeds(t *testing.T) {
+	cfg := newTestConfig(t, testRSS, strings.Replace(testRSS, "Test Feed", "Other Feed", 1))
+	cfg.SaveRawFeeds = filepath.Join(t.TempDir(), "raw")
+	fs, err := readFeedsConfig(cfg.FeedsFile[0])
+	require.Nil(t, err)
+	fs[1].Name = "Other Feed: Special/Chars"
+
+	succs, fails := downloadFeeds(cfg, fs)
+	require.Len(t, succs, 2)
+	require.Len(t, fails, 0)
+
+	byt, err := os.ReadFile(filepath.Join(cfg.SaveRawFeeds, "feed-0.raw"))
+	require.Nil(t, err)
+	require.Equal(t, testRSS, string(byt))
+
+	byt, err = os.ReadFile(filepath.Join(cfg.SaveRawFeeds, "other-feed-special-chars.raw"))
+	require.Nil(t, err)
+	require.Contains(t, string(byt), "Other Feed")
+}
+
+// newGrowingFeedServer serves an RSS feed that gains a new entry with every request.
+func newGrowingFeedServer(t *testing.T) *httptest.Server {
+	var mu sync.Mutex
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests += 1
+		n := requests
+		mu.Unlock()
+
+		fmt.Fprint(w, `<?xml version="1.0"?><rss version="2.0"><channel><title>Growing</title><link>https://example.com/</link>`)
+		for i := 1; i <= n; i++ {
+			pub := time.Date(2022, 8, 1, i, 0, 0, 0, time.UTC).Format(time.RFC1123Z)
+			fmt.Fprintf(w, `<item><title>Entry %v</title><guid>%v</guid><pubDate>%v</pubDate></item>`, i, i, pub)
+		}
+		fmt.Fprint(w, `</channel></rss>`)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestLoop(t *testing.T) {
+	srv := newGrowingFeedServer(t)
+	cfg := newTestConfig(t)
+	bt, err := yaml.Marshal([]*ConfigFeed{{Name: "growing", URL: srv.URL}})
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(cfg.FeedsFile[0], bt, 0o677))
+
+	stop := make(chan os.Signal, 1)
+	bodies := []string{}
+	orig := deliver
+	deliver = func(cfg ConfigEmail, msg *message) error {
+		bodies = append(bodies, msg.Body)
+		if len(bodies) == 2 {
+			stop <- os.Interrupt
+		}
+		return nil
+	}
+	t.Cleanup(func() { deliver = orig })
+
+	loop(cfg, &FeederFlags{Loop: time.Millisecond}, stop, func(err error) { t.Fatal(err) })
+	require.Len(t, bodies, 2)
+	require.Contains(t, bodies[0], "Entry 1")
+	require.Contains(t, bodies[1], "Entry 2")
+	require.NotContains(t, bodies[1], "Entry 1")
+}
+
+func TestFeedRecipients(t *testing.T) {
+	cfg := newTestConfig(t, testRSS, strings.Replace(testRSS, "Test Feed", "Work Feed", 1), "not a feed")
+	fs, err := readFeedsConfig(cfg.FeedsFile[0])
+	require.Nil(t, err)
+	fs[1].To = "work@example.com"
+	fs[2].To = "work@example.com"
+	bt, err := yaml.Marshal(fs)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(cfg.FeedsFile[0], bt, 0o677))
+	msgs := captureDeliveries(t, 0)
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 2)
+
+	byTo := map[string]string{}
+	for _, m := range *msgs {
+		byTo[m.To] = m.Body
+	}
+	require.Contains(t, byTo["hans@example.com"], "Test Feed")
+	require.NotContains(t, byTo["hans@example.com"], "Work Feed")
+	require.NotContains(t, byTo["hans@example.com"], "feed-2")
+	require.Contains(t, byTo["work@example.com"], "Work Feed")
+	require.Contains(t, byTo["work@example.com"], "feed-2", "failures go to the feed's recipient")
+	require.NotContains(t, byTo["work@example.com"], "Test Feed")
+}
+
+func TestItemLevelMedia(t *testing.T) {
+	byt, err := os.ReadFile("test-data/item-media.rss")
+	require.Nil(t, err)
+
+	f, err := unmarshal(byt)
+	require.Nil(t, err)
+	require.Len(t, f.Entries, 3)
+	require.Equal(t, `The rover found traces of water.<div><img src="https://news.example.com/img/rover-thumb.jpg" width="240" height="135" /></div>`, string(f.Entries[0].Content))
+	require.Equal(t, "https://news.example.com/img/rover-thumb.jpg", f.Entries[0].Thumbnail)
+	require.Equal(t, `The bridge is open again.<div><a href="https://news.example.com/img/bridge.jpg"><img src="https://news.example.com/img/bridge.jpg" width="640" height="360" /></a></div>`, string(f.Entries[1].Content))
+	require.Equal(t, "Just text.", string(f.Entries[2].Content))
+	require.Equal(t, "", f.Entries[2].Thumbnail)
+
+	byt, err = os.ReadFile("test-data/item-media.atom")
+	require.Nil(t, err)
+
+	f, err = unmarshal(byt)
+	require.Nil(t, err)
+	require.Len(t, f.Entries, 1)
+	require.Equal(t, `<div><a href="https://gallery.example.com/sunset.mp4"><img src="https://gallery.example.com/sunset.jpg" width="320" height="180" /></a></div>`, string(f.Entries[0].Content))
+
+	body, err := makeEmailBody(&Config{}, []*Feed{f}, nil, defaultEmailTemplate)
+	require.Nil(t, err)
+	require.Contains(t, body, `<img src="https://gallery.example.com/sunset.jpg"`)
+}
+
+func TestMinSendInterval(t *testing.T) {
+	srv := newGrowingFeedServer(t)
+	cfg := newTestConfig(t)
+	bt, err := yaml.Marshal([]*ConfigFeed{{Name: "growing", URL: srv.URL}})
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(cfg.FeedsFile[0], bt, 0o677))
+	cfg.MinSendInterval = time.Hour
+	msgs := captureDeliveries(t, 0)
+
+	clock := time.Date(2022, 8, 3, 8, 0, 0, 0, time.UTC)
+	orig := now
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { now = orig })
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1)
+	require.Contains(t, (*msgs)[0].Body, "Entry 1")
+
+	clock = clock.Add(10 * time.Minute)
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1, "second run within interval should defer")
+
+	clock = clock.Add(time.Hour)
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 2)
+	require.Contains(t, (*msgs)[1].Body, "Entry 2", "deferred entries are sent")
+
+	st, err := readState(cfg.stateFile())
+	require.Nil(t, err)
+	require.True(t, clock.Equal(st.LastSend))
+}
+
+func TestSendDays(t *testing.T) {
+	srv := newGrowingFeedServer(t)
+	cfg := newTestConfig(t)
+	bt, err := yaml.Marshal([]*ConfigFeed{{Name: "growing", URL: srv.URL}})
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(cfg.FeedsFile[0], bt, 0o677))
+	cfg.SendDays = []string{"Mon", "tuesday", "wed", "thu", "Friday"}
+	cfg.MaxEntriesPerFeed = 1
+	msgs := captureDeliveries(t, 0)
+
+	clock := time.Date(2022, 8, 6, 8, 0, 0, 0, time.UTC) // Saturday
+	orig := now
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { now = orig })
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	clock = clock.Add(24 * time.Hour)
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Empty(t, *msgs, "no emails on weekends")
+
+	st, err := readState(cfg.stateFile())
+	require.Nil(t, err)
+	require.Len(t, st.Spool[srv.URL].Entries, 2)
+
+	clock = clock.Add(24 * time.Hour)
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1)
+	for _, e := range []string{"Entry 1", "Entry 2", "Entry 3"} {
+		require.Contains(t, (*msgs)[0].Body, e, "spooled entries are sent on monday")
+	}
+
+	st, err = readState(cfg.stateFile())
+	require.Nil(t, err)
+	require.Empty(t, st.Spool)
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 2)
+	require.Contains(t, (*msgs)[1].Body, "Entry 4")
+	require.NotContains(t, (*msgs)[1].Body, "Entry 3")
+}
+
+func TestSendDaysExitNonzeroOnFailures(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "not a feed")
+	}))
+	t.Cleanup(broken.Close)
+	cfg := newTestConfig(t, testRSS)
+	fcs := []*ConfigFeed{}
+	bt, err := os.ReadFile(cfg.FeedsFile[0])
+	require.Nil(t, err)
+	require.Nil(t, yaml.Unmarshal(bt, &fcs))
+	bt, err = yaml.Marshal(append(fcs, &ConfigFeed{Name: "broken", URL: broken.URL}))
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(cfg.FeedsFile[0], bt, 0o677))
+	cfg.SendDays = []string{"Mon"}
+	cfg.ExitNonzeroOnFailures = true
+	msgs := captureDeliveries(t, 0)
+
+	clock := time.Date(2022, 8, 6, 8, 0, 0, 0, time.UTC) // Saturday
+	orig := now
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { now = orig })
+
+	err = feed(cfg, &FeederFlags{})
+	require.ErrorIs(t, err, ErrFeedFailures, "failures count on days without emails too")
+	require.Empty(t, *msgs)
+
+	clock = clock.Add(48 * time.Hour)
+	err = feed(cfg, &FeederFlags{})
+	require.ErrorIs(t, err, ErrFeedFailures)
+	require.Len(t, *msgs, 1)
+}
+
+func TestSendDaysWithoutIDs(t *testing.T) {
+	var mu sync.Mutex
+	items := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprint(w, `<?xml version="1.0"?><rss version="2.0"><channel><title>No GUIDs</title><link>https://example.com/</link>`)
+		for i, it := range items {
+			pub := time.Date(2022, 8, 1, i+1, 0, 0, 0, time.UTC).Format(time.RFC1123Z)
+			fmt.Fprintf(w, `<item><title>Entry %v</title><link>https://example.com/%v</link><pubDate>%v</pubDate></item>`, it, it, pub)
+		}
+		fmt.Fprint(w, `</channel></rss>`)
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg := newTestConfig(t)
+	bt, err := yaml.Marshal([]*ConfigFeed{{Name: "no-guids", URL: srv.URL}})
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(cfg.FeedsFile[0], bt, 0o677))
+	cfg.SendDays = []string{"Mon"}
+	msgs := captureDeliveries(t, 0)
+
+	clock := time.Date(2022, 8, 6, 8, 0, 0, 0, time.UTC) // Saturday
+	orig := now
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { now = orig })
+
+	mu.Lock()
+	items = []string{"A"}
+	mu.Unlock()
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+
+	clock = clock.Add(24 * time.Hour)
+	mu.Lock()
+	items = []string{"A", "B"}
+	mu.Unlock()
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Empty(t, *msgs)
+
+	st, err := readState(cfg.stateFile())
+	require.Nil(t, err)
+	require.Len(t, st.Spool[srv.URL].Entries, 2, "entries without ID are spooled separately")
+
+	clock = clock.Add(24 * time.Hour)
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1)
+	require.Contains(t, (*msgs)[0].Body, "Entry A")
+	require.Contains(t, (*msgs)[0].Body, "Entry B")
+}
+
+func TestDedupWindow(t *testing.T) {
+	var mu sync.Mutex
+	items := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprint(w, `<?xml version="1.0"?><rss version="2.0"><channel><title>Flaky</title><link>https://example.com/</link>`)
+		for id, hour := range items {
+			pub := time.Date(2022, 8, 1, hour, 0, 0, 0, time.UTC).Format(time.RFC1123Z)
+			fmt.Fprintf(w, `<item><title>Entry %v</title><guid>%v</guid><pubDate>%v</pubDate></item>`, id, id, pub)
+		}
+		fmt.Fprint(w, `</channel></rss>`)
+	}))
+	t.Cleanup(srv.Close)
+	set := func(is map[string]int) {
+		mu.Lock()
+		defer mu.Unlock()
+		items = is
+	}
+
+	cfg := newTestConfig(t)
+	bt, err := yaml.Marshal([]*ConfigFeed{{Name: "flaky", URL: srv.URL}})
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(cfg.FeedsFile[0], bt, 0o677))
+	cfg.DedupWindowRuns = 2
+	msgs := captureDeliveries(t, 0)
+
+	set(map[string]int{"A": 1})
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1)
+	require.Contains(t, (*msgs)[0].Body, "Entry A")
+
+	set(map[string]int{})
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+
+	set(map[string]int{"A": 2, "B": 3})
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 2)
+	require.Contains(t, (*msgs)[1].Body, "Entry B")
+	require.NotContains(t, (*msgs)[1].Body, "Entry A", "reappearing entry within window isn't sent again")
+
+	set(map[string]int{})
+	for i := 0; i < 3; i++ {
+		require.Nil(t, feed(cfg, &FeederFlags{}))
+	}
+
+	st, err := readState(cfg.stateFile())
+	require.Nil(t, err)
+	require.Empty(t, st.Seen, "entries outside of the window are pruned")
+
+	set(map[string]int{"A": 4})
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 3)
+	require.Contains(t, (*msgs)[2].Body, "Entry A")
+}
+
+func TestDedupWindowWithoutIDs(t *testing.T) {
+	var mu sync.Mutex
+	items := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprint(w, `<?xml version="1.0"?><rss version="2.0"><channel><title>No GUIDs</title><link>https://example.com/</link>`)
+		for i, it := range items {
+			pub := time.Date(2022, 8, 1, i+1, 0, 0, 0, time.UTC).Format(time.RFC1123Z)
+			fmt.Fprintf(w, `<item><title>Entry %v</title><link>https://example.com/%v</link><pubDate>%v</pubDate></item>`, it, it, pub)
+		}
+		fmt.Fprint(w, `</channel></rss>`)
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg := newTestConfig(t)
+	bt, err := yaml.Marshal([]*ConfigFeed{{Name: "no-guids", URL: srv.URL}})
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(cfg.FeedsFile[0], bt, 0o677))
+	cfg.DedupWindowRuns = 5
+	msgs := captureDeliveries(t, 0)
+
+	items = []string{"A"}
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1)
+	require.Contains(t, (*msgs)[0].Body, "Entry A")
+
+	mu.Lock()
+	items = []string{"A", "B"}
+	mu.Unlock()
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 2)
+	require.Contains(t, (*msgs)[1].Body, "Entry B")
+	require.NotContains(t, (*msgs)[1].Body, "Entry A")
+}
+
+func TestDedupByID(t *testing.T) {
+	var mu sync.Mutex
+	hour := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		pub := time.Date(2022, 8, 1, hour, 0, 0, 0, time.UTC).Format(time.RFC1123Z)
+		fmt.Fprintf(w, `<?xml version="1.0"?><rss version="2.0"><channel><title>Republishing</title><link>https://example.com/</link>
+<item><title>Story</title><guid>story</guid><pubDate>%v</pubDate></item>
+<item><title>No GUID</title><link>https://example.com/no-guid</link><pubDate>%v</pubDate></item>
+</channel></rss>`, pub, pub)
+	}))
+	t.Cleanup(srv.Close)
+	republish := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		hour += 1
+	}
+
+	for _, dedup := range []bool{false, true} {
+		cfg := newTestConfig(t)
+		bt, err := yaml.Marshal([]*ConfigFeed{{Name: "republishing", URL: srv.URL}})
+		require.Nil(t, err)
+		require.Nil(t, os.WriteFile(cfg.FeedsFile[0], bt, 0o677))
+		cfg.DedupByID = dedup
+		msgs := captureDeliveries(t, 0)
+
+		require.Nil(t, feed(cfg, &FeederFlags{}))
+		require.Len(t, *msgs, 1)
+		require.Contains(t, (*msgs)[0].Body, "Story")
+		require.Contains(t, (*msgs)[0].Body, "No GUID")
+
+		republish()
+		require.Nil(t, feed(cfg, &FeederFlags{}))
+		if !dedup {
+			require.Len(t, *msgs, 2, "republished entries are sent again by default")
+			continue
+		}
+		require.Len(t, *msgs, 1, "republished entries aren't sent again")
+
+		st, err := readState(cfg.stateFile())
+		require.Nil(t, err)
+		require.Len(t, st.SentIDs[srv.URL], 2)
+	}
+}
+
+func TestSkipUnchangedContent(t *testing.T) {
+	var mu sync.Mutex
+	hour, content := 1, "First version"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		pub := time.Date(2022, 8, 1, hour, 0, 0, 0, time.UTC).Format(time.RFC1123Z)
+		fmt.Fprintf(w, `<?xml version="1.0"?><rss version="2.0"><channel><title>Updating</title><link>https://example.com/</link>
+<item><title>Story</title><guid>story</guid><pubDate>%v</pubDate><description>&lt;p&gt;%v&lt;/p&gt;</description></item>
+</channel></rss>`, pub, content)
+	}))
+	t.Cleanup(srv.Close)
+	update := func(c string) {
+		mu.Lock()
+		defer mu.Unlock()
+		hour += 1
+		content = c
+	}
+
+	cfg := newTestConfig(t)
+	bt, err := yaml.Marshal([]*ConfigFeed{{Name: "updating", URL: srv.URL}})
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(cfg.FeedsFile[0], bt, 0o677))
+	cfg.SkipUnchangedContent = true
+	cfg.SanitizeHTML = true
+	cfg.MaxContentChars = 5
+	msgs := captureDeliveries(t, 0)
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1)
+	require.Contains(t, (*msgs)[0].Body, "First")
+
+	update("First version")
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1, "updated entry with unchanged content isn't sent again")
+
+	update("Second version")
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 2, "updated entry with changed content is sent again")
+	require.Contains(t, (*msgs)[1].Body, "Secon")
+
+	update("Second version")
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 2)
+
+	st, err := readState(cfg.stateFile())
+	require.Nil(t, err)
+	require.Len(t, st.ContentHashes[srv.URL], 1)
+}
+
+func TestFeedFormatChange(t *testing.T) {
+	item := func(format string, i int) string {
+		link := fmt.Sprintf("https://example.com/%v", i)
+		if format == "rdf" {
+			return fmt.Sprintf(`<item rdf:about="%v"><title>Entry %v</title><link>%v</link><dc:date>2022-08-0%vT08:00:00+00:00</dc:date></item>`, link, i, link, i)
+		}
+		return fmt.Sprintf(`<item><title>Entry %v</title><link>%v</link><guid>%v</guid><pubDate>%v</pubDate></item>`, i, link, link, time.Date(2022, 8, i, 8, 0, 0, 0, time.UTC).Format(time.RFC1123Z))
+	}
+
+	var mu sync.Mutex
+	format, count := "rss", 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if format == "rdf" {
+			fmt.Fprint(w, `<?xml version="1.0"?><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#" xmlns="http://purl.org/rss/1.0/" xmlns:dc="http://purl.org/dc/elements/1.1/">
+<channel rdf:about="https://example.com/"><title>Flipping</title><link>https://example.com/</link></channel>`)
+			for i := 1; i <= count; i++ {
+				fmt.Fprint(w, item(format, i))
+			}
+			fmt.Fprint(w, `</rdf:RDF>`)
+			return
+		}
+		fmt.Fprint(w, `<?xml version="1.0"?><rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom"><channel><title>Flipping</title>
+<link>https://example.com/feed.rss</link><atom:link href="https://example.com/feed.rss?format=rss" rel="self"/>`)
+		for i := 1; i <= count; i++ {
+			fmt.Fprint(w, item(format, i))
+		}
+		fmt.Fprint(w, `</channel></rss>`)
+	}))
+	t.Cleanup(srv.Close)
+	serve := func(f string, c int) {
+		mu.Lock()
+		defer mu.Unlock()
+		format, count = f, c
+	}
+
+	cfg := newTestConfig(t)
+	bt, err := yaml.Marshal([]*ConfigFeed{{Name: "flipping", URL: srv.URL}})
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(cfg.FeedsFile[0], bt, 0o677))
+	msgs := captureDeliveries(t, 0)
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1)
+
+	serve("rdf", 2)
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1, "format change doesn't resend entries")
+
+	st, err := readState(cfg.stateFile())
+	require.Nil(t, err)
+	require.Equal(t, "rdf", st.Feeds[srv.URL].Format)
+
+	serve("rdf", 3)
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 2)
+	require.Contains(t, (*msgs)[1].Body, "Entry 3")
+	require.NotContains(t, (*msgs)[1].Body, "Entry 2")
+
+	serve("rss", 3)
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 2, "changing back doesn't resend entries either")
+}
+
+func TestOpenGraphPreviews(t *testing.T) {
+	page := `<html><head>
+<meta property="og:title" content="Page &amp; Title">
+<meta property="og:description" content="A description.">
+<meta property="og:image" content="https://example.com/image.png">
+</head><body></body></html>`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, page)
+	}))
+	t.Cleanup(srv.Close)
+
+	fs := []*Feed{{
+		Title: "Links",
+		Entries: []*FeedEntry{
+			{Title: "Link only", Link: srv.URL + "/page"},
+			{Title: "With content", Link: srv.URL + "/other", Content: "<p>Existing</p>"},
+		},
+	}}
+	addOpenGraphPreviews(&Config{}, fs)
+
+	require.Equal(t,
+		template.HTML(`<div class="preview"><a href="`+srv.URL+`/page"><img src="https://example.com/image.png" style="max-width: 100%"></a>`+
+			`<h3><a href="`+srv.URL+`/page">Page &amp; Title</a></h3><p>A description.</p></div>`),
+		fs[0].Entries[0].Content,
+	)
+	require.Equal(t, template.HTML("<p>Existing</p>"), fs[0].Entries[1].Content)
+}
+
+func TestSanitizeHTMLAllowlist(t *testing.T) {
+	in := `<div onclick="x()"><p class="a">Hello <em>there</em> <a href="javascript:alert(1)" title="t">link</a></p>` +
+		`<script>alert(1)</script><img src="https://example.com/a.png" alt="a"><!-- note --></div>`
+
+	tags, attrs := (&Config{}).htmlAllowlist()
+	out, err := sanitizeHTML(in, tags, attrs)
+	require.Nil(t, err)
+	require.Equal(t, `<div><p>Hello <em>there</em> <a title="t">link</a></p><img src="https://example.com/a.png" alt="a"/></div>`, out)
+
+	cfg := &Config{AllowedHTMLTags: []string{"p", "a"}, AllowedHTMLAttrs: []string{"href", "class"}}
+	require.Nil(t, validateAllowlist(cfg.AllowedHTMLTags, cfg.AllowedHTMLAttrs))
+	tags, attrs = cfg.htmlAllowlist()
+	out, err = sanitizeHTML(`<div><p class="a">Hello <em>there</em> <a href="https://example.com" title="t">link</a></p></div>`, tags, attrs)
+	require.Nil(t, err)
+	require.Equal(t, `<p class="a">Hello there <a href="https://example.com">link</a></p>`, out)
+
+	require.NotNil(t, validateAllowlist([]string{"script"}, nil))
+	require.NotNil(t, validateAllowlist([]string{"<p>"}, nil))
+	require.NotNil(t, validateAllowlist(nil, []string{"onerror"}))
+}
+
+func TestSanitizeHTML(t *testing.T) {
+	tags, attrs := (&Config{}).htmlAllowlist()
+	td := map[string]struct {
+		in       string
+		expected string
+	}{
+		"formatting survives": {
+			in:       `<p>Some <b>bold</b>, <em>emphasized</em> and <code>code</code></p><ul><li>item</li></ul>`,
+			expected: `<p>Some <b>bold</b>, <em>emphasized</em> and <code>code</code></p><ul><li>item</li></ul>`,
+		},
+		"links and images survive": {
+			in:       `<a href="https://example.com/post" title="Post">post</a><img src="https://example.com/a.png" alt="a" width="640" height="480">`,
+			expected: `<a href="https://example.com/post" title="Post">post</a><img src="https://example.com/a.png" alt="a" width="640" height="480"/>`,
+		},
+		"scripts and styles are removed": {
+			in:       `<p>before</p><script>alert(1)</script><style>p { display: none }</style><p>after</p>`,
+			expected: `<p>before</p><p>after</p>`,
+		},
+		"event handlers and inline styles are removed": {
+			in:       `<p onclick="alert(1)" style="color: red">text</p><img src="https://example.com/a.png" onerror="alert(1)">`,
+			expected: `<p>text</p><img src="https://example.com/a.png"/>`,
+		},
+		"frames and embedded documents are removed": {
+			in:       `<iframe src="https://example.com"></iframe><svg><script>alert(1)</script></svg><object data="x.swf"></object><meta http-equiv="refresh" content="0">ok`,
+			expected: `ok`,
+		},
+		"javascript urls are removed": {
+			in:       `<a href=" javascript:alert(1)">a</a><img srcset="https://example.com/a.png 1x, javascript:alert(1) 2x">`,
+			expected: `<a>a</a><img/>`,
+		},
+		"tracking pixels are removed": {
+			in:       `<p>text<img src="https://tracker.example.com/p.gif" width="1" height="1"><img src="https://example.com/icon.png" width="1px" height="0"></p><img src="https://example.com/wide.png" width="600" height="1">`,
+			expected: `<p>text</p><img src="https://example.com/wide.png" width="600" height="1"/>`,
+		},
+	}
+
+	for tn, tc := range td {
+		out, err := sanitizeHTML(tc.in, tags, attrs)
+		require.Nil(t, err, tn)
+		require.Equal(t, tc.expected, out, tn)
+	}
+}
+
+func BenchmarkPickNewData(b *testing.B) {
+	start := time.Date(2022, 8, 1, 0, 0, 0, 0, time.UTC)
+	fs := make([]*Feed, 500)
+	ts := map[string]time.Time{}
+	for i := range fs {
+		f := &Feed{ID: fmt.Sprintf("feed-%v", i), Title: fmt.Sprintf("Feed %v", i)}
+		for j := 0; j < 200; j++ {
+			f.Entries = append(f.Entries, &FeedEntry{
+				Title:   fmt.Sprintf("Entry %v", j),
+				Updated: start.Add(time.Duration((j*7919)%200) * time.Hour),
+				Content: "<p>Content</p>",
+			})
+		}
+		ts[f.ID] = start.Add(195 * time.Hour)
+		fs[i] = f
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pickNewData(fs, 3, ts)
+	}
+}
+
+func TestAutoDisableFailingFeed(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "<html><body>internal server error</body></html>")
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg := newTestConfig(t)
+	cfg.AutoDisableAfter = 3
+	feeds := `# feeds I read
+- name: broken # keeps failing
+  url: ` + srv.URL + `
+`
+	require.Nil(t, os.WriteFile(cfg.FeedsFile[0], []byte(feeds), 0o600))
+	msgs := captureDeliveries(t, 0)
+
+	for i := 0; i < 2; i++ {
+		require.Nil(t, feed(cfg, &FeederFlags{}))
+		fs, err := readFeedsConfig(cfg.FeedsFile[0])
+		require.Nil(t, err)
+		require.False(t, fs[0].Disabled)
+	}
+	require.Len(t, *msgs, 2)
+	require.NotContains(t, (*msgs)[1].Body, "disabled after repeated failures")
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 3)
+	require.Contains(t, (*msgs)[2].Body, "disabled after repeated failures")
+
+	bt, err := os.ReadFile(cfg.FeedsFile[0])
+	require.Nil(t, err)
+	require.Contains(t, string(bt), "# feeds I read")
+	require.Contains(t, string(bt), "# keeps failing")
+
+	fs, err := readFeedsConfig(cfg.FeedsFile[0])
+	require.Nil(t, err)
+	require.True(t, fs[0].Disabled)
+
+	st, err := readState(cfg.stateFile())
+	require.Nil(t, err)
+	require.Zero(t, st.Feeds[srv.URL].Failures)
+}
+
+func TestMultipleFeedsFiles(t *testing.T) {
+	dir := t.TempDir()
+	news := `- name: News
+  url: https://example.com/news.rss
+- name: Blog
+  url: https://example.com/blog.rss
+`
+	tech := `- name: Tech
+  url: https://example.com/tech.rss
+- name: Same blog
+  url: https://EXAMPLE.com/blog.rss
+`
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "feeds"), 0o700))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "feeds", "news.yml"), []byte(news), 0o600))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "feeds", "tech.yml"), []byte(tech), 0o600))
+
+	var cfg Config
+	require.Nil(t, yaml.Unmarshal([]byte(`feeds-file: `+filepath.Join(dir, "feeds", "*.yml")), &cfg))
+
+	fps, err := cfg.feedsFiles()
+	require.Nil(t, err)
+	fs, err := readFeedsConfigs(fps)
+	require.Nil(t, err)
+	require.Equal(t, []*ConfigFeed{
+		{Name: "News", URL: "https://example.com/news.rss"},
+		{Name: "Blog", URL: "https://example.com/blog.rss"},
+		{Name: "Tech", URL: "https://example.com/tech.rss"},
+	}, fs)
+
+	sf, err := cfg.subscribeFile()
+	require.Nil(t, err)
+	require.Equal(t, filepath.Join(dir, "feeds", "news.yml"), sf)
+
+	cfg = Config{}
+	list := fmt.Sprintf("feeds-file:\n  - %s\n  - %s\nsubscribe-file: %s\n",
+		filepath.Join(dir, "feeds", "tech.yml"), filepath.Join(dir, "feeds", "news.yml"), filepath.Join(dir, "new.yml"))
+	require.Nil(t, yaml.Unmarshal([]byte(list), &cfg))
+
+	fps, err = cfg.feedsFiles()
+	require.Nil(t, err)
+	fs, err = readFeedsConfigs(fps)
+	require.Nil(t, err)
+	require.Len(t, fs, 3)
+	require.Equal(t, "Same blog", fs[1].Name)
+
+	sf, err = cfg.subscribeFile()
+	require.Nil(t, err)
+	require.Equal(t, filepath.Join(dir, "new.yml"), sf)
+}
+
+func TestClampFutureDates(t *testing.T) {
+	downloaded := time.Date(2022, 8, 3, 8, 0, 0, 0, time.UTC)
+	fs := []*Feed{{
+		ID:    "feed",
+		Title: "Feed",
+		Entries: []*FeedEntry{
+			{Title: "Future", Updated: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)},
+			{Title: "Skewed", Updated: downloaded.Add(5 * time.Minute)},
+			{Title: "Real", Updated: downloaded.Add(-time.Hour)},
+		},
+		conf: &ConfigFeed{URL: "https://example.com/feed"},
+	}}
+	st := &State{}
+	st.clampFutureDates(fs, downloaded)
+	require.Equal(t, downloaded, fs[0].Entries[0].Updated)
+	require.Equal(t, downloaded.Add(5*time.Minute), fs[0].Entries[1].Updated)
+	require.Equal(t, downloaded.Add(-time.Hour), fs[0].Entries[2].Updated)
+
+	ts := map[string]time.Time{}
+	updateTimestamps(ts, pickNewData(fs, 3, ts))
+
+	fs[0].Entries = append(fs[0].Entries, &FeedEntry{Title: "Later", Updated: downloaded.Add(time.Hour)})
+	nd := pickNewData(fs, 3, ts)
+	require.Len(t, nd, 1)
+	require.Len(t, nd[0].Entries, 1)
+	require.Equal(t, "Later", nd[0].Entries[0].Title)
+}
+
+func TestFeedClampFutureDates(t *testing.T) {
+	future := `<item><title>Future</title><link>https://example.com/future</link><guid>https://example.com/future</guid><pubDate>Tue, 01 Jan 2030 00:00:00 +0000</pubDate></item>`
+	cfg := newTestConfig(t, strings.Replace(testRSS, "<item>", future+"<item>", 1))
+	cfg.ClampFutureDates = true
+	msgs := captureDeliveries(t, 0)
+
+	clock := time.Date(2022, 8, 3, 8, 0, 0, 0, time.UTC)
+	orig := now
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { now = orig })
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1)
+	require.Contains(t, (*msgs)[0].Body, "Future")
+
+	clock = clock.Add(time.Hour)
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+	require.Len(t, *msgs, 1, "future entry is sent only once")
+}
+
+func TestContentPipelineOrder(t *testing.T) {
+	newFeeds := func() []*Feed {
+		return []*Feed{{
+			Link:    "http://example.com/blog",
+			Entries: []*FeedEntry{{Title: "e1", Content: `<img src="/a.png" onerror="x()">`}},
+		}}
+	}
+
+	require.Equal(t, []string{"resolve-relative-urls", "truncate"}, (&Config{}).contentPipeline())
+	require.Equal(t,
+		[]string{"sanitize", "resolve-relative-urls", "upgrade-insecure-images", "truncate"},
+		(&Config{SanitizeHTML: true, UpgradeInsecureImages: "auto"}).contentPipeline(),
+	)
+
+	fs := newFeeds()
+	runContentPipeline(&Config{
+		UpgradeInsecureImages: "always",
+		ContentPipeline:       []string{"resolve-relative-urls", "upgrade-insecure-images", "sanitize"},
+	}, fs)
+	require.Contains(t, string(fs[0].Entries[0].Content), `<img src="https://example.com/a.png"/>`)
+
+	fs = newFeeds()
+	runContentPipeline(&Config{
+		UpgradeInsecureImages: "always",
+		ContentPipeline:       []string{"upgrade-insecure-images", "resolve-relative-urls"},
+	}, fs)
+	require.Contains(t, string(fs[0].Entries[0].Content), `<img src="http://example.com/a.png" onerror="x()"/>`)
+}
+
+func TestTimeoutFlag(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+		}
+		fmt.Fprint(w, testRSS)
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg := &Config{timeout: 50 * time.Millisecond}
+	require.Equal(t, 50*time.Millisecond, cfg.requestTimeout(openGraphTimeout))
+	require.Equal(t, openGraphTimeout, (&Config{}).requestTimeout(openGraphTimeout))
+
+	started := time.Now()
+	_, err := downloadFeed(cfg, &ConfigFeed{URL: srv.URL})
+	require.NotNil(t, err)
+	require.Less(t, time.Since(started), time.Second)
+}
+
+func TestDownloadFeedViaPOST(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPost || string(body) != `{"query": "{ posts { title } }"}` {
+			http.Error(w, "expected query", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"version": "https://jsonfeed.org/version/1.1", "title": "API %s", "home_page_url": "https://api.example.com/",
+"items": [{"id": "1", "url": "https://api.example.com/1", "title": "Post", "content_html": "<p>Hi</p>", "date_published": "2022-08-01T10:00:00Z"}]}`, r.Header.Get("Content-Type"))
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg := &Config{}
+	_, err := downloadFeed(cfg, &ConfigFeed{URL: srv.URL})
+	require.NotNil(t, err, "GET is rejected")
+
+	fc := &ConfigFeed{URL: srv.URL, Method: "post", Body: `{"query": "{ posts { title } }"}`}
+	f, err := downloadFeed(cfg, fc)
+	require.Nil(t, err)
+	require.Equal(t, "API application/json", f.Title)
+	require.Len(t, f.Entries, 1)
+	require.Equal(t, "Post", f.Entries[0].Title)
+
+	fc = &ConfigFeed{URL: srv.URL, Body: `{"query": "{ posts { title } }"}`, ContentType: "application/graphql+json"}
+	f, err = downloadFeed(cfg, fc)
+	require.Nil(t, err, "a body implies POST")
+	require.Equal(t, "API application/graphql+json", f.Title)
+
+	fn := filepath.Join(t.TempDir(), "feeds.yml")
+	require.Nil(t, os.WriteFile(fn, []byte("- name: api\n  url: https://api.example.com\n  method: DELETE\n"), 0o600))
+	_, err = readFeedsConfig(fn)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid method")
+}
+
+func TestHTTPTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+		fmt.Fprint(w, testRSS)
+	}))
+	t.Cleanup(srv.Close)
+
+	require.Equal(t, defaultHTTPTimeout, (&Config{}).feedTimeout(nil))
+	require.Equal(t, time.Minute, (&Config{HTTPTimeout: time.Minute}).feedTimeout(&ConfigFeed{}))
+	require.Equal(t, time.Second, (&Config{HTTPTimeout: time.Minute}).feedTimeout(&ConfigFeed{Timeout: time.Second}))
+	require.Equal(t, time.Millisecond, (&Config{timeout: time.Millisecond}).feedTimeout(&ConfigFeed{Timeout: time.Second}))
+
+	_, err := downloadFeed(&Config{HTTPTimeout: 20 * time.Millisecond}, &ConfigFeed{URL: srv.URL})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Timeout")
+
+	_, err = downloadFeed(&Config{}, &ConfigFeed{URL: srv.URL, Timeout: 20 * time.Millisecond})
+	require.NotNil(t, err, "per feed timeout applies")
+
+	cfg := &Config{HTTPTimeout: 20 * time.Millisecond}
+	f, err := downloadFeed(cfg, &ConfigFeed{URL: srv.URL, Timeout: 2 * time.Second})
+	require.Nil(t, err, "per feed timeout overrides http-timeout")
+	require.Equal(t, "Test Feed", f.Title)
+}
+
+func TestRotatingLogFile(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "feeder.log")
+	rf, err := openRotatingFile(fn, 100, 2)
+	require.Nil(t, err)
+	t.Cleanup(func() { rf.Close() })
+
+	logger := log.New(rf, "", 0)
+	logger.Printf("first line")
+	byt, err := os.ReadFile(fn)
+	require.Nil(t, err)
+	require.Equal(t, "first line\n", string(byt))
+
+	for i := 0; i < 12; i++ {
+		logger.Printf("line %02d %s", i, strings.Repeat("x", 30))
+	}
+
+	byt, err = os.ReadFile(fn)
+	require.Nil(t, err)
+	require.LessOrEqual(t, len(byt), 100)
+	require.Contains(t, string(byt), "line 11")
+
+	byt, err = os.ReadFile(fn + ".1")
+	require.Nil(t, err)
+	require.Contains(t, string(byt), "line 08")
+
+	_, err = os.Stat(fn + ".2")
+	require.Nil(t, err)
+	_, err = os.Stat(fn + ".3")
+	require.True(t, os.IsNotExist(err), "only keeps two rotated files")
+}
+
+func TestExplain(t *testing.T) {
+	serve := func(fn string) string {
+		byt, err := os.ReadFile(fn)
+		require.Nil(t, err)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(byt)
+		}))
+		t.Cleanup(srv.Close)
+		return srv.URL
+	}
+
+	var buf bytes.Buffer
+	require.Nil(t, explain(&buf, &Config{}, serve("test-data/date-no-time.rss")))
+	out := buf.String()
+	require.Contains(t, out, "format:  rss\n")
+	require.Contains(t, out, "entries: 1\n")
+	require.Contains(t, out, "updated: 2020-11-25T21:26:52Z\n")
+	require.Contains(t, out, `updated: 2020-11-23T00:00:00Z (from "2020-11-23")`)
+	require.Contains(t, out, "warnings:\n- entry 1 \"here's a post\" has no id\n")
+
+	buf.Reset()
+	require.Nil(t, explain(&buf, &Config{}, serve("test-data/jsonfeed.json")))
+	out = buf.String()
+	require.Contains(t, out, "format:  json\n")
+	require.Contains(t, out, "entries: 2\n")
+	require.Contains(t, out, `updated: 2022-08-02T12:30:00+02:00 (from "2022-08-02T12:30:00+02:00")`)
+	require.NotContains(t, out, "warnings:")
+
+	buf.Reset()
+	require.NotNil(t, explain(&buf, &Config{}, serve("test-data/sample_head.html")))
+}
+
+func TestPrintStatus(t *testing.T) {
+	cfg := newTestConfig(t, testRSS, "<html></html>")
+	captureDeliveries(t, 0)
+
+	clock := time.Date(2022, 8, 3, 8, 0, 0, 0, time.UTC)
+	orig := now
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { now = orig })
+
+	require.Nil(t, feed(cfg, &FeederFlags{}))
+
+	fcs, err := readFeedsConfig(cfg.FeedsFile[0])
+	require.Nil(t, err)
+
+	buf := &bytes.Buffer{}
+	require.Nil(t, printStatus(buf, cfg))
+
+	var status struct {
+		LastSend time.Time              `json:"last_send"`
+		Feeds    map[string]*FeedStatus `json:"feeds"`
+	}
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &status))
+	require.True(t, clock.Equal(status.LastSend))
+	require.Len(t, status.Feeds, 2)
+
+	ok := status.Feeds[fcs[0].URL]
+	require.True(t, clock.Equal(ok.LastSuccess))
+	require.Empty(t, ok.LastError)
+	require.Equal(t, 2, ok.NewEntries)
+	require.Zero(t, ok.Failures)
+
+	failed := status.Feeds[fcs[1].URL]
+	require.True(t, failed.LastSuccess.IsZero())
+	require.Contains(t, failed.LastError, "html")
+	require.Zero(t, failed.NewEntries)
+	require.Equal(t, 1, failed.Failures)
+}
+
+func TestIDLinkRel(t *testing.T) {
+	rss := `<?xml version="1.0"?><rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom"><channel><title>Multi Link</title>
+<atom:link href="https://example.com/feed?session=123" rel="self" type="application/rss+xml"/>
+<link>https://example.com/</link>
+<atom:link href="https://hub.example.com/" rel="hub"/>
+<item><title>Entry</title><guid>1</guid><pubDate>Mon, 01 Aug 2022 08:00:00 +0000</pubDate></item>
+</channel></rss>`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, rss)
+	}))
+	t.Cleanup(srv.Close)
+
+	f, err := downloadFeed(&Config{}, &ConfigFeed{URL: srv.URL})
+	require.Nil(t, err)
+	require.Equal(t, "https://example.com/feed?session=123", f.ID)
+
+	f, err = downloadFeed(&Config{}, &ConfigFeed{URL: srv.URL, IDLinkRel: "alternate"})
+	require.Nil(t, err)
+	require.Equal(t, "https://example.com/", f.ID)
+
+	f, err = downloadFeed(&Config{}, &ConfigFeed{URL: srv.URL, IDLinkRel: "hub"})
+	require.Nil(t, err)
+	require.Equal(t, "https://hub.example.com/", f.ID)
+
+	f, err = downloadFeed(&Config{}, &ConfigFeed{URL: srv.URL, IDLinkRel: "missing"})
+	require.Nil(t, err)
+	require.Equal(t, "https://example.com/feed?session=123", f.ID, "falls back to the default ID")
+}
+
+func TestDownloadPagedFeed(t *testing.T) {
+	page := func(w http.ResponseWriter, guids bool, next string, ids ...int) {
+		fmt.Fprint(w, `<?xml version="1.0"?><rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom"><channel><title>Paged</title><link>https://example.com/</link>`)
+		if next != "" {
+			fmt.Fprintf(w, `<atom:link href="%v" rel="next" type="application/rss+xml"/>`, next)
+		}
+		for _, i := range ids {
+			pub := time.Date(2022, 8, 1, i, 0, 0, 0, time.UTC).Format(time.RFC1123Z)
+			if guids {
+				fmt.Fprintf(w, `<item><title>Entry %v</title><guid>%v</guid><pubDate>%v</pubDate></item>`, i, i, pub)
+			} else {
+				fmt.Fprintf(w, `<item><title>Entry %v</title><link>https://example.com/%v</link><pubDate>%v</pubDate></item>`, i, i, pub)
+			}
+		}
+		fmt.Fprint(w, `</channel></rss>`)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		guids := r.URL.Path != "/no-guids"
+		switch r.URL.Query().Get("page") {
+		case "":
+			page(w, guids, r.URL.Path+"?page=2", 4, 3)
+		case "2":
+			page(w, guids, r.URL.Path+"?page=3", 3, 2)
+		default:
+			page(w, guids, r.URL.Path, 1)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	fc := &ConfigFeed{Name: "paged", URL: srv.URL + "/"}
+
+	f, err := downloadFeed(&Config{}, fc)
+	require.Nil(t, err)
+	require.Len(t, f.Entries, 2, "paging is disabled by default")
+
+	f, err = downloadFeed(&Config{MaxPages: 2}, fc)
+	require.Nil(t, err)
+	ids := []string{}
+	for _, e := range f.Entries {
+		ids = append(ids, e.ID)
+	}
+	require.Equal(t, []string{"4", "3", "2"}, ids)
+
+	f, err = downloadFeed(&Config{MaxPages: 10}, fc)
+	require.Nil(t, err)
+	require.Len(t, f.Entries, 4, "stops when the next page was already seen")
+	require.Equal(t, "https://example.com/", f.Link)
+
+	f, err = downloadFeed(&Config{MaxPages: 10}, &ConfigFeed{Name: "no-guids", URL: srv.URL + "/no-guids"})
+	require.Nil(t, err)
+	titles := []string{}
+	for _, e := range f.Entries {
+		titles = append(titles, e.Title)
+	}
+	require.Equal(t, []string{"Entry 4", "Entry 3", "Entry 2", "Entry 1"}, titles, "entries without guid are merged too")
+}
+
+func TestDownloadConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	running, peak := 0, 0
+	orig := fetchFeed
+	fetchFeed = func(cfg *Config, fc *ConfigFeed) (*Feed, error) {
+		mu.Lock()
+		running += 1
+		peak = max(peak, running)
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		running -= 1
+		mu.Unlock()
+		if strings.HasSuffix(fc.URL, "fail") {
+			return nil, fmt.Errorf("failed")
+		}
+		return &Feed{Title: fc.Name}, nil
+	}
+	t.Cleanup(func() { fetchFeed = orig })
+
+	fcs := []*ConfigFeed{}
+	for i := 0; i < 20; i++ {
+		u := fmt.Sprintf("https://example.com/%v", i)
+		if i%5 == 0 {
+			u += "/fail"
+		}
+		fcs = append(fcs, &ConfigFeed{Name: fmt.Sprint(i), URL: u})
+	}
+
+	succs, fails := downloadFeeds(&Config{MaxDownloads: 3}, fcs)
+	require.Len(t, succs, 16)
+	require.Len(t, fails, 4)
+	require.Equal(t, 3, peak)
+
+	peak = 0
+	succs, fails = downloadFeeds(&Config{}, fcs)
+	require.Len(t, succs, 16)
+	require.Len(t, fails, 4)
+	require.LessOrEqual(t, peak, defaultConcurrentDownloads)
+}
+
+func TestDownloadPerHostDelay(t *testing.T) {
+	var mu sync.Mutex
+	running := map[string]int{}
+	overlaps := 0
+	var ends []time.Time
+	var starts []time.Time
+	orig := fetchFeed
+	fetchFeed = func(cfg *Config, fc *ConfigFeed) (*Feed, error) {
+		u, err := url.Parse(fc.URL)
+		require.Nil(t, err)
+
+		mu.Lock()
+		running[u.Host] += 1
+		if running[u.Host] > 1 {
+			overlaps += 1
+		}
+		if u.Host == "example.com" {
+			starts = append(starts, time.Now())
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running[u.Host] -= 1
+		if u.Host == "example.com" {
+			ends = append(ends, time.Now())
+		}
+		mu.Unlock()
+		return &Feed{Title: fc.Name}, nil
+	}
+	t.Cleanup(func() { fetchFeed = orig })
+
+	fcs := []*ConfigFeed{
+		{Name: "one", URL: "https://example.com/r/one/.rss"},
+		{Name: "two", URL: "https://example.com/r/two/.rss"},
+		{Name: "other", URL: "https://example.org/feed"},
+	}
+	succs, _ := downloadFeeds(&Config{PerHostDelay: 20 * time.Millisecond}, fcs)
+	require.Len(t, succs, 3)
+	require.Zero(t, overlaps)
+	require.Len(t, starts, 2)
+	require.GreaterOrEqual(t, starts[1].Sub(ends[0]), 20*time.Millisecond)
+}
+
+func TestDownloadFeedsFetchDuration(t *testing.T) {
+	orig := fetchFeed
+	fetchFeed = func(cfg *Config, fc *ConfigFeed) (*Feed, error) {
+		time.Sleep(20 * time.Millisecond)
+		if strings.HasSuffix(fc.URL, "fail") {
+			return nil, fmt.Errorf("failed")
+		}
+		return &Feed{Title: fc.Name}, nil
+	}
+	t.Cleanup(func() { fetchFeed = orig })
+
+	fcs := []*ConfigFeed{
+		{Name: "slow", URL: "https://example.com/slow"},
+		{Name: "failing", URL: "https://example.com/fail"},
+	}
+	succs, fails := downloadFeeds(&Config{}, fcs)
+	require.Len(t, succs, 1)
+	require.Len(t, fails, 1)
+	require.GreaterOrEqual(t, succs[0].FetchDuration, 20*time.Millisecond)
+	require.GreaterOrEqual(t, fails[0].FetchDuration, 20*time.Millisecond)
+}
+
+func TestCompressedResponses(t *testing.T) {
+	compress := func(encoding string) []byte {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+		switch encoding {
+		case "gzip":
+			w = gzip.NewWriter(&buf)
+		case "deflate":
+			w = zlib.NewWriter(&buf)
+		default:
+			return []byte(testRSS)
+		}
+		_, err := w.Write([]byte(testRSS))
+		require.Nil(t, err)
+		require.Nil(t, w.Close())
+		return buf.Bytes()
+	}
+
+	td := map[string]struct {
+		header string
+		body   []byte
+	}{
+		"gzip":              {header: "gzip", body: compress("gzip")},
+		"deflate":           {header: "deflate", body: compress("deflate")},
+		"plain":             {body: compress("")},
+		"mislabelled plain": {header: "gzip", body: compress("")},
+	}
+
+	for tn, tc := range td {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "gzip, deflate", r.Header.Get("Accept-Encoding"), tn)
+			if tc.header != "" {
+				w.Header().Set("Content-Encoding", tc.header)
+			}
+			w.Write(tc.body)
+		}))
+
+		f, err := downloadFeed(&Config{}, &ConfigFeed{URL: srv.URL})
+		srv.Close()
+		require.Nil(t, err, tn)
+		require.Equal(t, "Test Feed", f.Title, tn)
+	}
+}
+
+func TestDownloadRetries(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests += 1
+		switch requests {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			fmt.Fprint(w, testRSS)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	fcs := []*ConfigFeed{{Name: "flaky", URL: srv.URL}}
+
+	succs, fails := downloadFeeds(&Config{Retries: 3, RetryBackoff: time.Millisecond}, fcs)
+	require.Len(t, succs, 1)
+	require.Empty(t, fails)
+	require.Equal(t, 3, requests)
+
+	requests = 0
+	succs, fails = downloadFeeds(&Config{Retries: 1, RetryBackoff: time.Millisecond}, fcs)
+	require.Empty(t, succs)
+	require.Len(t, fails, 1)
+	require.Contains(t, fails[0].Failure.Error(), "429")
+	require.Equal(t, 2, requests)
+
+	clock := time.Date(2022, 8, 3, 8, 0, 0, 0, time.UTC)
+	orig := now
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { now = orig })
+
+	require.Equal(t, 2*time.Second, retryAfter("2"))
+	require.Equal(t, 30*time.Second, retryAfter(clock.Add(30*time.Second).Format(http.TimeFormat)))
+	require.Equal(t, maxRetryAfter, retryAfter("86400"))
+	require.Equal(t, time.Duration(0), retryAfter("soon"))
+}
+
+func TestUseOldReddit(t *testing.T) {
+	newFeeds := func() []*Feed {
+		return []*Feed{{
+			Link: "https://www.reddit.com/r/golang/",
+			Entries: []*FeedEntry{{
+				Title: "Post",
+				Link:  "https://www.reddit.com/r/golang/comments/abc/post/",
+				Content: `<a href="https://www.reddit.com/user/gopher">/u/gopher</a> ` +
+					`<a href="https://i.redd.it/image.png">image</a> <a href="https://example.com/reddit.com">other</a>`,
+			}},
+		}}
+	}
+
+	fs := newFeeds()
+	runContentPipeline(&Config{}, fs)
+	require.Equal(t, "https://www.reddit.com/r/golang/comments/abc/post/", fs[0].Entries[0].Link)
+	require.Contains(t, string(fs[0].Entries[0].Content), "https://www.reddit.com/user/gopher")
+
+	fs = newFeeds()
+	runContentPipeline(&Config{Reddit: ConfigReddit{UseOldReddit: true}}, fs)
+	require.Equal(t, "https://old.reddit.com/r/golang/comments/abc/post/", fs[0].Entries[0].Link)
+	require.Equal(t,
+		template.HTML(`<a href="https://old.reddit.com/user/gopher">/u/gopher</a> `+
+			`<a href="https://i.redd.it/image.png">image</a> <a href="https://example.com/reddit.com">other</a>`),
+		fs[0].Entries[0].Content,
+	)
+}
+
+func TestTruncateContentsPerFeed(t *testing.T) {
+	content := `<p>The first paragraph is long enough.</p><p>The <em>second</em> paragraph.</p><img src="a.png">`
+	full := 0
+	fs := []*Feed{
+		{Title: "Truncated", Entries: []*FeedEntry{{Link: "https://example.com/1", Content: template.HTML(content)}}},
+		{Title: "Full", Entries: []*FeedEntry{{Link: "https://example.com/2", Content: template.HTML(content)}}, conf: &ConfigFeed{MaxContentChars: &full}},
+		{Title: "Short", Entries: []*FeedEntry{{Link: "https://example.com/3", Content: "<p>Short.</p>"}}},
+	}
+	runContentPipeline(&Config{MaxContentChars: 42}, fs)
+
+	require.Equal(t,
+		template.HTML(`<p>The first paragraph is long enough.</p><p>The <em>sec…</em></p><p><a href="https://example.com/1">Read more</a></p>`),
+		fs[0].Entries[0].Content,
+	)
+	require.Equal(t, template.HTML(content), fs[1].Entries[0].Content)
+	require.Equal(t, template.HTML("<p>Short.</p>"), fs[2].Entries[0].Content)
+}
+
+func TestImportOPML(t *testing.T) {
+	cfg := newTestConfig(t)
+	existing := []*ConfigFeed{{Name: "irreal", URL: "https://irreal.org/blog/?feed=rss2"}}
+	bt, err := yaml.Marshal(existing)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(cfg.FeedsFile[0], bt, 0o600))
+
+	fcs, err := readOPML("test-data/subscriptions.opml")
+	require.Nil(t, err)
+	require.Len(t, fcs, 5)
+
+	added, skipped, err := addFeeds(cfg, fcs)
+	require.Nil(t, err)
+	require.Equal(t, 3, added)
+	require.Equal(t, 2, skipped)
+
+	fs, err := readFeedsConfig(cfg.FeedsFile[0])
+	require.Nil(t, err)
+	require.Equal(t, []*ConfigFeed{
+		{Name: "irreal", URL: "https://irreal.org/blog/?feed=rss2"},
+		{Name: "The Go Blog", URL: "https://go.dev/blog/feed.atom"},
+		{Name: "Golang Weekly", URL: "https://golangweekly.com/rss"},
+		{Name: "Top level", URL: "https://example.com/feed.xml"},
+	}, fs)
+
+	added, skipped, err = addFeeds(cfg, fcs)
+	require.Nil(t, err)
+	require.Equal(t, 0, added)
+	require.Equal(t, 5, skipped)
+}
+
+func TestSubscribeFollowsPermanentRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/moved", http.RedirectHandler("/permanent", http.StatusMovedPermanently))
+	mux.Handle("/permanent", http.RedirectHandler("/feed", http.StatusPermanentRedirect))
+	mux.Handle("/temporary", http.RedirectHandler("/feed", http.StatusFound))
+	mux.Handle("/mixed", http.RedirectHandler("/temporary", http.StatusMovedPermanently))
+	mux.HandleFunc("/feed", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testRSS)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	td := map[string]string{
+		"/moved":     "/feed",
+		"/temporary": "/temporary",
+		"/mixed":     "/temporary",
+	}
+
+	for path, expected := range td {
+		cfg := newTestConfig(t)
+		subscribe(io.Discard, cfg, srv.URL+path, false, false)
+
+		fs, err := readFeedsConfig(cfg.FeedsFile[0])
+		require.Nil(t, err)
+		require.Len(t, fs, 1, path)
+		require.Equal(t, srv.URL+expected, fs[0].URL, path)
+		require.Equal(t, "Test Feed", fs[0].Name, path)
+	}
+}
+
+func TestSubscribePrintsJSON(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testRSS)
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg := newTestConfig(t)
+	var buf bytes.Buffer
+	subscribe(&buf, cfg, srv.URL+"/feed", false, true)
+
+	fs, err := readFeedsConfig(cfg.FeedsFile[0])
+	require.Nil(t, err)
+	require.Len(t, fs, 1)
+
+	var printed ConfigFeed
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &printed))
+	require.Equal(t, fs[0], &printed)
+	require.JSONEq(t, fmt.Sprintf(`{"name": "Test Feed", "url": "%s/feed", "disabled": false}`, srv.URL), buf.String())
+
+	buf.Reset()
+	subscribe(&buf, cfg, srv.URL+"/feed", false, true)
+	require.Empty(t, buf.String(), "already subscribed")
+
+	buf.Reset()
+	subscribe(&buf, cfg, srv.URL+"/other", false, false)
+	require.Empty(t, buf.String())
+}
+
+func TestReportFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	cfg := &Config{Email: ConfigEmail{From: "hans@example.com", Maildir: dir}, OutputFile: "-"}
+
+	reportFailure(cfg, fmt.Errorf("boom"))
+	_, err := os.Stat(dir)
+	require.True(t, os.IsNotExist(err), "no failure email with output-file")
+
+	cfg.OutputFile = ""
+	reportFailure(cfg, fmt.Errorf("boom"))
+	fs, err := os.ReadDir(filepath.Join(dir, "new"))
+	require.Nil(t, err)
+	require.Len(t, fs, 1)
+}
+
+func TestSendEmailToMaildir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	cfg := ConfigEmail{From: "hans@example.com", Maildir: dir}
+
+	require.Nil(t, sendEmail(cfg, &message{To: "hans@example.com, work@example.com", Body: "<p>html</p>", Text: "text"}))
+	require.Nil(t, sendEmail(cfg, &message{To: "hans@example.com", Body: "<p>second</p>"}))
+
+	fs, err := os.ReadDir(filepath.Join(dir, "new"))
+	require.Nil(t, err)
+	require.Len(t, fs, 2)
+	require.NotEqual(t, fs[0].Name(), fs[1].Name())
+	tmp, err := os.ReadDir(filepath.Join(dir, "tmp"))
+	require.Nil(t, err)
+	require.Empty(t, tmp)
+
+	rf, err := os.Open(filepath.Join(dir, "new", fs[0].Name()))
+	require.Nil(t, err)
+	defer rf.Close()
+	m, err := mail.ReadMessage(rf)
+	require.Nil(t, err)
+	require.Equal(t, "hans@example.com", m.Header.Get("From"))
+	to, err := m.Header.AddressList("To")
+	require.Nil(t, err)
+	require.Len(t, to, 2)
+	require.True(t, strings.HasPrefix(m.Header.Get("Subject"), "feeder update: "))
+	_, err = m.Header.Date()
+	require.Nil(t, err)
+	require.Equal(t, "1.0", m.Header.Get("Mime-Version"))
+	require.Contains(t, m.Header.Get("Content-Type"), "multipart/alternative")
+
+	fn := filepath.Join(t.TempDir(), "config.yml")
+	require.Nil(t, os.WriteFile(fn, []byte("feeds-file: feeds.yml\ntimestamp-file: ts.yml\nemail:\n  from: hans@example.com\n  maildir: "+dir+"\n"), 0o600))
+	c, err := readConfig(fn, true)
+	require.Nil(t, err, "smtp settings aren't required with a maildir")
+	require.Equal(t, dir, c.Email.Maildir)
+}
+
+func TestMessageIDDomain(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	cfg := ConfigEmail{From: "hans@example.com", Maildir: dir, MessageIDDomain: "mail.example.com"}
+
+	require.Nil(t, sendEmail(cfg, &message{To: "hans@example.com", Body: "<p>one</p>"}))
+	require.Nil(t, sendEmail(cfg, &message{To: "hans@example.com", Body: "<p>two</p>"}))
+
+	fs, err := os.ReadDir(filepath.Join(dir, "new"))
+	require.Nil(t, err)
+	require.Len(t, fs, 2)
+
+	ids := map[string]bool{}
+	for _, f := range fs {
+		rf, err := os.Open(filepath.Join(dir, "new", f.Name()))
+		require.Nil(t, err)
+		m, err := mail.ReadMessage(rf)
+		rf.Close()
+		require.Nil(t, err)
+
+		id := m.Header.Get("Message-Id")
+		require.True(t, strings.HasPrefix(id, "<"), id)
+		require.True(t, strings.HasSuffix(id, "@mail.example.com>"), id)
+		ids[id] = true
+	}
+	require.Len(t, ids, 2, "message ids are unique")
+
+	for domain, valid := range map[string]bool{
+		"example.com":       true,
+		"Mail.Example.COM":  true,
+		"localhost":         true,
+		"":                  false,
+		"-example.com":      false,
+		"example..com":      false,
+		"exa mple.com":      false,
+		"hans@example.com":  false,
+		"example.com/path":  false,
+		"mail.example.com.": false,
+	} {
+		require.Equal(t, valid, isDomain(domain), domain)
+	}
+
+	fn := filepath.Join(t.TempDir(), "config.yml")
+	require.Nil(t, os.WriteFile(fn, []byte("feeds-file: feeds.yml\ntimestamp-file: ts.yml\nemail:\n  from: hans@example.com\n  maildir: "+dir+"\n  message-id-domain: example..com\n"), 0o600))
+	_, err = readConfig(fn, true)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "message-id-domain")
+}
+
+func TestContentFetchConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, maxInFlight, requests := 0, 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight += 1
+		requests += 1
+		maxInFlight = max(maxInFlight, inFlight)
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprint(w, `<html><head><meta property="og:title" content="Title"></head></html>`)
+
+		mu.Lock()
+		inFlight -= 1
+		mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+
+	fs := []*Feed{{}, {}}
+	for i := 0; i < 10; i++ {
+		f := fs[i%2]
+		f.Entries = append(f.Entries, &FeedEntry{Link: fmt.Sprintf("%s/%v", srv.URL, i)})
+	}
+
+	cfg := &Config{MaxContentFetches: 2}
+	var wg sync.WaitGroup
+	for _, f := range fs {
+		wg.Add(1)
+		go func(f *Feed) {
+			defer wg.Done()
+			addOpenGraphPreviews(cfg, []*Feed{f})
+		}(f)
+	}
+	wg.Wait()
+	require.Equal(t, 10, requests)
+	require.Equal(t, 2, maxInFlight)
+	require.Equal(t, 2, cap(cfg.contentFetches()))
+	require.Equal(t, defaultContentFetchConcurrency, cap((&Config{}).contentFetches()))
+}
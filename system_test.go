@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
 
@@ -121,3 +127,116 @@ func TestSystem(t *testing.T) {
 	require.Equal(t, expected1, fs[1])
 	require.Equal(t, expected2, fs[2])
 }
+
+// smtpServer accepts mails without authentication and records their data.
+type smtpServer struct {
+	sync.Mutex
+	ln    net.Listener
+	mails []string
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	srv := &smtpServer{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+
+	return srv
+}
+
+func (s *smtpServer) port() int { return s.ln.Addr().(*net.TCPAddr).Port }
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	fmt.Fprint(conn, "220 localhost ESMTP\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			fmt.Fprint(conn, "250 localhost\r\n")
+		case strings.HasPrefix(cmd, "DATA"):
+			fmt.Fprint(conn, "354 go ahead\r\n")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(l)
+			}
+			s.Lock()
+			s.mails = append(s.mails, data.String())
+			s.Unlock()
+			fmt.Fprint(conn, "250 ok\r\n")
+		case strings.HasPrefix(cmd, "QUIT"):
+			fmt.Fprint(conn, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "250 ok\r\n")
+		}
+	}
+}
+
+func TestSystemExitCode(t *testing.T) {
+	build(t)
+
+	smtp := newSMTPServer(t)
+	feeds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			fmt.Fprint(w, "<html><body>not a feed</body></html>")
+			return
+		}
+		fmt.Fprint(w, testRSS)
+	}))
+	t.Cleanup(feeds.Close)
+
+	run := func(exitNonzero bool) int {
+		dir := t.TempDir()
+		fl := fmt.Sprintf("- name: working\n  url: %s/feed\n- name: broken\n  url: %s/broken\n", feeds.URL, feeds.URL)
+		require.Nil(t, os.WriteFile(filepath.Join(dir, "feeds.yml"), []byte(fl), 0o600))
+
+		cfg := fmt.Sprintf(`feeds-file: %s
+timestamp-file: %s
+exit-nonzero-on-failures: %v
+email:
+  from: hans@example.com
+  smtp:
+    host: 127.0.0.1
+    port: %v
+    user: hans@example.com
+    pass: password
+`, filepath.Join(dir, "feeds.yml"), filepath.Join(dir, "timestamps.yml"), exitNonzero, smtp.port())
+		fn := filepath.Join(dir, "config.yml")
+		require.Nil(t, os.WriteFile(fn, []byte(cfg), 0o600))
+
+		status, stdOut, stdErr := newCmd().run("./feeder", "-config", fn)
+		fmt.Printf(">> feeder -config %s stdout:\n%s\n", fn, stdOut)
+		fmt.Printf(">> feeder -config %s stderr:\n%s\n", fn, stdErr)
+		return status
+	}
+
+	require.Zero(t, run(false))
+	require.Equal(t, exitFeedFailures, run(true))
+
+	smtp.Lock()
+	defer smtp.Unlock()
+	require.Len(t, smtp.mails, 2)
+	require.Contains(t, smtp.mails[1], "Failed to process feed")
+}